@@ -0,0 +1,282 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// The JSON API under /pm-api/ is for headless access to pages and page data.
+// It only accepts API tokens sent as "Authorization: Bearer <token>" and
+// ignores session cookies, so it needs no CSRF protection.
+//
+//	GET /pm-api/pages?prefix=/blog/         list pages
+//	PUT /pm-api/pages                       create or update a page (body: a page)
+//	GET /pm-api/pagedata?url=&locale=       get a page's data
+//	PUT /pm-api/pagedata?url=&locale=       set a page's data
+//
+// Page data has the same shape as what the edit mode saves: an object mapping
+// each key to either a string or an array of row objects.
+func (pm *PageManager) serveAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := pm.loadAPIUser(r)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+		return
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pagemanager"`)
+		writeAPIError(w, http.StatusUnauthorized, errors.New("missing, invalid or expired API token"))
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), UserKey{}, user))
+	switch r.URL.Path {
+	case "/pm-api/pages":
+		switch r.Method {
+		case "GET":
+			pm.apiListPages(w, r)
+		case "PUT":
+			pm.apiPutPage(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	case "/pm-api/pagedata":
+		switch r.Method {
+		case "GET":
+			pm.apiGetPageData(w, r)
+		case "PUT":
+			pm.apiPutPageData(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (pm *PageManager) apiListPages(w http.ResponseWriter, r *http.Request) {
+	user, _ := CurrentUser(r)
+	pages := []exportPage{}
+	PAGES := tables.NEW_PAGES(r.Context(), "p")
+	var predicates []sq.Predicate
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		predicates = append(predicates, prefixPredicate(PAGES.URL, prefix))
+	}
+	_, err := sq.FetchContext(r.Context(), pm.dataDB, sq.SQLite.
+		From(PAGES).
+		Where(predicates...).
+		OrderBy(PAGES.URL),
+		func(row *sq.Row) error {
+			page := exportPage{
+				URL:         row.String(PAGES.URL),
+				Disabled:    nullBoolPtr(row.NullBool(PAGES.DISABLED)),
+				RedirectURL: nullStringPtr(row.NullString(PAGES.REDIRECT_URL)),
+				Plugin:      nullStringPtr(row.NullString(PAGES.PLUGIN)),
+				HandlerName: nullStringPtr(row.NullString(PAGES.HANDLER_NAME)),
+				HandlerURL:  nullStringPtr(row.NullString(PAGES.HANDLER_URL)),
+				Content:     nullStringPtr(row.NullString(PAGES.CONTENT)),
+				ThemePath:   nullStringPtr(row.NullString(PAGES.THEME_PATH)),
+				Template:    nullStringPtr(row.NullString(PAGES.TEMPLATE)),
+			}
+			return row.Accumulate(func() error {
+				if user.Can(page.URL, PageRead) {
+					pages = append(pages, page)
+				}
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, pages)
+}
+
+func (pm *PageManager) apiPutPage(w http.ResponseWriter, r *http.Request) {
+	user, _ := CurrentUser(r)
+	var page exportPage
+	err := json.NewDecoder(r.Body).Decode(&page)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !strings.HasPrefix(page.URL, "/") {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("url %q does not start with /", page.URL))
+		return
+	}
+	PAGES := tables.NEW_PAGES(r.Context(), "")
+	exists, err := sq.ExistsContext(r.Context(), pm.dataDB, sq.SQLite.From(PAGES).Where(PAGES.URL.EqString(page.URL)))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+		return
+	}
+	perm := PageCreate
+	if exists {
+		perm = PageUpdate
+	}
+	if !user.Can(page.URL, perm) {
+		writeAPIError(w, http.StatusForbidden, fmt.Errorf("not allowed to %s %s", FormatPagePerms(perm), page.URL))
+		return
+	}
+	var res ImportResult
+	err = sq.WithTxContext(r.Context(), pm.dataDB, nil, func(tx *sql.Tx) error {
+		return importPage(r.Context(), tx, &page, false, &res)
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+		return
+	}
+	status, action := http.StatusOK, AuditPageUpdate
+	if !exists {
+		status, action = http.StatusCreated, AuditPageCreate
+	}
+	if res.Updated > 0 || res.Inserted > 0 {
+		pm.audit(r.Context(), action, page.URL, page)
+		err = pm.indexPages(r.Context(), page.URL)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+			return
+		}
+	}
+	writeAPIJSON(w, status, page)
+}
+
+// apiLocale returns the locale code in r's locale query parameter, which must
+// be empty or a known locale.
+func (pm *PageManager) apiLocale(r *http.Request) (string, error) {
+	localeCode := r.URL.Query().Get("locale")
+	if localeCode == "" {
+		return "", nil
+	}
+	pm.localesMutex.RLock()
+	_, ok := pm.locales[tenantID(r.Context())][localeCode]
+	pm.localesMutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown locale %q", localeCode)
+	}
+	return localeCode, nil
+}
+
+func (pm *PageManager) apiGetPageData(w http.ResponseWriter, r *http.Request) {
+	user, _ := CurrentUser(r)
+	dataID := r.URL.Query().Get("url")
+	localeCode, err := pm.apiLocale(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !user.Can(dataID, PageRead) {
+		writeAPIError(w, http.StatusForbidden, fmt.Errorf("not allowed to read %s", dataID))
+		return
+	}
+	data := make(map[string]interface{})
+	PAGEDATA := tables.NEW_PAGEDATA(r.Context(), "pd")
+	_, err = sq.FetchContext(r.Context(), pm.dataDB, sq.SQLite.
+		From(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(dataID),
+		).
+		OrderBy(PAGEDATA.KEY, PAGEDATA.ARRAY_INDEX),
+		func(row *sq.Row) error {
+			key := row.String(PAGEDATA.KEY)
+			b := row.Bytes(PAGEDATA.VALUE)
+			arrayIndex := row.NullInt64(PAGEDATA.ARRAY_INDEX)
+			return row.Accumulate(func() error {
+				value, err := pm.openPageValue(string(b))
+				if err != nil {
+					return erro.Wrap(fmt.Errorf("%s: %w", key, err))
+				}
+				if !arrayIndex.Valid {
+					data[key] = value
+					return nil
+				}
+				rows, _ := data[key].([]json.RawMessage)
+				data[key] = append(rows, json.RawMessage(value))
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, data)
+}
+
+func (pm *PageManager) apiPutPageData(w http.ResponseWriter, r *http.Request) {
+	user, _ := CurrentUser(r)
+	dataID := r.URL.Query().Get("url")
+	localeCode, err := pm.apiLocale(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if dataID == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("missing url"))
+		return
+	}
+	if !user.Can(dataID, PageUpdate) {
+		writeAPIError(w, http.StatusForbidden, fmt.Errorf("not allowed to update %s", dataID))
+		return
+	}
+	var keys map[string]json.RawMessage
+	err = json.NewDecoder(r.Body).Decode(&keys)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = sq.WithTxContext(r.Context(), pm.dataDB, nil, func(tx *sql.Tx) error {
+		sensitive, err := pm.sensitiveKeys(r.Context(), tx, dataID)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for key, raw := range keys {
+			err := pm.savePageDataKey(r.Context(), tx, localeCode, dataID, key, raw, sensitive[key])
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errInvalidPageData) {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+		return
+	}
+	pm.auditPageDataSave(r.Context(), localeCode, dataID, keys)
+	if !strings.HasPrefix(dataID, blockDataIDPrefix) {
+		err = pm.indexPages(r.Context(), dataID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, erro.Wrap(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,414 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// apiTokenPrefix makes API tokens easy to recognize, e.g. by secret scanners.
+const apiTokenPrefix = "pmt_"
+
+// APIToken describes an API token. The token itself is only known when it
+// is created.
+type APIToken struct {
+	TokenID    int64
+	UserID     int64
+	Username   string
+	Name       string
+	Scope      Authz
+	CreatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+}
+
+// Expired reports whether the token can no longer be used.
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt.Valid && !time.Now().Before(t.ExpiresAt.Time)
+}
+
+// Perms returns the permissions the token grants, formatted like
+// "read,update".
+func (t APIToken) Perms() string {
+	perms := t.Scope.PagePerms
+	for _, prefixPerms := range t.Scope.PagePermsByPrefix {
+		perms |= prefixPerms
+	}
+	return FormatPagePerms(perms)
+}
+
+// Prefixes returns the URL prefixes the token is restricted to, or nil if it
+// applies to every page.
+func (t APIToken) Prefixes() []string {
+	var prefixes []string
+	for prefix := range t.Scope.PagePermsByPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// ParsePagePerms parses a comma separated list of "create", "read", "update"
+// and "delete" into PageCreate|PageRead|PageUpdate|PageDelete bit flags.
+func ParsePagePerms(s string) (int, error) {
+	var perms int
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "":
+		case "create":
+			perms |= PageCreate
+		case "read":
+			perms |= PageRead
+		case "update":
+			perms |= PageUpdate
+		case "delete":
+			perms |= PageDelete
+		default:
+			return 0, fmt.Errorf("unknown permission %q, want create, read, update or delete", name)
+		}
+	}
+	return perms, nil
+}
+
+// FormatPagePerms is the inverse of ParsePagePerms.
+func FormatPagePerms(perms int) string {
+	var names []string
+	for _, p := range []struct {
+		perm int
+		name string
+	}{{PageCreate, "create"}, {PageRead, "read"}, {PageUpdate, "update"}, {PageDelete, "delete"}} {
+		if perms&p.perm != 0 {
+			names = append(names, p.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// APITokenScope returns a scope granting perms on every data ID that starts
+// with one of prefixes, or on every data ID if there are no prefixes.
+func APITokenScope(perms int, prefixes []string) Authz {
+	var scope Authz
+	if len(prefixes) == 0 {
+		scope.PagePerms = perms
+		return scope
+	}
+	scope.PagePermsByPrefix = make(map[string]int)
+	for _, prefix := range prefixes {
+		scope.PagePermsByPrefix[prefix] |= perms
+	}
+	return scope
+}
+
+// CreateAPIToken creates an API token for userID (0 is the superadmin)
+// restricted to scope. A zero expiresAt means the token never expires. The
+// returned token is not stored anywhere and cannot be recovered later.
+func (pm *PageManager) CreateAPIToken(ctx context.Context, userID int64, name string, scope Authz, expiresAt time.Time) (tokenID int64, token string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return 0, "", erro.Wrap(err)
+	}
+	token = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	scopeData, err := json.Marshal(scope)
+	if err != nil {
+		return 0, "", erro.Wrap(err)
+	}
+	USERS, API_TOKENS := tables.NEW_USERS(ctx, ""), tables.NEW_API_TOKENS(ctx, "")
+	exists, err := sq.ExistsContext(ctx, pm.dataDB, sq.SQLite.From(USERS).Where(USERS.USER_ID.EqInt64(userID)))
+	if err != nil {
+		return 0, "", erro.Wrap(err)
+	}
+	if !exists {
+		return 0, "", erro.Wrap(fmt.Errorf("no such user %d", userID))
+	}
+	_, tokenID, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		InsertInto(API_TOKENS).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(API_TOKENS.TOKEN_HASH, hashToken(token))
+			col.SetInt64(API_TOKENS.USER_ID, userID)
+			col.SetString(API_TOKENS.NAME, name)
+			col.Set(API_TOKENS.AUTHZ_DATA, string(scopeData))
+			col.SetTime(API_TOKENS.CREATED_AT, time.Now().UTC())
+			if !expiresAt.IsZero() {
+				col.SetTime(API_TOKENS.EXPIRES_AT, expiresAt.UTC())
+			}
+			return nil
+		}),
+		sq.ElastInsertID,
+	)
+	if err != nil {
+		return 0, "", erro.Wrap(err)
+	}
+	payload := map[string]interface{}{
+		"owner": auditAccount(userID == 0, userID),
+		"name":  name,
+		"scope": scope,
+	}
+	if !expiresAt.IsZero() {
+		payload["expires_at"] = expiresAt.UTC()
+	}
+	pm.audit(ctx, AuditAPITokenCreate, "apitoken:"+strconv.FormatInt(tokenID, 10), payload)
+	return tokenID, token, nil
+}
+
+// APITokens lists the API tokens belonging to userID, or every API token if
+// userID is negative.
+func (pm *PageManager) APITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	var apiTokens []APIToken
+	API_TOKENS, USERS := tables.NEW_API_TOKENS(ctx, "t"), tables.NEW_USERS(ctx, "u")
+	var predicates []sq.Predicate
+	if userID >= 0 {
+		predicates = append(predicates, API_TOKENS.USER_ID.EqInt64(userID))
+	}
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(API_TOKENS).
+		LeftJoin(USERS, USERS.USER_ID.Eq(API_TOKENS.USER_ID)).
+		Where(predicates...).
+		OrderBy(API_TOKENS.TOKEN_ID),
+		func(row *sq.Row) error {
+			t := APIToken{
+				TokenID:    row.Int64(API_TOKENS.TOKEN_ID),
+				UserID:     row.Int64(API_TOKENS.USER_ID),
+				Username:   row.String(USERS.USERNAME),
+				Name:       row.String(API_TOKENS.NAME),
+				CreatedAt:  row.Time(API_TOKENS.CREATED_AT),
+				ExpiresAt:  row.NullTime(API_TOKENS.EXPIRES_AT),
+				LastUsedAt: row.NullTime(API_TOKENS.LAST_USED_AT),
+			}
+			scopeData := row.Bytes(API_TOKENS.AUTHZ_DATA)
+			return row.Accumulate(func() error {
+				if t.UserID == 0 && t.Username == "" {
+					t.Username = "superadmin"
+				}
+				if len(scopeData) > 0 {
+					err := json.Unmarshal(scopeData, &t.Scope)
+					if err != nil {
+						return erro.Wrap(err)
+					}
+				}
+				apiTokens = append(apiTokens, t)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return apiTokens, nil
+}
+
+// RevokeAPIToken deletes an API token. If userID is not negative, the token
+// must belong to userID.
+func (pm *PageManager) RevokeAPIToken(ctx context.Context, tokenID, userID int64) error {
+	API_TOKENS := tables.NEW_API_TOKENS(ctx, "")
+	predicates := []sq.Predicate{API_TOKENS.TOKEN_ID.EqInt64(tokenID)}
+	if userID >= 0 {
+		predicates = append(predicates, API_TOKENS.USER_ID.EqInt64(userID))
+	}
+	rowsAffected, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(API_TOKENS).
+		Where(predicates...),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return erro.Wrap(fmt.Errorf("no such API token %d", tokenID))
+	}
+	pm.audit(ctx, AuditAPITokenRevoke, "apitoken:"+strconv.FormatInt(tokenID, 10), nil)
+	return nil
+}
+
+// loadAPIUser resolves the bearer token in r's Authorization header to a
+// User whose permissions are the intersection of the user's own and the
+// token's scope. It returns false if there is no bearer token or it is
+// unknown or expired.
+func (pm *PageManager) loadAPIUser(r *http.Request) (User, bool, error) {
+	var user User
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || !strings.HasPrefix(token, apiTokenPrefix) {
+		return user, false, nil
+	}
+	ctx := r.Context()
+	var tokenID int64
+	var expiresAt sql.NullTime
+	var scopeData, authzData, authzGroups []byte
+	API_TOKENS, USERS := tables.NEW_API_TOKENS(ctx, "t"), tables.NEW_USERS(ctx, "u")
+	rowCount, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(API_TOKENS).
+		Join(USERS, USERS.USER_ID.Eq(API_TOKENS.USER_ID)).
+		Where(API_TOKENS.TOKEN_HASH.EqString(hashToken(token))),
+		func(row *sq.Row) error {
+			tokenID = row.Int64(API_TOKENS.TOKEN_ID)
+			expiresAt = row.NullTime(API_TOKENS.EXPIRES_AT)
+			scopeData = row.Bytes(API_TOKENS.AUTHZ_DATA)
+			user.UserID = row.Int64(USERS.USER_ID)
+			user.PublicUserID = row.String(USERS.PUBLIC_USER_ID)
+			user.Username = row.String(USERS.USERNAME)
+			authzData = row.Bytes(USERS.AUTHZ_DATA)
+			authzGroups = row.Bytes(USERS.AUTHZ_GROUPS)
+			return nil
+		},
+	)
+	if err != nil {
+		return user, false, erro.Wrap(err)
+	}
+	now := time.Now().UTC()
+	if rowCount == 0 || (expiresAt.Valid && !now.Before(expiresAt.Time)) {
+		return user, false, nil
+	}
+	if len(authzGroups) > 0 {
+		err = json.Unmarshal(authzGroups, &user.AuthzGroups)
+		if err != nil {
+			return user, false, erro.Wrap(err)
+		}
+	}
+	user.Authz, err = loadAuthz(ctx, pm.dataDB, authzData, user.AuthzGroups)
+	if err != nil {
+		return user, false, erro.Wrap(err)
+	}
+	user.apiTokenID = tokenID
+	user.tokenScope = &Authz{}
+	if len(scopeData) > 0 {
+		err = json.Unmarshal(scopeData, user.tokenScope)
+		if err != nil {
+			return user, false, erro.Wrap(err)
+		}
+	}
+	if user.UserID == 0 {
+		user.Superadmin = true
+		user.Username = "superadmin"
+	}
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		Update(API_TOKENS).
+		Setx(func(col *sq.Column) error {
+			col.SetTime(API_TOKENS.LAST_USED_AT, now)
+			return nil
+		}).
+		Where(API_TOKENS.TOKEN_ID.EqInt64(tokenID)),
+		0,
+	)
+	if err != nil {
+		return user, false, erro.Wrap(err)
+	}
+	return user, true, nil
+}
+
+// apiTokensPage lets the logged in user create, list and revoke their API
+// tokens. The superadmin sees everyone's tokens.
+func (pm *PageManager) apiTokensPage(w http.ResponseWriter, r *http.Request) {
+	const errorCookieName = "pm-api-tokens-error"
+	type Data struct {
+		Tokens     []APIToken
+		Superadmin bool
+		NewToken   string
+		Error      string
+		CSRFToken  string
+	}
+	user, ok := CurrentUser(r)
+	if !ok {
+		http.Redirect(w, r, "/pm-login", http.StatusFound)
+		return
+	}
+	owner := user.UserID
+	if user.Superadmin {
+		owner = -1
+	}
+	data := Data{Superadmin: user.Superadmin}
+	switch r.Method {
+	case "GET":
+		_ = hyforms.CookiePop(w, r, errorCookieName, &data.Error)
+	case "POST":
+		if !checkCSRF(w, r) {
+			return
+		}
+		if tokenID := r.FormValue("revoke"); tokenID != "" {
+			id, err := strconv.ParseInt(tokenID, 10, 64)
+			if err == nil {
+				err = pm.RevokeAPIToken(r.Context(), id, owner)
+			}
+			if err != nil {
+				_ = hyforms.CookieSet(w, errorCookieName, err.Error(), nil)
+			}
+			http.Redirect(w, r, "/pm-api-tokens", http.StatusFound)
+			return
+		}
+		token, err := pm.createAPITokenFromForm(r, user)
+		if err != nil {
+			_ = hyforms.CookieSet(w, errorCookieName, err.Error(), nil)
+			http.Redirect(w, r, "/pm-api-tokens", http.StatusFound)
+			return
+		}
+		// the token is only ever shown here, so render it directly instead
+		// of redirecting
+		data.NewToken = token
+	}
+	var err error
+	data.CSRFToken, err = hyforms.CSRFToken(w, r)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Tokens, err = pm.APITokens(r.Context(), owner)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := pm.parseTemplates(templatesFS, "api-tokens.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (pm *PageManager) createAPITokenFromForm(r *http.Request, user User) (token string, err error) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return "", fmt.Errorf("the token needs a name")
+	}
+	perms, err := ParsePagePerms(strings.Join(r.Form["perms"], ","))
+	if err != nil {
+		return "", err
+	}
+	if perms == 0 {
+		return "", fmt.Errorf("the token needs at least one permission")
+	}
+	var prefixes []string
+	for _, prefix := range strings.Split(r.FormValue("prefixes"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	var expiresAt time.Time
+	if days := r.FormValue("expires-in-days"); days != "" && days != "0" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid number of days %q", days)
+		}
+		expiresAt = time.Now().AddDate(0, 0, n)
+	}
+	_, token, err = pm.CreateAPIToken(r.Context(), user.UserID, name, APITokenScope(perms, prefixes), expiresAt)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return token, nil
+}
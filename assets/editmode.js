@@ -623,7 +623,8 @@ document.addEventListener("DOMContentLoaded", function main() {
     async function save() {
       const data = {};
       const indextracker = {};
-      const pageID = window.Env("PageID").replace(/\/edit$/, "");
+      const page = pmJSONValue("pm-page") || {};
+      const pageID = page.dataID;
       for (const node of document.querySelectorAll("[data-pm\\.row]")) {
         if (node.getAttribute("hidden") !== null) {
           continue;
@@ -665,6 +666,7 @@ document.addEventListener("DOMContentLoaded", function main() {
       console.log(data);
       console.log(imgs);
       const formdata = new FormData();
+      formdata.append("pm-locale", page.locale || "");
       for (const [key, value] of Object.entries(data)) {
         formdata.append(key, JSON.stringify(value));
       }
@@ -675,11 +677,14 @@ document.addEventListener("DOMContentLoaded", function main() {
       for (const [key, value] of formdata.entries()) {
         console.log(key + ", " + value);
       }
-      const res = await fetch("/upload", {
+      const res = await fetch("/pm-save", {
         method: "POST",
+        headers: { "X-CSRF-Token": page.csrfToken || "" },
         body: formdata,
       });
-      console.log(res);
+      if (!res.ok) {
+        alert(`Saving failed: ${res.status} ${await res.text()}`);
+      }
     }
 
     function pathToKeys(path) {
@@ -730,8 +735,59 @@ document.addEventListener("DOMContentLoaded", function main() {
   }
 
   function pmContenteditable(node) {
+    const key = node.getAttribute("data-pm.key") || node.getAttribute("data-pm.row.key");
+    const field = pmSchema()[key] || {};
+    if (field.Type === "bool") {
+      node.classList.add("pointer");
+      node.addEventListener("click", function () {
+        node.textContent = node.textContent.trim() === "true" ? "false" : "true";
+      });
+      return;
+    }
     node.setAttribute("contenteditable", true);
     node.classList.add("contenteditable");
+    if (field.Type === "int" || field.Type === "time" || field.Type === "json") {
+      node.addEventListener("blur", function () {
+        node.classList.toggle("pm-invalid", !isValid(field.Type, node.textContent.trim()));
+      });
+    }
+
+    function isValid(type, value) {
+      switch (type) {
+        case "int":
+          return /^-?\d+$/.test(value);
+        case "time":
+          return !isNaN(Date.parse(value));
+        case "json":
+          try {
+            JSON.parse(value);
+            return true;
+          } catch {
+            return false;
+          }
+      }
+      return true;
+    }
+  }
+
+  /**
+   * pmSchema returns the page data schema declared by the current template's
+   * theme-config.js, keyed by page data key.
+   */
+  function pmSchema() {
+    return pmJSONValue("pm-schema") || {};
+  }
+
+  /**
+   * pmJSONValue returns the value of name in the page's data-pm-json script.
+   */
+  function pmJSONValue(name) {
+    const el = document.querySelector(`script[type="application/json"][data-pm-json]`);
+    try {
+      return JSON.parse((el && el.textContent) || "{}")[name];
+    } catch {
+      return undefined;
+    }
   }
 
   function pmImagePicker(img) {
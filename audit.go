@@ -0,0 +1,486 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Audit log actions. Plugins may record their own actions with Audit, and
+// should namespace them by plugin name.
+const (
+	AuditLoginSuccess     = "login.success"
+	AuditLoginFailure     = "login.failure"
+	AuditLoginLocked      = "login.locked"
+	AuditSessionCreate    = "session.create"
+	AuditSessionRevoke    = "session.revoke"
+	AuditPasswordChange   = "password.change"
+	AuditPageCreate       = "page.create"
+	AuditPageUpdate       = "page.update"
+	AuditPageDataSave     = "pagedata.save"
+	AuditContentImport    = "content.import"
+	AuditBlockCreate      = "block.create"
+	AuditBlockDelete      = "block.delete"
+	AuditKeyRotate        = "key.rotate"
+	AuditKeyRetire        = "key.retire"
+	AuditKeyUnlock        = "key.unlock"
+	AuditAPITokenCreate   = "apitoken.create"
+	AuditAPITokenRevoke   = "apitoken.revoke"
+	AuditTwoFactorEnable  = "2fa.enable"
+	AuditTwoFactorDisable = "2fa.disable"
+	AuditTenantCreate     = "tenant.create"
+	AuditTenantDelete     = "tenant.delete"
+)
+
+// AuditEntry is one row of the audit log.
+type AuditEntry struct {
+	AuditID     int64
+	CreatedAt   time.Time
+	Action      string
+	Actor       string // username, "superadmin", or empty for anonymous and command line actions
+	ActorUserID sql.NullInt64
+	IP          string
+	Target      string
+	Payload     json.RawMessage
+	MAC         string // empty until the entry is sealed
+}
+
+// clientIPKey is the request context key for the client's IP address, so that
+// code deeper down than the handler can still audit it.
+type clientIPKey struct{}
+
+// ensureAuditLogTriggers makes the audit log append-only: rows cannot be
+// deleted, and the only update allowed is sealing an unsealed row.
+func ensureAuditLogTriggers(ctx context.Context, db sq.Queryer) error {
+	AUDIT_LOG := tables.NEW_AUDIT_LOG(ctx, "")
+	name := AUDIT_LOG.GetName()
+	for _, query := range []string{
+		"CREATE TRIGGER IF NOT EXISTS " + name + "_no_delete BEFORE DELETE ON " + name +
+			" BEGIN SELECT RAISE(ABORT, '" + name + " is append-only'); END",
+		"CREATE TRIGGER IF NOT EXISTS " + name + "_no_update BEFORE UPDATE ON " + name +
+			" WHEN OLD.mac IS NOT NULL" +
+			" OR NEW.audit_id IS NOT OLD.audit_id" +
+			" OR NEW.created_at IS NOT OLD.created_at" +
+			" OR NEW.action IS NOT OLD.action" +
+			" OR NEW.actor IS NOT OLD.actor" +
+			" OR NEW.actor_user_id IS NOT OLD.actor_user_id" +
+			" OR NEW.ip IS NOT OLD.ip" +
+			" OR NEW.target IS NOT OLD.target" +
+			" OR NEW.payload IS NOT OLD.payload" +
+			" BEGIN SELECT RAISE(ABORT, '" + name + " is append-only'); END",
+	} {
+		_, err := db.ExecContext(ctx, query)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Audit appends an entry to the audit log. The actor and IP address are taken
+// from ctx, which is normally a request context. payload is marshaled to JSON
+// and may be nil.
+func (pm *PageManager) Audit(ctx context.Context, action, target string, payload interface{}) error {
+	entry := AuditEntry{
+		CreatedAt: time.Now().UTC(),
+		Action:    action,
+		Target:    target,
+	}
+	entry.IP, _ = ctx.Value(clientIPKey{}).(string)
+	if user, ok := UserFromContext(ctx); ok {
+		entry.ActorUserID = sql.NullInt64{Int64: user.UserID, Valid: true}
+		entry.Actor = user.Username
+		if user.Superadmin {
+			entry.Actor = "superadmin"
+		} else if entry.Actor == "" {
+			USERS := tables.NEW_USERS(ctx, "u")
+			_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+				From(USERS).
+				Where(USERS.USER_ID.EqInt64(user.UserID)),
+				func(row *sq.Row) error {
+					entry.Actor = row.String(USERS.USERNAME)
+					return nil
+				},
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		if user.apiTokenID != 0 {
+			entry.Actor += " (API token " + strconv.FormatInt(user.apiTokenID, 10) + ")"
+		}
+	}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		entry.Payload = b
+	}
+	AUDIT_LOG := tables.NEW_AUDIT_LOG(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		InsertInto(AUDIT_LOG).
+		Valuesx(func(col *sq.Column) error {
+			col.SetTime(AUDIT_LOG.CREATED_AT, entry.CreatedAt)
+			col.SetString(AUDIT_LOG.ACTION, entry.Action)
+			col.SetString(AUDIT_LOG.ACTOR, entry.Actor)
+			col.Set(AUDIT_LOG.ACTOR_USER_ID, entry.ActorUserID)
+			col.SetString(AUDIT_LOG.IP, entry.IP)
+			col.SetString(AUDIT_LOG.TARGET, entry.Target)
+			if entry.Payload != nil {
+				col.Set(AUDIT_LOG.PAYLOAD, string(entry.Payload))
+			}
+			return nil
+		}),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.sealAuditLog(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// audit is Audit for callers that should not fail because the audit log
+// could not be written.
+func (pm *PageManager) audit(ctx context.Context, action, target string, payload interface{}) {
+	err := pm.Audit(ctx, action, target, payload)
+	if err != nil {
+		log.Printf("audit: %s %s: %s", action, target, err)
+	}
+}
+
+// auditMAC returns the MAC of entry chained onto prevMAC.
+func auditMAC(macKey []byte, prevMAC string, entry AuditEntry) string {
+	var actorUserID string
+	if entry.ActorUserID.Valid {
+		actorUserID = strconv.FormatInt(entry.ActorUserID.Int64, 10)
+	}
+	return makeMAC(macKey, strings.Join([]string{
+		prevMAC,
+		strconv.FormatInt(entry.AuditID, 10),
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+		entry.Action,
+		entry.Actor,
+		actorUserID,
+		entry.IP,
+		entry.Target,
+		string(entry.Payload),
+	}, "\x00"))
+}
+
+func scanAuditEntry(row *sq.Row, AUDIT_LOG tables.PM_AUDIT_LOG) AuditEntry {
+	return AuditEntry{
+		AuditID:     row.Int64(AUDIT_LOG.AUDIT_ID),
+		CreatedAt:   row.Time(AUDIT_LOG.CREATED_AT),
+		Action:      row.String(AUDIT_LOG.ACTION),
+		Actor:       row.String(AUDIT_LOG.ACTOR),
+		ActorUserID: row.NullInt64(AUDIT_LOG.ACTOR_USER_ID),
+		IP:          row.String(AUDIT_LOG.IP),
+		Target:      row.String(AUDIT_LOG.TARGET),
+		Payload:     json.RawMessage(row.Bytes(AUDIT_LOG.PAYLOAD)),
+		MAC:         row.String(AUDIT_LOG.MAC),
+	}
+}
+
+// sealAuditLog MACs every unsealed entry in order. Entries written while the
+// MAC keys are locked stay unsealed until the superadmin logs in.
+func (pm *PageManager) sealAuditLog(ctx context.Context) error {
+	pm.keysMutex.RLock()
+	locked := len(pm.innerMACKey) == 0
+	pm.keysMutex.RUnlock()
+	if locked {
+		return nil
+	}
+	macKeys, err := pm.macKeys(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.auditMutex.Lock()
+	defer pm.auditMutex.Unlock()
+	return sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		var prevMAC string
+		var entries []AuditEntry
+		AUDIT_LOG := tables.NEW_AUDIT_LOG(ctx, "")
+		_, err := sq.FetchContext(ctx, tx, sq.SQLite.
+			From(AUDIT_LOG).
+			Where(AUDIT_LOG.MAC.IsNotNull()).
+			OrderBy(AUDIT_LOG.AUDIT_ID.Desc()).
+			Limit(1),
+			func(row *sq.Row) error {
+				prevMAC = row.String(AUDIT_LOG.MAC)
+				return nil
+			},
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, err = sq.FetchContext(ctx, tx, sq.SQLite.
+			From(AUDIT_LOG).
+			Where(AUDIT_LOG.MAC.IsNull()).
+			OrderBy(AUDIT_LOG.AUDIT_ID),
+			func(row *sq.Row) error {
+				entry := scanAuditEntry(row, AUDIT_LOG)
+				return row.Accumulate(func() error {
+					entries = append(entries, entry)
+					return nil
+				})
+			},
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, entry := range entries {
+			mac := auditMAC(macKeys[0], prevMAC, entry)
+			_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+				Update(AUDIT_LOG).
+				Setx(func(col *sq.Column) error {
+					col.SetString(AUDIT_LOG.MAC, mac)
+					return nil
+				}).
+				Where(AUDIT_LOG.AUDIT_ID.EqInt64(entry.AuditID)),
+				0,
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			prevMAC = mac
+		}
+		return nil
+	})
+}
+
+// AuditVerification is the result of VerifyAuditLog.
+type AuditVerification struct {
+	Entries  int
+	Unsealed int
+	// BrokenAt is the ID of the first entry whose MAC does not match, or 0
+	// if the chain is intact.
+	BrokenAt int64
+}
+
+// VerifyAuditLog walks the audit log's MAC chain. It needs the MAC keys to be
+// unlocked. Entries removed from the end of the log cannot be detected; every
+// other edit, deletion or reordering can.
+func (pm *PageManager) VerifyAuditLog(ctx context.Context) (AuditVerification, error) {
+	var v AuditVerification
+	macKeys, err := pm.macKeys(ctx)
+	if err != nil {
+		return v, erro.Wrap(err)
+	}
+	var prevMAC string
+	AUDIT_LOG := tables.NEW_AUDIT_LOG(ctx, "")
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(AUDIT_LOG).
+		OrderBy(AUDIT_LOG.AUDIT_ID),
+		func(row *sq.Row) error {
+			entry := scanAuditEntry(row, AUDIT_LOG)
+			return row.Accumulate(func() error {
+				v.Entries++
+				if v.BrokenAt != 0 {
+					return nil
+				}
+				if entry.MAC == "" {
+					v.Unsealed++
+					return nil
+				}
+				// a sealed entry after an unsealed one means the chain was
+				// tampered with, since sealing always goes in order
+				if v.Unsealed > 0 {
+					v.BrokenAt = entry.AuditID
+					return nil
+				}
+				ok := false
+				for _, macKey := range macKeys {
+					if auditMAC(macKey, prevMAC, entry) == entry.MAC {
+						ok = true
+						break
+					}
+				}
+				if !ok {
+					v.BrokenAt = entry.AuditID
+					return nil
+				}
+				prevMAC = entry.MAC
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return v, erro.Wrap(err)
+	}
+	return v, nil
+}
+
+// AuditFilter narrows down the entries returned by AuditLog. The zero value
+// matches everything.
+type AuditFilter struct {
+	Action   string // prefix, so "login." matches every login action
+	Actor    string
+	Target   string // prefix
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	BeforeID int64 // for paging: only entries older than this ID
+	Limit    int   // defaults to 100
+}
+
+// AuditLog returns the audit log entries matching filter, newest first.
+func (pm *PageManager) AuditLog(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	AUDIT_LOG := tables.NEW_AUDIT_LOG(ctx, "")
+	var predicates []sq.Predicate
+	if filter.Action != "" {
+		predicates = append(predicates, prefixPredicate(AUDIT_LOG.ACTION, filter.Action))
+	}
+	if filter.Actor != "" {
+		predicates = append(predicates, AUDIT_LOG.ACTOR.EqString(filter.Actor))
+	}
+	if filter.Target != "" {
+		predicates = append(predicates, prefixPredicate(AUDIT_LOG.TARGET, filter.Target))
+	}
+	if filter.IP != "" {
+		predicates = append(predicates, AUDIT_LOG.IP.EqString(filter.IP))
+	}
+	if !filter.Since.IsZero() {
+		predicates = append(predicates, AUDIT_LOG.CREATED_AT.GeTime(filter.Since.UTC()))
+	}
+	if !filter.Until.IsZero() {
+		predicates = append(predicates, AUDIT_LOG.CREATED_AT.LtTime(filter.Until.UTC()))
+	}
+	if filter.BeforeID > 0 {
+		predicates = append(predicates, AUDIT_LOG.AUDIT_ID.LtInt64(filter.BeforeID))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(AUDIT_LOG).
+		Where(predicates...).
+		OrderBy(AUDIT_LOG.AUDIT_ID.Desc()).
+		Limit(int64(limit)),
+		func(row *sq.Row) error {
+			entry := scanAuditEntry(row, AUDIT_LOG)
+			return row.Accumulate(func() error {
+				entries = append(entries, entry)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return entries, nil
+}
+
+// auditLogPage shows the audit log to the superadmin.
+func (pm *PageManager) auditLogPage(w http.ResponseWriter, r *http.Request) {
+	type Data struct {
+		Entries      []AuditEntry
+		Filter       AuditFilter
+		Verified     bool
+		Verification AuditVerification
+		VerifyError  string
+		NextPage     string
+	}
+	user, _ := CurrentUser(r)
+	if !user.Superadmin {
+		pm.forbidden(w, r)
+		return
+	}
+	var data Data
+	data.Filter = AuditFilter{
+		Limit:  100,
+		Action: r.FormValue("action"),
+		Actor:  r.FormValue("actor"),
+		Target: r.FormValue("target"),
+		IP:     r.FormValue("ip"),
+	}
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &data.Filter.Since}, {"until", &data.Filter.Until}} {
+		if value := r.FormValue(param.name); value != "" {
+			t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s date %q, want YYYY-MM-DD", param.name, value), http.StatusBadRequest)
+				return
+			}
+			*param.dest = t
+		}
+	}
+	if before := r.FormValue("before"); before != "" {
+		data.Filter.BeforeID, _ = strconv.ParseInt(before, 10, 64)
+	}
+	var err error
+	data.Entries, err = pm.AuditLog(r.Context(), data.Filter)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(data.Entries) == data.Filter.Limit {
+		query := r.URL.Query()
+		query.Set("before", strconv.FormatInt(data.Entries[len(data.Entries)-1].AuditID, 10))
+		data.NextPage = "/pm-audit?" + query.Encode()
+	}
+	// verifying walks the whole log, so it is only done when asked for
+	if r.FormValue("verify") != "" {
+		data.Verified = true
+		data.Verification, err = pm.VerifyAuditLog(r.Context())
+		if err != nil {
+			data.VerifyError = err.Error()
+		}
+	}
+	t, err := pm.parseTemplates(templatesFS, "audit-log.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// auditAccount formats a user account as an audit log target.
+func auditAccount(superadmin bool, userID int64) string {
+	if superadmin {
+		return "superadmin"
+	}
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+func (pm *PageManager) auditPageDataSave(ctx context.Context, localeCode, dataID string, keys map[string]json.RawMessage) {
+	// sensitive values are encrypted at rest, so they must not end up in the
+	// audit log in plaintext either
+	sensitive, err := pm.sensitiveKeys(ctx, pm.dataDB, dataID)
+	if err != nil {
+		log.Printf("audit %s: %s", dataID, err)
+	}
+	if len(sensitive) > 0 {
+		redacted := make(map[string]json.RawMessage, len(keys))
+		for key, raw := range keys {
+			if sensitive[key] {
+				raw = json.RawMessage(`"[redacted]"`)
+			}
+			redacted[key] = raw
+		}
+		keys = redacted
+	}
+	pm.audit(ctx, AuditPageDataSave, dataID, map[string]interface{}{"locale": localeCode, "data": keys})
+}
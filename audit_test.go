@@ -0,0 +1,63 @@
+package pagemanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_VerifyAuditLog(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	for _, target := range []string{"/a", "/b", "/c"} {
+		is.NoErr(pm.Audit(ctx, AuditPageUpdate, target, nil))
+	}
+	v, err := pm.VerifyAuditLog(ctx)
+	is.NoErr(err)
+	is.Equal(0, v.Unsealed)
+	is.Equal(int64(0), v.BrokenAt)
+	entries, err := pm.AuditLog(ctx, AuditFilter{Target: "/b"})
+	is.NoErr(err)
+	is.Equal(1, len(entries))
+	// the triggers stop edits through SQLite, but not someone with the file
+	_, err = pm.dataDB.Exec("UPDATE pm_audit_log SET target = '/x' WHERE audit_id = ?", entries[0].AuditID)
+	is.True(err != nil)
+	_, err = pm.dataDB.Exec("DROP TRIGGER pm_audit_log_no_update")
+	is.NoErr(err)
+	_, err = pm.dataDB.Exec("UPDATE pm_audit_log SET target = '/x' WHERE audit_id = ?", entries[0].AuditID)
+	is.NoErr(err)
+	v, err = pm.VerifyAuditLog(ctx)
+	is.NoErr(err)
+	is.Equal(entries[0].AuditID, v.BrokenAt)
+}
+
+func Test_sealAuditLog(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	pm.innerEncryptionKey, pm.innerMACKey = nil, nil
+	pm.macKeyProvider.invalidate()
+	for _, target := range []string{"/a", "/b"} {
+		is.NoErr(pm.Audit(ctx, AuditPageUpdate, target, nil))
+	}
+	entries, err := pm.AuditLog(ctx, AuditFilter{Action: AuditPageUpdate})
+	is.NoErr(err)
+	is.Equal(2, len(entries))
+	for _, entry := range entries {
+		is.Equal("", entry.MAC)
+	}
+	is.NoErr(pm.unlockSuperadmin(ctx, "password"))
+	entries, err = pm.AuditLog(ctx, AuditFilter{Action: AuditPageUpdate})
+	is.NoErr(err)
+	for _, entry := range entries {
+		is.True(entry.MAC != "")
+	}
+	v, err := pm.VerifyAuditLog(ctx)
+	is.NoErr(err)
+	is.Equal(0, v.Unsealed)
+	is.Equal(int64(0), v.BrokenAt)
+}
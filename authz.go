@@ -0,0 +1,308 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Authz is a user's effective permissions: the union of the user's own
+// AUTHZ_DATA and the AUTHZ_DATA of every group the user belongs to.
+//
+// AUTHZ_DATA is a JSON object. PageManager reads the following keys and
+// ignores the rest, so plugins are free to store their own:
+//
+//	{
+//	    "pm-page-perms": 15,
+//	    "pm-page-perms-by-prefix": {"/blog/": 6, "pm-block:": 4}
+//	}
+//
+// pm-page-perms applies to every page, pm-page-perms-by-prefix only to the
+// data IDs (page URLs, or "pm-block:<name>" for blocks) that start with the
+// prefix. Permissions are PageCreate|PageRead|PageUpdate|PageDelete bit flags.
+type Authz struct {
+	PagePerms         int            `json:"pm-page-perms"`
+	PagePermsByPrefix map[string]int `json:"pm-page-perms-by-prefix"`
+}
+
+func (a *Authz) merge(other Authz) {
+	a.PagePerms |= other.PagePerms
+	for prefix, perms := range other.PagePermsByPrefix {
+		if a.PagePermsByPrefix == nil {
+			a.PagePermsByPrefix = make(map[string]int)
+		}
+		a.PagePermsByPrefix[prefix] |= perms
+	}
+}
+
+// PagePermsFor returns the permissions granted on dataID.
+func (a Authz) PagePermsFor(dataID string) int {
+	perms := a.PagePerms
+	for prefix, prefixPerms := range a.PagePermsByPrefix {
+		if strings.HasPrefix(dataID, prefix) {
+			perms |= prefixPerms
+		}
+	}
+	return perms
+}
+
+// Can reports whether every permission in perm is granted on dataID.
+func (a Authz) Can(dataID string, perm int) bool {
+	return a.PagePermsFor(dataID)&perm == perm
+}
+
+// Can reports whether the user holds every permission in perm on dataID. The
+// superadmin can do everything, except when using an API token that is scoped
+// to less.
+func (u User) Can(dataID string, perm int) bool {
+	if u.tokenScope != nil && !u.tokenScope.Can(dataID, perm) {
+		return false
+	}
+	return u.Superadmin || u.Authz.Can(dataID, perm)
+}
+
+// loadAuthz merges the user's own authz data with that of their groups.
+func loadAuthz(ctx context.Context, db sq.Queryer, userAuthzData []byte, groups []string) (Authz, error) {
+	var authz Authz
+	if len(userAuthzData) > 0 {
+		err := json.Unmarshal(userAuthzData, &authz)
+		if err != nil {
+			return authz, erro.Wrap(fmt.Errorf("invalid user AUTHZ_DATA %s: %w", string(userAuthzData), err))
+		}
+	}
+	if len(groups) == 0 {
+		return authz, nil
+	}
+	AUTHZ_GROUPS := tables.NEW_AUTHZ_GROUPS(ctx, "ag")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(AUTHZ_GROUPS).
+		Where(AUTHZ_GROUPS.NAME.In(groups)),
+		func(row *sq.Row) error {
+			name := row.String(AUTHZ_GROUPS.NAME)
+			b := row.Bytes(AUTHZ_GROUPS.AUTHZ_DATA)
+			return row.Accumulate(func() error {
+				if len(b) == 0 {
+					return nil
+				}
+				var groupAuthz Authz
+				err := json.Unmarshal(b, &groupAuthz)
+				if err != nil {
+					return erro.Wrap(fmt.Errorf("invalid AUTHZ_DATA for group %s %s: %w", name, string(b), err))
+				}
+				authz.merge(groupAuthz)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return authz, erro.Wrap(err)
+	}
+	return authz, nil
+}
+
+// checkPerm reports whether the logged in user holds perm on dataID. If not,
+// it has already written a 403 page to w.
+func (pm *PageManager) checkPerm(w http.ResponseWriter, r *http.Request, dataID string, perm int) bool {
+	user, _ := CurrentUser(r)
+	if user.Can(dataID, perm) {
+		return true
+	}
+	pm.forbidden(w, r)
+	return false
+}
+
+// checkCSRF reports whether r carries a valid CSRF token. If not, it has
+// already written a 403 to w. Forms built with hyforms are checked by
+// hyforms.UnmarshalForm instead.
+func checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if hyforms.VerifyCSRF(r) != nil {
+		http.Error(w, hyforms.ErrInvalidCSRFToken.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (pm *PageManager) forbidden(w http.ResponseWriter, r *http.Request) {
+	type Data struct {
+		LoggedIn  bool
+		Username  string
+		URL       string
+		CSRFToken string
+	}
+	user, loggedIn := CurrentUser(r)
+	data := Data{LoggedIn: loggedIn, Username: user.Username, URL: LocaleURL(r)}
+	if loggedIn {
+		var err error
+		data.CSRFToken, err = hyforms.CSRFToken(w, r)
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	t, err := pm.parseTemplates(templatesFS, "forbidden.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// savePageData handles the edit mode save button. The request is a form whose
+// field names are data IDs and whose values are JSON objects mapping each
+// page data key to either a string or an array of row objects. pm-locale
+// holds the locale being edited.
+func (pm *PageManager) savePageData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+	localeCode := r.FormValue("pm-locale")
+	pm.localesMutex.RLock()
+	_, ok := pm.locales[tenantID(r.Context())][localeCode]
+	pm.localesMutex.RUnlock()
+	if !ok && localeCode != "" {
+		http.Error(w, fmt.Sprintf("unknown locale %q", localeCode), http.StatusBadRequest)
+		return
+	}
+	data := make(map[string]map[string]json.RawMessage)
+	for dataID, values := range r.PostForm {
+		if dataID == "pm-locale" || dataID == hyforms.CSRFFieldName || len(values) == 0 {
+			continue
+		}
+		var keys map[string]json.RawMessage
+		err = json.Unmarshal([]byte(values[0]), &keys)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %s", dataID, err), http.StatusBadRequest)
+			return
+		}
+		data[dataID] = keys
+	}
+	for dataID := range data {
+		if !pm.checkPerm(w, r, dataID, PageUpdate) {
+			return
+		}
+	}
+	var urls []string
+	err = sq.WithTxContext(r.Context(), pm.dataDB, nil, func(tx *sql.Tx) error {
+		for dataID, keys := range data {
+			sensitive, err := pm.sensitiveKeys(r.Context(), tx, dataID)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			for key, raw := range keys {
+				err := pm.savePageDataKey(r.Context(), tx, localeCode, dataID, key, raw, sensitive[key])
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+			if !strings.HasPrefix(dataID, blockDataIDPrefix) {
+				urls = append(urls, dataID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	for dataID, keys := range data {
+		pm.auditPageDataSave(r.Context(), localeCode, dataID, keys)
+	}
+	err = pm.indexPages(r.Context(), urls...)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errInvalidPageData is returned by savePageDataKey for values it refuses to
+// save, as opposed to failures to save them.
+var errInvalidPageData = errors.New("invalid page data")
+
+// savePageDataKey saves raw, a string or an array of row objects, as the value
+// of key. Sensitive values are encrypted before they are stored.
+func (pm *PageManager) savePageDataKey(ctx context.Context, tx *sql.Tx, localeCode, dataID, key string, raw json.RawMessage, sensitive bool) error {
+	var value string
+	if json.Unmarshal(raw, &value) == nil {
+		// a value that looks sealed would be decrypted and shown on this
+		// page, so it could be used to reveal another page's sensitive values
+		if strings.HasPrefix(value, sensitivePrefix) {
+			return erro.Wrap(fmt.Errorf("%w: %s.%s: values may not start with %q", errInvalidPageData, dataID, key, sensitivePrefix))
+		}
+		if sensitive && value != "" {
+			var err error
+			value, err = pm.sealPageValue(value)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return setPageValue(ctx, tx, localeCode, dataID, key, value)
+	}
+	var rows []json.RawMessage
+	err := json.Unmarshal(raw, &rows)
+	if err != nil {
+		return erro.Wrap(fmt.Errorf("%w: %s.%s is neither a string nor an array of rows", errInvalidPageData, dataID, key))
+	}
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "")
+	_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+		DeleteFrom(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(dataID),
+			PAGEDATA.KEY.EqString(key),
+			PAGEDATA.ARRAY_INDEX.IsNotNull(),
+		),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for i, row := range rows {
+		value := string(row)
+		if sensitive {
+			value, err = pm.sealPageValue(value)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(PAGEDATA).
+			Valuesx(func(col *sq.Column) error {
+				col.SetString(PAGEDATA.LOCALE_CODE, localeCode)
+				col.SetString(PAGEDATA.DATA_ID, dataID)
+				col.SetString(PAGEDATA.KEY, key)
+				col.Set(PAGEDATA.VALUE, value)
+				col.SetInt(PAGEDATA.ARRAY_INDEX, i)
+				return nil
+			}),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
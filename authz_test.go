@@ -0,0 +1,131 @@
+package pagemanager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_loadAuthz(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	_, err := pm.dataDB.Exec("INSERT INTO pm_authz_groups (name, authz_data) VALUES (?, ?), (?, ?)",
+		"readers", `{"pm-page-perms-by-prefix": {"/blog/": 2, "pm-block:": 2}}`,
+		"writers", `{"pm-page-perms-by-prefix": {"/blog/": 4}}`,
+	)
+	is.NoErr(err)
+	authz, err := loadAuthz(ctx, pm.dataDB, []byte(`{"pm-page-perms-by-prefix": {"/docs/": 1}}`), []string{"readers", "writers", "unknown"})
+	is.NoErr(err)
+	is.Equal(0, authz.PagePerms)
+	is.Equal(map[string]int{"/blog/": PageRead | PageUpdate, "pm-block:": PageRead, "/docs/": PageCreate}, authz.PagePermsByPrefix)
+	is.True(authz.Can("/blog/post", PageRead|PageUpdate))
+	is.True(!authz.Can("/blog/post", PageCreate))
+	is.True(authz.Can("/docs/intro", PageCreate))
+	is.True(!authz.Can("/docs/intro", PageRead))
+	is.True(authz.Can(blockDataID("footer"), PageRead))
+	is.True(!authz.Can("/about", PageRead))
+	// an invalid group is an error, not an empty grant
+	_, err = pm.dataDB.Exec("INSERT INTO pm_authz_groups (name, authz_data) VALUES ('broken', '[]')")
+	is.NoErr(err)
+	_, err = loadAuthz(ctx, pm.dataDB, nil, []string{"broken"})
+	is.True(err != nil)
+}
+
+func Test_savePageData(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	blogEditor := User{UserID: 1, Username: "editor", Authz: Authz{PagePermsByPrefix: map[string]int{"/blog/": PageUpdate}}}
+	ctx := context.WithValue(context.Background(), hyforms.CSRFSessionKey{}, "session")
+	w := httptest.NewRecorder()
+	csrfToken, err := hyforms.CSRFToken(w, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	is.NoErr(err)
+	cookies := w.Result().Cookies()
+	is.Equal(1, len(cookies))
+	save := func(user *User, form url.Values) int {
+		r := httptest.NewRequest("POST", "/pm-save", strings.NewReader(form.Encode())).WithContext(ctx)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookies[0])
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), UserKey{}, *user))
+		}
+		w := httptest.NewRecorder()
+		pm.savePageData(w, r)
+		return w.Code
+	}
+	count := func(dataID string) (n int) {
+		is.NoErr(pm.dataDB.QueryRow("SELECT COUNT(*) FROM pm_pagedata WHERE data_id = ?", dataID).Scan(&n))
+		return n
+	}
+	with := func(form url.Values) url.Values {
+		form.Set(hyforms.CSRFFieldName, csrfToken)
+		return form
+	}
+	superadmin := User{Superadmin: true}
+	is.Equal(http.StatusForbidden, save(&superadmin, url.Values{"/about": {`{"title": "About"}`}}))
+	is.Equal(http.StatusForbidden, save(&superadmin, url.Values{"/about": {`{"title": "About"}`}, hyforms.CSRFFieldName: {csrfToken + "A"}}))
+	is.Equal(http.StatusForbidden, save(nil, with(url.Values{"/blog/post": {`{"title": "Post"}`}})))
+	is.Equal(http.StatusForbidden, save(&blogEditor, with(url.Values{"/about": {`{"title": "About"}`}})))
+	// one forbidden data ID rejects the whole save
+	is.Equal(http.StatusForbidden, save(&blogEditor, with(url.Values{"/about": {`{"title": "About"}`}, "/blog/post": {`{"title": "Post"}`}})))
+	is.Equal(0, count("/about"))
+	is.Equal(0, count("/blog/post"))
+	is.Equal(http.StatusNoContent, save(&blogEditor, with(url.Values{"/blog/post": {`{"title": "Post", "tags": [{"tag": "a"}, {"tag": "b"}]}`}})))
+	is.Equal(3, count("/blog/post"))
+	is.Equal(http.StatusNoContent, save(&superadmin, with(url.Values{"/about": {`{"title": "About"}`}})))
+	is.Equal(1, count("/about"))
+}
+
+func Test_superadminAPITokenScope(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	is.NoErr(seedData(ctx, pm.dataDB))
+	_, token, err := pm.CreateAPIToken(ctx, 0, "blog reader", APITokenScope(PageRead, []string{"/blog/"}), time.Time{})
+	is.NoErr(err)
+	r := httptest.NewRequest("GET", "/pm-api/pages", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	user, ok, err := pm.loadAPIUser(r)
+	is.NoErr(err)
+	is.True(ok)
+	is.True(user.Superadmin)
+	is.True(user.Can("/blog/post", PageRead))
+	is.True(!user.Can("/blog/post", PageUpdate))
+	is.True(!user.Can("/about", PageRead))
+	// the API refuses what the scope leaves out, even for the superadmin
+	r = httptest.NewRequest("PUT", "/pm-api/pages", strings.NewReader(`{"url": "/blog/new"}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	pm.serveAPI(w, r)
+	is.Equal(http.StatusForbidden, w.Code)
+}
+
+func Test_apiPutPageData(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	is.NoErr(seedData(ctx, pm.dataDB))
+	_, token, err := pm.CreateAPIToken(ctx, 0, "editor", APITokenScope(PageRead|PageUpdate, nil), time.Time{})
+	is.NoErr(err)
+	put := func(body string) int {
+		r := httptest.NewRequest("PUT", "/pm-api/pagedata?url=/about", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		pm.serveAPI(w, r)
+		return w.Code
+	}
+	is.Equal(http.StatusNoContent, put(`{"title": "About us"}`))
+	is.Equal(http.StatusBadRequest, put(`{"title": 5}`))
+	is.Equal(http.StatusBadRequest, put(`{"title": "`+sensitivePrefix+`x"}`))
+	// failing to save is not the client's fault
+	_, err = pm.dataDB.Exec("DROP TABLE pm_pagedata")
+	is.NoErr(err)
+	is.Equal(http.StatusInternalServerError, put(`{"title": "About us"}`))
+}
@@ -0,0 +1,650 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Blocks are named pieces of page data (a site footer, an announcement bar,
+// a navigation menu) that are shared by every page that references them. A
+// block's data lives in pm_pagedata under the DATA_ID "pm-block:<name>", so
+// it gets locales and fallbacks like any other page data. Templates read a
+// block by passing pmBlock to the page data accessors:
+//
+//     {{ pmGetValue .Page "text" (pmBlock "footer") }}
+//     {{ range pmGetRows .Page "links" (pmBlock "nav") }}...{{ end }}
+
+const blockDataIDPrefix = "pm-block:"
+
+var blockNameRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+func blockDataID(name string) string {
+	return blockDataIDPrefix + name
+}
+
+// Block is a named block and the number of pages known to use it.
+type Block struct {
+	Name        string
+	Description string
+	Usages      int
+}
+
+// blockUsageRefresh is how often a page that keeps using the same blocks
+// has its usages' LAST_USED_AT updated.
+const blockUsageRefresh = time.Hour
+
+// blockUsageCollectorKey is the context key for the blockUsageCollector of
+// the page being rendered.
+type blockUsageCollectorKey struct{}
+
+// blockUsageCollector gathers the names of the blocks that a page reads while
+// it is rendered.
+type blockUsageCollector struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+func withBlockUsageCollector(ctx context.Context) (context.Context, *blockUsageCollector) {
+	c := &blockUsageCollector{names: make(map[string]struct{})}
+	return context.WithValue(ctx, blockUsageCollectorKey{}, c), c
+}
+
+func (c *blockUsageCollector) add(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names[name] = struct{}{}
+}
+
+func (c *blockUsageCollector) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.names))
+	for name := range c.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordedBlockUsages is what pm.blockUsages remembers about a page.
+type recordedBlockUsages struct {
+	names      string // sorted block names joined by "\x00"
+	recordedAt time.Time
+}
+
+// pmBlock makes a page data accessor read from the block called name instead
+// of the current page, and notes that the page being rendered uses the block.
+func (pm *PageManager) pmBlock(name string) PageDataOption {
+	return func(pg *PageData) {
+		if pg.Ctx != nil {
+			if c, ok := pg.Ctx.Value(blockUsageCollectorKey{}).(*blockUsageCollector); ok {
+				c.add(name)
+			}
+		}
+		pg.DataID = blockDataID(name)
+	}
+}
+
+func ensureBlockUsagesIndex(ctx context.Context, db sq.Queryer) error {
+	BLOCK_USAGES := tables.NEW_BLOCK_USAGES(ctx, "")
+	name := BLOCK_USAGES.GetName()
+	for _, query := range []string{
+		// usages used to be recorded without a unique constraint
+		"DELETE FROM " + name + " WHERE rowid NOT IN (SELECT MIN(rowid) FROM " + name + " GROUP BY block_name, url)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS " + name + "_block_name_url_idx ON " + name + " (block_name, url)",
+	} {
+		_, err := db.ExecContext(ctx, query)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// recordBlockUsages records that the page at url uses exactly the blocks
+// called names, forgetting any blocks that it used before but no longer does.
+func (pm *PageManager) recordBlockUsages(ctx context.Context, url string, names []string) error {
+	cacheKey := tenantID(ctx) + "\x00" + url
+	joinedNames := strings.Join(names, "\x00")
+	if v, ok := pm.blockUsages.Load(cacheKey); ok {
+		recorded := v.(recordedBlockUsages)
+		if recorded.names == joinedNames && time.Since(recorded.recordedAt) < blockUsageRefresh {
+			return nil
+		}
+	}
+	now := time.Now()
+	err := sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		BLOCK_USAGES := tables.NEW_BLOCK_USAGES(ctx, "")
+		predicates := []sq.Predicate{BLOCK_USAGES.URL.EqString(url)}
+		if len(names) > 0 {
+			predicates = append(predicates, sq.Not(BLOCK_USAGES.BLOCK_NAME.In(names)))
+		}
+		_, _, err := sq.ExecContext(ctx, tx, sq.SQLite.DeleteFrom(BLOCK_USAGES).Where(predicates...), 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if len(names) == 0 {
+			return nil
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(BLOCK_USAGES).
+			Valuesx(func(col *sq.Column) error {
+				for _, name := range names {
+					col.SetString(BLOCK_USAGES.BLOCK_NAME, name)
+					col.SetString(BLOCK_USAGES.URL, url)
+					col.SetTime(BLOCK_USAGES.LAST_USED_AT, now)
+				}
+				return nil
+			}).
+			OnConflict(BLOCK_USAGES.BLOCK_NAME, BLOCK_USAGES.URL).
+			DoUpdateSet(sq.SetExcluded(BLOCK_USAGES.LAST_USED_AT)),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.blockUsages.Store(cacheKey, recordedBlockUsages{names: joinedNames, recordedAt: now})
+	return nil
+}
+
+// deleteStaleBlockUsages forgets the usages of pages that no longer exist.
+func (pm *PageManager) deleteStaleBlockUsages(ctx context.Context) error {
+	BLOCK_USAGES := tables.NEW_BLOCK_USAGES(ctx, "")
+	PAGES := tables.NEW_PAGES(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(BLOCK_USAGES).
+		Where(sq.Not(BLOCK_USAGES.URL.In(sq.SQLite.Select(PAGES.URL).From(PAGES)))),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// Blocks returns every block, ordered by name.
+func (pm *PageManager) Blocks(ctx context.Context) ([]Block, error) {
+	var blocks []Block
+	BLOCKS := tables.NEW_BLOCKS(ctx, "b")
+	BLOCK_USAGES := tables.NEW_BLOCK_USAGES(ctx, "bu")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(BLOCKS).
+		LeftJoin(BLOCK_USAGES, BLOCK_USAGES.BLOCK_NAME.Eq(BLOCKS.NAME)).
+		GroupBy(BLOCKS.NAME, BLOCKS.DESCRIPTION).
+		OrderBy(BLOCKS.NAME),
+		func(row *sq.Row) error {
+			block := Block{
+				Name:        row.String(BLOCKS.NAME),
+				Description: row.String(BLOCKS.DESCRIPTION),
+			}
+			row.ScanInto(&block.Usages, sq.Fieldf("COUNT(?)", BLOCK_USAGES.URL))
+			return row.Accumulate(func() error {
+				blocks = append(blocks, block)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return blocks, nil
+}
+
+// BlockUsages returns the URLs of the pages that use the block called name.
+func (pm *PageManager) BlockUsages(ctx context.Context, name string) ([]string, error) {
+	var urls []string
+	BLOCK_USAGES := tables.NEW_BLOCK_USAGES(ctx, "bu")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(BLOCK_USAGES).
+		Where(BLOCK_USAGES.BLOCK_NAME.EqString(name)).
+		OrderBy(BLOCK_USAGES.URL),
+		func(row *sq.Row) error {
+			url := row.String(BLOCK_USAGES.URL)
+			return row.Accumulate(func() error {
+				urls = append(urls, url)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return urls, nil
+}
+
+// CreateBlock creates an empty block. Block names are lowercase letters,
+// digits and single dashes.
+func (pm *PageManager) CreateBlock(ctx context.Context, name, description string) error {
+	if !blockNameRegexp.MatchString(name) {
+		return erro.Wrap(fmt.Errorf("invalid block name %q", name))
+	}
+	BLOCKS := tables.NEW_BLOCKS(ctx, "")
+	exists, err := sq.ExistsContext(ctx, pm.dataDB, sq.SQLite.From(BLOCKS).Where(BLOCKS.NAME.EqString(name)))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if exists {
+		return erro.Wrap(fmt.Errorf("block %q already exists", name))
+	}
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		InsertInto(BLOCKS).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(BLOCKS.NAME, name)
+			col.SetString(BLOCKS.DESCRIPTION, description)
+			col.SetTime(BLOCKS.CREATED_AT, time.Now())
+			return nil
+		}),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// DeleteBlock deletes the block called name together with its data and usage
+// records. Pages still referencing the block will render it as empty.
+func (pm *PageManager) DeleteBlock(ctx context.Context, name string) error {
+	err := sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		PAGEDATA := tables.NEW_PAGEDATA(ctx, "")
+		_, _, err := sq.ExecContext(ctx, tx, sq.SQLite.DeleteFrom(PAGEDATA).Where(PAGEDATA.DATA_ID.EqString(blockDataID(name))), 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		BLOCK_USAGES := tables.NEW_BLOCK_USAGES(ctx, "")
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.DeleteFrom(BLOCK_USAGES).Where(BLOCK_USAGES.BLOCK_NAME.EqString(name)), 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		BLOCKS := tables.NEW_BLOCKS(ctx, "")
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.DeleteFrom(BLOCKS).Where(BLOCKS.NAME.EqString(name)), 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	// every page that used the block has to record its usages again
+	pm.blockUsages.Range(func(key, _ interface{}) bool {
+		pm.blockUsages.Delete(key)
+		return true
+	})
+	return nil
+}
+
+// BlockValues returns the (non-row) values of the block called name that are
+// set in localeCode itself, keyed by page data key.
+func (pm *PageManager) BlockValues(ctx context.Context, name, localeCode string) (map[string]string, error) {
+	values := make(map[string]string)
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "pd")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(blockDataID(name)),
+			PAGEDATA.ARRAY_INDEX.IsNull(),
+		),
+		func(row *sq.Row) error {
+			key := row.String(PAGEDATA.KEY)
+			value := string(row.Bytes(PAGEDATA.VALUE))
+			return row.Accumulate(func() error {
+				values[key] = value
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return values, nil
+}
+
+// SetBlockValues writes values into the block called name for localeCode.
+// Empty values delete their key.
+func (pm *PageManager) SetBlockValues(ctx context.Context, name, localeCode string, values map[string]string) error {
+	BLOCKS := tables.NEW_BLOCKS(ctx, "")
+	exists, err := sq.ExistsContext(ctx, pm.dataDB, sq.SQLite.From(BLOCKS).Where(BLOCKS.NAME.EqString(name)))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !exists {
+		return erro.Wrap(fmt.Errorf("no such block %q", name))
+	}
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		for key, value := range values {
+			err := setPageValue(ctx, tx, localeCode, blockDataID(name), key, value)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// BlockRows returns the rows of the block called name that are set in
+// localeCode itself, keyed by page data key. Each row is a JSON object.
+func (pm *PageManager) BlockRows(ctx context.Context, name, localeCode string) (map[string][]string, error) {
+	rows := make(map[string][]string)
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "pd")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(blockDataID(name)),
+			PAGEDATA.ARRAY_INDEX.IsNotNull(),
+		).
+		OrderBy(PAGEDATA.KEY, PAGEDATA.ARRAY_INDEX),
+		func(row *sq.Row) error {
+			key := row.String(PAGEDATA.KEY)
+			value := string(row.Bytes(PAGEDATA.VALUE))
+			return row.Accumulate(func() error {
+				rows[key] = append(rows[key], value)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return rows, nil
+}
+
+// SetBlockRows replaces the rows of each key in rows for localeCode. Every
+// row must be a JSON object, an empty list deletes the key's rows.
+func (pm *PageManager) SetBlockRows(ctx context.Context, name, localeCode string, rows map[string][]string) error {
+	BLOCKS := tables.NEW_BLOCKS(ctx, "")
+	exists, err := sq.ExistsContext(ctx, pm.dataDB, sq.SQLite.From(BLOCKS).Where(BLOCKS.NAME.EqString(name)))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !exists {
+		return erro.Wrap(fmt.Errorf("no such block %q", name))
+	}
+	raws := make(map[string]json.RawMessage)
+	for key, keyRows := range rows {
+		list := make([]json.RawMessage, 0, len(keyRows))
+		for i, row := range keyRows {
+			var object map[string]interface{}
+			if json.Unmarshal([]byte(row), &object) != nil || object == nil {
+				return erro.Wrap(fmt.Errorf("%s[%d] is not a JSON object", key, i))
+			}
+			list = append(list, json.RawMessage(row))
+		}
+		raw, err := json.Marshal(list)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		raws[key] = raw
+	}
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		for key, raw := range raws {
+			err := pm.savePageDataKey(ctx, tx, localeCode, blockDataID(name), key, raw, false)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func (pm *PageManager) blocksIndex(w http.ResponseWriter, r *http.Request) {
+	const errorCookieName = "pm-blocks-error"
+	type Data struct {
+		Blocks    []Block
+		Error     string
+		CSRFToken string
+	}
+	var data Data
+	if r.Method == "POST" {
+		if !checkCSRF(w, r) {
+			return
+		}
+		name := r.FormValue("name")
+		if !pm.checkPerm(w, r, blockDataID(name), PageCreate) {
+			return
+		}
+		err := pm.CreateBlock(r.Context(), name, r.FormValue("description"))
+		if err != nil {
+			_ = hyforms.CookieSet(w, errorCookieName, err.Error(), nil)
+			http.Redirect(w, r, "/pm-blocks", http.StatusFound)
+			return
+		}
+		pm.audit(r.Context(), AuditBlockCreate, blockDataID(name), map[string]interface{}{"description": r.FormValue("description")})
+		http.Redirect(w, r, "/pm-blocks/edit?name="+url.QueryEscape(name), http.StatusFound)
+		return
+	}
+	if !pm.checkPerm(w, r, blockDataIDPrefix, PageRead) {
+		return
+	}
+	_ = hyforms.CookiePop(w, r, errorCookieName, &data.Error)
+	var err error
+	data.CSRFToken, err = hyforms.CSRFToken(w, r)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Blocks, err = pm.Blocks(r.Context())
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := pm.parseTemplates(templatesFS, "blocks.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (pm *PageManager) blocksEdit(w http.ResponseWriter, r *http.Request) {
+	type Locale struct {
+		Code        string
+		Description string
+	}
+	type Value struct {
+		Key   string
+		Value string
+	}
+	type Rows struct {
+		Key  string
+		Rows []string
+	}
+	type Data struct {
+		Name       string
+		LocaleCode string
+		Locales    []Locale
+		Values     []Value
+		Rows       []Rows
+		Usages     []string
+		CSRFToken  string
+	}
+	name, localeCode := r.FormValue("name"), r.FormValue("locale")
+	editURL := "/pm-blocks/edit?name=" + url.QueryEscape(name) + "&locale=" + url.QueryEscape(localeCode)
+	if r.Method == "POST" {
+		if !pm.checkPerm(w, r, blockDataID(name), PageUpdate) || !checkCSRF(w, r) {
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusBadRequest)
+			return
+		}
+		keys, values := r.PostForm["key"], r.PostForm["value"]
+		if len(keys) != len(values) {
+			http.Error(w, "mismatched keys and values", http.StatusBadRequest)
+			return
+		}
+		m := make(map[string]string)
+		for i, key := range keys {
+			if key == "" {
+				continue
+			}
+			m[key] = values[i]
+		}
+		// each row is a textarea named "row:<key>", emptying one deletes the
+		// row and filling in the blank one at the end adds a row
+		rows := make(map[string][]string)
+		if key := r.PostForm.Get("new-rows-key"); key != "" {
+			r.PostForm["row:"+key] = append(r.PostForm["row:"+key], r.PostForm.Get("new-row"))
+		}
+		for field, fieldValues := range r.PostForm {
+			if !strings.HasPrefix(field, "row:") {
+				continue
+			}
+			key := strings.TrimPrefix(field, "row:")
+			rows[key] = []string{}
+			for _, value := range fieldValues {
+				if strings.TrimSpace(value) != "" {
+					rows[key] = append(rows[key], value)
+				}
+			}
+		}
+		err = pm.SetBlockValues(r.Context(), name, localeCode, m)
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		err = pm.SetBlockRows(r.Context(), name, localeCode, rows)
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusBadRequest)
+			return
+		}
+		pm.audit(r.Context(), AuditPageDataSave, blockDataID(name), map[string]interface{}{"locale": localeCode, "values": m, "rows": rows})
+		http.Redirect(w, r, editURL, http.StatusFound)
+		return
+	}
+	if !pm.checkPerm(w, r, blockDataID(name), PageRead) {
+		return
+	}
+	data := Data{Name: name, LocaleCode: localeCode}
+	pm.localesMutex.RLock()
+	data.Locales = append(data.Locales, Locale{Code: "", Description: "Default"})
+	for code, description := range pm.locales[tenantID(r.Context())] {
+		data.Locales = append(data.Locales, Locale{Code: code, Description: description})
+	}
+	pm.localesMutex.RUnlock()
+	sort.Slice(data.Locales[1:], func(i, j int) bool { return data.Locales[i+1].Code < data.Locales[j+1].Code })
+	var err error
+	data.CSRFToken, err = hyforms.CSRFToken(w, r)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	values, err := pm.BlockValues(r.Context(), name, localeCode)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	for key, value := range values {
+		data.Values = append(data.Values, Value{Key: key, Value: value})
+	}
+	sort.Slice(data.Values, func(i, j int) bool { return data.Values[i].Key < data.Values[j].Key })
+	rows, err := pm.BlockRows(r.Context(), name, localeCode)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	for key, keyRows := range rows {
+		data.Rows = append(data.Rows, Rows{Key: key, Rows: keyRows})
+	}
+	sort.Slice(data.Rows, func(i, j int) bool { return data.Rows[i].Key < data.Rows[j].Key })
+	data.Usages, err = pm.BlockUsages(r.Context(), name)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := pm.parseTemplates(templatesFS, "block-edit.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (pm *PageManager) blocksDelete(w http.ResponseWriter, r *http.Request) {
+	type Data struct {
+		Name      string
+		Usages    []string
+		CSRFToken string
+	}
+	name := r.FormValue("name")
+	if !pm.checkPerm(w, r, blockDataID(name), PageDelete) {
+		return
+	}
+	if r.Method == "POST" {
+		if !checkCSRF(w, r) {
+			return
+		}
+		if r.FormValue("confirm") != name {
+			http.Redirect(w, r, "/pm-blocks/delete?name="+url.QueryEscape(name), http.StatusFound)
+			return
+		}
+		err := pm.DeleteBlock(r.Context(), name)
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		pm.audit(r.Context(), AuditBlockDelete, blockDataID(name), nil)
+		http.Redirect(w, r, "/pm-blocks", http.StatusFound)
+		return
+	}
+	data := Data{Name: name}
+	var err error
+	data.CSRFToken, err = hyforms.CSRFToken(w, r)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Usages, err = pm.BlockUsages(r.Context(), name)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := pm.parseTemplates(templatesFS, "block-delete.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,65 @@
+package pagemanager
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_BlockUsages(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	for _, name := range []string{"footer", "nav"} {
+		is.NoErr(pm.CreateBlock(ctx, name, ""))
+	}
+	_, err := pm.dataDB.Exec("INSERT INTO pm_pages (url) VALUES ('/a'), ('/b')")
+	is.NoErr(err)
+	is.NoErr(pm.recordBlockUsages(ctx, "/a", []string{"footer", "nav"}))
+	is.NoErr(pm.recordBlockUsages(ctx, "/b", []string{"nav"}))
+	// another process (or a restart) recording the same usages again
+	pm.blockUsages = sync.Map{}
+	is.NoErr(pm.recordBlockUsages(ctx, "/b", []string{"nav"}))
+	usages, err := pm.BlockUsages(ctx, "nav")
+	is.NoErr(err)
+	is.Equal([]string{"/a", "/b"}, usages)
+
+	// /a stops using the footer
+	is.NoErr(pm.recordBlockUsages(ctx, "/a", []string{"nav"}))
+	usages, err = pm.BlockUsages(ctx, "footer")
+	is.NoErr(err)
+	is.Equal(0, len(usages))
+
+	// /b is deleted
+	_, err = pm.dataDB.Exec("DELETE FROM pm_pages WHERE url = '/b'")
+	is.NoErr(err)
+	is.NoErr(pm.deleteStaleBlockUsages(ctx))
+	blocks, err := pm.Blocks(ctx)
+	is.NoErr(err)
+	is.Equal([]Block{{Name: "footer"}, {Name: "nav", Usages: 1}}, blocks)
+}
+
+func Test_BlockRows(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	is.NoErr(pm.CreateBlock(ctx, "nav", ""))
+	is.NoErr(pm.SetBlockRows(ctx, "nav", "", map[string][]string{
+		"links": {`{"href": "/", "text": "Home"}`, `{"href": "/about", "text": "About"}`},
+	}))
+	is.True(pm.SetBlockRows(ctx, "nav", "", map[string][]string{"links": {`"not a row"`}}) != nil)
+	rows, err := pm.pmGetRows(PageData{Ctx: ctx, URL: "/"}, "links", pm.pmBlock("nav"))
+	is.NoErr(err)
+	is.Equal(2, len(rows))
+	is.Equal("About", rows[1].(map[string]interface{})["text"])
+	blockRows, err := pm.BlockRows(ctx, "nav", "")
+	is.NoErr(err)
+	is.Equal(2, len(blockRows["links"]))
+	// an empty list deletes the rows
+	is.NoErr(pm.SetBlockRows(ctx, "nav", "", map[string][]string{"links": {}}))
+	blockRows, err = pm.BlockRows(ctx, "nav", "")
+	is.NoErr(err)
+	is.Equal(0, len(blockRows))
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/bokwoon95/erro"
 	"github.com/bokwoon95/pagemanager"
@@ -12,12 +20,54 @@ import (
 	"github.com/go-chi/chi/middleware"
 )
 
+var flagTenant = flag.String("tenant", "", "the tenant that export, import, search-rebuild, 2fa-reset, api-token, locales and audit-verify act on (default the default tenant)")
+
+// tenantContext returns the context commands run in, belonging to the tenant
+// named by -tenant.
+func tenantContext() context.Context {
+	return pagemanager.WithTenant(context.Background(), *flagTenant)
+}
+
 func main() {
 	flag.Parse()
 	pm, err := pagemanager.New()
 	if err != nil {
 		log.Fatalln(erro.Wrap(err))
 	}
+	switch flag.Arg(0) {
+	case "export":
+		err = export(pm, flag.Args()[1:])
+	case "import":
+		err = importContent(pm, flag.Args()[1:])
+	case "search-rebuild":
+		err = pm.RebuildSearchIndex(tenantContext())
+	case "2fa-reset":
+		err = resetTwoFactor(pm, flag.Args()[1:])
+	case "api-token":
+		err = apiToken(pm, flag.Args()[1:])
+	case "locales":
+		err = locales(pm, flag.Args()[1:])
+	case "keys":
+		err = keys(pm, flag.Args()[1:])
+	case "tenant":
+		err = tenant(pm, flag.Args()[1:])
+	case "audit-verify":
+		err = auditVerify(pm)
+	case "argon2-benchmark":
+		err = argon2Benchmark(flag.Args()[1:])
+	case "superadmin-password":
+		err = pm.ChangeSuperadminPasswordFromTerminal(context.Background())
+	case "":
+		err = serve(pm)
+	default:
+		err = fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+	if err != nil {
+		log.Fatalln(erro.Wrap(err))
+	}
+}
+
+func serve(pm *pagemanager.PageManager) error {
 	mux := chi.NewRouter()
 	mux.Use(middleware.Compress(5))
 	mux.Use(pm.PageManager)
@@ -26,5 +76,432 @@ func main() {
 		w.Write([]byte(`<h1>hello world</h1><br><a href="/pm-superadmin">Log In</a>`))
 	})
 	fmt.Println("listening on :80")
-	http.ListenAndServe(":80", mux)
+	return http.ListenAndServe(":80", mux)
+}
+
+// contentFilterFlags registers the flags shared by export and import.
+func contentFilterFlags(flagset *flag.FlagSet) func() pagemanager.ContentFilter {
+	urlPrefix := flagset.String("prefix", "", "only include pages and page data whose URL starts with this prefix")
+	locales := flagset.String("locales", "", "comma separated list of locale codes to include (default all)")
+	return func() pagemanager.ContentFilter {
+		filter := pagemanager.ContentFilter{URLPrefix: *urlPrefix}
+		if *locales != "" {
+			filter.LocaleCodes = strings.Split(*locales, ",")
+		}
+		return filter
+	}
+}
+
+func export(pm *pagemanager.PageManager, args []string) error {
+	flagset := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flagset.String("o", "", "output file (default stdout)")
+	unlock := flagset.Bool("unlock", false, "ask for the superadmin password so that sensitive page data can be decrypted")
+	filter := contentFilterFlags(flagset)
+	flagset.Parse(args)
+	if *unlock {
+		err := pm.UnlockFromTerminal(context.Background())
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	err := pm.Export(tenantContext(), w, filter())
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func importContent(pm *pagemanager.PageManager, args []string) error {
+	flagset := flag.NewFlagSet("import", flag.ExitOnError)
+	input := flagset.String("i", "", "input file (default stdin)")
+	dryRun := flagset.Bool("dry-run", false, "print the changes that would be made without making them")
+	unlock := flagset.Bool("unlock", false, "ask for the superadmin password so that sensitive page data can be encrypted")
+	filter := contentFilterFlags(flagset)
+	flagset.Parse(args)
+	if *unlock {
+		err := pm.UnlockFromTerminal(context.Background())
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	res, err := pm.Import(tenantContext(), r, filter(), *dryRun)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for _, change := range res.Changes {
+		if change.Action == pagemanager.ImportUnchanged {
+			continue
+		}
+		fmt.Printf("%-9s %-8s %s\n", change.Action, change.Kind, change.Key)
+	}
+	fmt.Printf("%d inserted, %d updated, %d unchanged\n", res.Inserted, res.Updated, res.Unchanged)
+	return nil
+}
+
+// resetTwoFactor turns off two-factor authentication for a user, or for the
+// superadmin (who has no one else to reset it for them).
+func resetTwoFactor(pm *pagemanager.PageManager, args []string) error {
+	flagset := flag.NewFlagSet("2fa-reset", flag.ExitOnError)
+	superadmin := flagset.Bool("superadmin", false, "reset the superadmin's two-factor authentication")
+	flagset.Parse(args)
+	ctx := tenantContext()
+	if *superadmin {
+		return pm.ResetSuperadminTwoFactor(ctx)
+	}
+	if flagset.NArg() != 1 {
+		return fmt.Errorf("usage: 2fa-reset [-superadmin] <username>")
+	}
+	userID, err := pm.UserIDByUsername(ctx, flagset.Arg(0))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return pm.ResetTwoFactor(ctx, userID)
+}
+
+// apiToken creates, lists and revokes API tokens.
+func apiToken(pm *pagemanager.PageManager, args []string) error {
+	const usage = "usage: api-token create|list|revoke [flags]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	ctx := tenantContext()
+	switch args[0] {
+	case "create":
+		flagset := flag.NewFlagSet("api-token create", flag.ExitOnError)
+		username := flagset.String("user", "", "the user the token acts as")
+		superadmin := flagset.Bool("superadmin", false, "create the token for the superadmin")
+		name := flagset.String("name", "", "a name to tell the token apart from others")
+		perms := flagset.String("perms", "read", "comma separated permissions out of create, read, update and delete")
+		prefixes := flagset.String("prefix", "", "comma separated URL prefixes the token is restricted to (default all pages)")
+		expires := flagset.Duration("expires", 90*24*time.Hour, "how long until the token expires, 0 for never")
+		flagset.Parse(args[1:])
+		if *name == "" || (*username == "") == !*superadmin {
+			return fmt.Errorf("usage: api-token create -name <name> (-user <username> | -superadmin) [-perms read,update] [-prefix /blog/] [-expires 720h]")
+		}
+		var userID int64
+		if !*superadmin {
+			var err error
+			userID, err = pm.UserIDByUsername(ctx, *username)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		pagePerms, err := pagemanager.ParsePagePerms(*perms)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		var prefixList []string
+		if *prefixes != "" {
+			prefixList = strings.Split(*prefixes, ",")
+		}
+		var expiresAt time.Time
+		if *expires > 0 {
+			expiresAt = time.Now().Add(*expires)
+		}
+		tokenID, token, err := pm.CreateAPIToken(ctx, userID, *name, pagemanager.APITokenScope(pagePerms, prefixList), expiresAt)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		fmt.Fprintf(os.Stderr, "created API token %d, it will not be shown again:\n", tokenID)
+		fmt.Println(token)
+		return nil
+	case "list":
+		flagset := flag.NewFlagSet("api-token list", flag.ExitOnError)
+		username := flagset.String("user", "", "only list this user's tokens")
+		flagset.Parse(args[1:])
+		userID := int64(-1)
+		if *username != "" {
+			var err error
+			userID, err = pm.UserIDByUsername(ctx, *username)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		tokens, err := pm.APITokens(ctx, userID)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSER\tNAME\tPERMS\tPREFIXES\tEXPIRES\tLAST USED")
+		for _, t := range tokens {
+			expiresAt, lastUsedAt := "never", "never"
+			if t.ExpiresAt.Valid {
+				expiresAt = t.ExpiresAt.Time.Local().Format(time.RFC3339)
+				if t.Expired() {
+					expiresAt += " (expired)"
+				}
+			}
+			if t.LastUsedAt.Valid {
+				lastUsedAt = t.LastUsedAt.Time.Local().Format(time.RFC3339)
+			}
+			prefixes := strings.Join(t.Prefixes(), ",")
+			if prefixes == "" {
+				prefixes = "*"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", t.TokenID, t.Username, t.Name, t.Perms(), prefixes, expiresAt, lastUsedAt)
+		}
+		return tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: api-token revoke <id>")
+		}
+		tokenID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid token ID %q", args[1])
+		}
+		return pm.RevokeAPIToken(ctx, tokenID, -1)
+	default:
+		return fmt.Errorf(usage)
+	}
+}
+
+// keys lists, rotates and retires the encryption and MAC keys.
+func keys(pm *pagemanager.PageManager, args []string) error {
+	const usage = "usage: keys list|rotate|retire"
+	if len(args) != 1 {
+		return fmt.Errorf(usage)
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		keys, err := pm.Keys(ctx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tID\tCREATED\tACTIVE")
+		for _, k := range keys {
+			createdAt := "at setup"
+			if k.CreatedAt.Valid {
+				createdAt = k.CreatedAt.Time.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%t\n", k.Kind, k.ID, createdAt, k.Active)
+		}
+		return tw.Flush()
+	case "rotate":
+		err := pm.UnlockFromTerminal(ctx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		err = pm.RotateKeys(ctx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for {
+			kr := pm.KeyRotationStatus()
+			fmt.Fprintf(os.Stderr, "\rre-encrypting with key %d: %d/%d", kr.KeyID, kr.Done, kr.Total)
+			if !kr.Running() {
+				fmt.Fprintln(os.Stderr)
+				if kr.Failed > 0 {
+					fmt.Fprintf(os.Stderr, "%d ciphertexts could not be decrypted and were left as they are\n", kr.Failed)
+				}
+				if kr.Err != "" {
+					return fmt.Errorf("key rotation stopped: %s", kr.Err)
+				}
+				return nil
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	case "retire":
+		err := pm.UnlockFromTerminal(ctx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		retired, err := pm.RetireKeys(ctx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, k := range retired {
+			fmt.Printf("retired %s key %d\n", k.Kind, k.ID)
+		}
+		fmt.Printf("%d keys retired\n", len(retired))
+		return nil
+	default:
+		return fmt.Errorf(usage)
+	}
+}
+
+// auditVerify checks the audit log's MAC chain. Verifying walks the whole log,
+// so it is left to this command and the audit log page's verify button.
+func auditVerify(pm *pagemanager.PageManager) error {
+	ctx := tenantContext()
+	err := pm.UnlockFromTerminal(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	v, err := pm.VerifyAuditLog(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if v.BrokenAt != 0 {
+		return fmt.Errorf("tampering detected: entry %d does not match its MAC, entries from %d on cannot be trusted", v.BrokenAt, v.BrokenAt)
+	}
+	fmt.Printf("all %d entries verified, %d not sealed yet\n", v.Entries, v.Unsealed)
+	return nil
+}
+
+// locales lists and adds locales, sets their fallback chains and reports the
+// page data keys that still need translating.
+func locales(pm *pagemanager.PageManager, args []string) error {
+	const usage = "usage: locales list | add <code> <description> | fallbacks <code> [<fallback>...] | untranslated"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	ctx := tenantContext()
+	switch args[0] {
+	case "list":
+		locales, fallbacks := pm.Locales(ctx)
+		codes := make([]string, 0, len(locales))
+		for code := range locales {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CODE\tDESCRIPTION\tFALLBACKS")
+		for _, code := range codes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", code, locales[code], strings.Join(fallbacks[code], ","))
+		}
+		return tw.Flush()
+	case "add":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: locales add <code> <description>")
+		}
+		return pm.AddLocale(ctx, args[1], args[2])
+	case "fallbacks":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: locales fallbacks <code> [<fallback>...]")
+		}
+		return pm.SetLocaleFallbacks(ctx, args[1], args[2:])
+	case "untranslated":
+		report, err := pm.UntranslatedKeys(ctx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "LOCALE\tDATA ID\tKEY\tSERVED FROM")
+		var codes []string
+		for code := range report {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			for _, k := range report[code] {
+				servedFrom := k.FallbackLocaleCode
+				switch {
+				case k.Missing:
+					servedFrom = "(missing)"
+				case servedFrom == "":
+					servedFrom = "(default)"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", k.LocaleCode, k.DataID, k.Key, servedFrom)
+			}
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf(usage)
+	}
+}
+
+// tenant creates, deletes and lists tenants, and sets whether they use the
+// shared themes. A running server picks up the changes within a minute.
+func tenant(pm *pagemanager.PageManager, args []string) error {
+	const usage = "usage: tenant create <id> <hostname>... | delete <id> | list | shared-themes <id> on|off"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "create":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: tenant create <id> <hostname>...")
+		}
+		err := pm.CreateTenant(ctx, args[1], args[2:])
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		fmt.Printf("created tenant %s\n", args[1])
+		return nil
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: tenant delete <id>")
+		}
+		fmt.Fprintf(os.Stderr, "this deletes every page, user and audit log entry of tenant %s, type its ID to confirm: ", args[1])
+		var confirm string
+		fmt.Scanln(&confirm)
+		if confirm != args[1] {
+			return fmt.Errorf("tenant %s not deleted", args[1])
+		}
+		err := pm.DeleteTenant(ctx, args[1])
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		fmt.Printf("deleted tenant %s, its files have been left in %s\n", args[1], pm.TenantFolder(args[1]))
+		return nil
+	case "list":
+		tenants, err := pm.Tenants(ctx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tHOSTNAMES\tSHARED THEMES\tCREATED")
+		for _, t := range tenants {
+			var createdAt string
+			if t.CreatedAt.Valid {
+				createdAt = t.CreatedAt.Time.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%s\n", t.TenantID, strings.Join(t.Hostnames, ","), t.SharedThemes, createdAt)
+		}
+		return tw.Flush()
+	case "shared-themes":
+		if len(args) != 3 || (args[2] != "on" && args[2] != "off") {
+			return fmt.Errorf("usage: tenant shared-themes <id> on|off")
+		}
+		return pm.SetSharedThemes(ctx, args[1], args[2] == "on")
+	default:
+		return fmt.Errorf(usage)
+	}
+}
+
+// argon2Benchmark suggests -pm-argon2-* flags that make deriving a key take
+// about as long as the target on this machine.
+func argon2Benchmark(args []string) error {
+	flagset := flag.NewFlagSet("argon2-benchmark", flag.ExitOnError)
+	target := flagset.Duration("target", 500*time.Millisecond, "how long deriving a key may take")
+	threads := flagset.Uint("threads", 4, "argon2id threads")
+	maxMemory := flagset.Uint("max-memory", 1024, "the most memory in MiB a single derivation may use")
+	flagset.Parse(args)
+	if *threads < 1 || *threads > 255 {
+		return fmt.Errorf("-threads must be between 1 and 255")
+	}
+	if *maxMemory < 1 {
+		return fmt.Errorf("-max-memory must be at least 1 MiB")
+	}
+	params, took, err := pagemanager.BenchmarkArgon2(*target, uint8(*threads), uint32(*maxMemory)*1024)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if took > *target {
+		fmt.Fprintf(os.Stderr, "even the cheapest parameters took %s, longer than %s\n", took, *target)
+	}
+	fmt.Fprintf(os.Stderr, "memory %d MiB, time %d, threads %d took %s\n", params.Memory/1024, params.Time, params.Threads, took)
+	fmt.Printf("-pm-argon2-memory %d -pm-argon2-time %d -pm-argon2-threads %d\n", params.Memory/1024, params.Time, params.Threads)
+	return nil
 }
@@ -4,14 +4,16 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/subtle"
-	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bokwoon95/erro"
 	"github.com/bokwoon95/pagemanager/sq"
@@ -65,7 +67,10 @@ func (kd *keyDerivation) Unmarshal(s string) error {
 	// parts[5] = base64 URL encoded key (can be empty, which indicates that key should be re-derived from the above params)
 	var err error
 	parts := strings.Split(s, "$")
-	kd.argon2Version, err = strconv.Atoi(parts[2])
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return erro.Wrap(fmt.Errorf("invalid argon2id hash"))
+	}
+	_, err = fmt.Sscanf(parts[2], "v=%d", &kd.argon2Version)
 	if err != nil {
 		return erro.Wrap(err)
 	}
@@ -86,12 +91,121 @@ func (kd *keyDerivation) Unmarshal(s string) error {
 	return nil
 }
 
+// Argon2Params are the cost parameters of argon2id.
+type Argon2Params struct {
+	Memory  uint32 // in KiB
+	Time    uint32 // number of passes over the memory
+	Threads uint8
+}
+
+// argon2Policy is what new password hashes and inner keys are derived with.
+// Hashes and keys derived with weaker parameters are upgraded the next time
+// their password is entered. It is set from the -pm-argon2-* flags in New.
+var argon2Policy = Argon2Params{Memory: 63 * 1024, Time: 1, Threads: 4}
+
+func (p Argon2Params) validate() error {
+	if p.Time < 1 {
+		return fmt.Errorf("argon2 time must be at least 1")
+	}
+	if p.Threads < 1 {
+		return fmt.Errorf("argon2 threads must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return fmt.Errorf("argon2 memory must be at least 8 KiB per thread")
+	}
+	return nil
+}
+
+// weakerThan reports whether kd was derived with less memory or fewer passes
+// than p, or with an older version of argon2.
+func (kd keyDerivation) weakerThan(p Argon2Params) bool {
+	return kd.argon2Version < argon2.Version || kd.memory < p.Memory || kd.time < p.Time
+}
+
+// weakerThanPolicy reports whether the password hash or key parameters s
+// were derived with weaker parameters than argon2Policy.
+func weakerThanPolicy(s string) bool {
+	var kd keyDerivation
+	if kd.Unmarshal(s) != nil {
+		return false
+	}
+	return kd.weakerThan(argon2Policy)
+}
+
+// BenchmarkArgon2 finds the strongest argon2id parameters that derive a key
+// in no more than target on this machine, using threads threads and at most
+// maxMemory KiB. Memory is raised first, then the number of passes. It
+// returns the parameters and how long they took, or an error if maxMemory is
+// below the 8 KiB per thread that argon2id needs.
+func BenchmarkArgon2(target time.Duration, threads uint8, maxMemory uint32) (Argon2Params, time.Duration, error) {
+	err := Argon2Params{Memory: maxMemory, Time: 1, Threads: threads}.validate()
+	if err != nil {
+		return Argon2Params{}, 0, err
+	}
+	salt := make([]byte, 16)
+	measure := func(p Argon2Params) time.Duration {
+		start := time.Now()
+		argon2.IDKey([]byte("benchmark"), salt, p.Time, p.Memory, p.Threads, 32)
+		return time.Since(start)
+	}
+	best := Argon2Params{Memory: 16 * 1024, Time: 1, Threads: threads}
+	if best.Memory > maxMemory {
+		best.Memory = maxMemory
+	}
+	bestDuration := measure(best)
+	if bestDuration > target {
+		return best, bestDuration, nil
+	}
+	for best.Memory*2 <= maxMemory {
+		next := best
+		next.Memory *= 2
+		d := measure(next)
+		if d > target {
+			break
+		}
+		best, bestDuration = next, d
+	}
+	for {
+		next := best
+		next.Time++
+		d := measure(next)
+		if d > target {
+			break
+		}
+		best, bestDuration = next, d
+	}
+	return best, bestDuration, nil
+}
+
+// argon2Slots bounds how many argon2id derivations run at once. Each one
+// allocates argon2Policy.Memory and keeps a core busy, so a flood of login
+// attempts would otherwise exhaust the server's memory and CPU.
+var argon2Slots = make(chan struct{}, runtime.NumCPU())
+
+// argon2SlotWait is how long a derivation waits for a free slot before giving
+// up with errPasswordHashingBusy.
+const argon2SlotWait = 5 * time.Second
+
+var errPasswordHashingBusy = errors.New("too many logins in progress, please try again shortly")
+
+func (kd keyDerivation) deriveKey(password string) ([]byte, error) {
+	timer := time.NewTimer(argon2SlotWait)
+	defer timer.Stop()
+	select {
+	case argon2Slots <- struct{}{}:
+	case <-timer.C:
+		return nil, errPasswordHashingBusy
+	}
+	defer func() { <-argon2Slots }()
+	return argon2.IDKey([]byte(password), kd.salt, kd.time, kd.memory, kd.threads, kd.keyLen), nil
+}
+
 func deriveKeyFromPassword(password string) (keyDerivation, error) {
 	kd := keyDerivation{
 		argon2Version: argon2.Version,
-		memory:        63 * 1024,
-		time:          1,
-		threads:       4,
+		memory:        argon2Policy.Memory,
+		time:          argon2Policy.Time,
+		threads:       argon2Policy.Threads,
 		keyLen:        32,
 		salt:          make([]byte, 16),
 	}
@@ -99,7 +213,10 @@ func deriveKeyFromPassword(password string) (keyDerivation, error) {
 	if err != nil {
 		return kd, erro.Wrap(err)
 	}
-	kd.key = argon2.IDKey([]byte(password), kd.salt, kd.time, kd.memory, kd.threads, kd.keyLen)
+	kd.key, err = kd.deriveKey(password)
+	if err != nil {
+		return kd, err
+	}
 	return kd, nil
 }
 
@@ -109,7 +226,10 @@ func verifyHashAndPassword(passwordHash string, password string) error {
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	derivedKey := argon2.IDKey([]byte(password), kd.salt, kd.time, kd.memory, kd.threads, kd.keyLen)
+	derivedKey, err := kd.deriveKey(password)
+	if err != nil {
+		return err
+	}
 	if subtle.ConstantTimeCompare(kd.key, derivedKey) != 1 {
 		return fmt.Errorf("password is invalid")
 	}
@@ -168,74 +288,169 @@ func decrypt(key []byte, ciphertext string) (plaintext string, ok bool, err erro
 	if err != nil {
 		return "", false, erro.Wrap(err)
 	}
+	if len(ciphertextBytes) < nonceSize {
+		return "", false, erro.Wrap(fmt.Errorf("ciphertext too short"))
+	}
 	var nonce [nonceSize]byte
 	copy(nonce[:], ciphertextBytes[:nonceSize])
+	// a wrong key is not an error, so that callers can try the next key
 	plaintextBytes, ok := secretbox.Open(nil, ciphertextBytes[nonceSize:], &nonce, &hashedKey)
 	if !ok {
-		return "", false, erro.Wrap(fmt.Errorf("decryption error"))
+		return "", false, nil
 	}
 	return string(plaintextBytes), ok, nil
 }
 
-func (pm *PageManager) Encrypt(plaintext string) (ciphertext string, err error) {
-	ctx := context.Background()
-	var encryptionKeyCiphertext sql.NullString
-	ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(ctx, "")
-	_, err = sq.Fetch(pm.superadminDB, sq.SQLite.
-		From(ENCRYPTION_KEYS).
-		Where(ENCRYPTION_KEYS.ID.EqInt(1)),
+// encryptionKey is a decrypted row of pm_encryption_keys or pm_mac_keys.
+type encryptionKey struct {
+	id  int64
+	key []byte
+}
+
+// keyCacheLifetime bounds how long decrypted keys are cached, so that keys
+// rotated or retired by another process (the command line) are picked up.
+const keyCacheLifetime = time.Minute
+
+// sqliteKeyProvider supplies the encryption or MAC keys in the superadmin
+// database, decrypted with the superadmin's inner key. It is not an
+// encrypthash.KeyProvider: Encrypt and MAC tag their output with the ID of
+// the key used, which key rotation relies on to find stale ciphertexts, so
+// they need each key's ID. The keys are cached until invalidate is called,
+// which rotating and retiring keys do.
+type sqliteKeyProvider struct {
+	pm        *PageManager
+	kind      string // "encryption" or "mac"
+	mutex     *sync.Mutex
+	keys      []encryptionKey
+	fetchedAt time.Time
+}
+
+func newSQLiteKeyProvider(pm *PageManager, kind string) *sqliteKeyProvider {
+	return &sqliteKeyProvider{pm: pm, kind: kind, mutex: &sync.Mutex{}}
+}
+
+// keysWithIDs returns the decrypted keys, newest first.
+func (p *sqliteKeyProvider) keysWithIDs(ctx context.Context) ([]encryptionKey, error) {
+	p.pm.keysMutex.RLock()
+	innerKey := p.pm.innerEncryptionKey
+	if p.kind == "mac" {
+		innerKey = p.pm.innerMACKey
+	}
+	p.pm.keysMutex.RUnlock()
+	if len(innerKey) == 0 {
+		return nil, erro.Wrap(fmt.Errorf("%s keys are locked, the superadmin needs to log in", p.kind))
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.keys != nil && time.Since(p.fetchedAt) < keyCacheLifetime {
+		return p.keys, nil
+	}
+	var table sq.TableInfo
+	var id sq.NumberField
+	var keyCiphertext sq.StringField
+	switch p.kind {
+	case "encryption":
+		ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(withoutTenant(ctx), "")
+		table, id, keyCiphertext = ENCRYPTION_KEYS.TableInfo, ENCRYPTION_KEYS.ID, ENCRYPTION_KEYS.KEY_CIPHERTEXT
+	case "mac":
+		MAC_KEYS := tables.NEW_MAC_KEYS(withoutTenant(ctx), "")
+		table, id, keyCiphertext = MAC_KEYS.TableInfo, MAC_KEYS.ID, MAC_KEYS.KEY_CIPHERTEXT
+	}
+	var keys []encryptionKey
+	_, err := sq.FetchContext(ctx, p.pm.superadminDB, sq.SQLite.
+		From(table).
+		OrderBy(id.Desc()),
 		func(row *sq.Row) error {
-			encryptionKeyCiphertext = row.NullString(ENCRYPTION_KEYS.KEY_CIPHERTEXT)
-			return nil
+			keyID := row.Int64(id)
+			ciphertext := row.String(keyCiphertext)
+			return row.Accumulate(func() error {
+				key, ok, err := decrypt(innerKey, ciphertext)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+				if !ok {
+					return erro.Wrap(fmt.Errorf("decryption error"))
+				}
+				keys = append(keys, encryptionKey{id: keyID, key: []byte(key)})
+				return nil
+			})
 		},
 	)
 	if err != nil {
-		return "", erro.Wrap(err)
+		return nil, erro.Wrap(err)
 	}
-	if !encryptionKeyCiphertext.Valid {
-		return "", erro.Wrap(fmt.Errorf("no encryption keys found"))
+	if len(keys) == 0 {
+		return nil, erro.Wrap(fmt.Errorf("no %s keys found", p.kind))
 	}
-	encryptionKey, ok, err := decrypt(pm.innerEncryptionKey, encryptionKeyCiphertext.String)
+	p.keys, p.fetchedAt = keys, time.Now()
+	return keys, nil
+}
+
+// invalidate drops the cached keys.
+func (p *sqliteKeyProvider) invalidate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keys = nil
+}
+
+// encryptionKeys returns the decrypted encryption keys, newest first. The
+// newest key is the active key, the one Encrypt uses.
+func (pm *PageManager) encryptionKeys(ctx context.Context) ([]encryptionKey, error) {
+	return pm.encryptionKeyProvider.keysWithIDs(ctx)
+}
+
+// ciphertextKeyID returns the ID of the key that ciphertext was encrypted
+// with. Ciphertexts made before key rotation existed carry no key ID, for
+// those ok is false.
+func ciphertextKeyID(ciphertext string) (keyID int64, body string, ok bool) {
+	i := strings.IndexByte(ciphertext, ':')
+	if i < 0 {
+		return 0, ciphertext, false
+	}
+	keyID, err := strconv.ParseInt(ciphertext[:i], 10, 64)
 	if err != nil {
-		return "", erro.Wrap(err)
+		return 0, ciphertext, false
 	}
-	if !ok {
-		return "", erro.Wrap(fmt.Errorf("decryption error"))
+	return keyID, ciphertext[i+1:], true
+}
+
+// Encrypt encrypts plaintext with the active encryption key. The ciphertext
+// is prefixed with the key's ID, "<keyID>:<base64 ciphertext>", so that
+// Decrypt knows which key to use after a rotation.
+func (pm *PageManager) Encrypt(plaintext string) (ciphertext string, err error) {
+	keys, err := pm.encryptionKeys(context.Background())
+	if err != nil {
+		return "", erro.Wrap(err)
 	}
-	ciphertext, err = encrypt([]byte(encryptionKey), plaintext)
+	ciphertext, err = encrypt(keys[0].key, plaintext)
 	if err != nil {
 		return "", erro.Wrap(err)
 	}
-	return ciphertext, nil
+	return strconv.FormatInt(keys[0].id, 10) + ":" + ciphertext, nil
 }
 
+// Decrypt decrypts a ciphertext made by Encrypt. Ciphertexts without a key ID
+// are tried against every key.
 func (pm *PageManager) Decrypt(ciphertext string) (plaintext string, err error) {
-	ctx := context.Background()
-	var encryptionKeyCiphertexts []string
-	ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(ctx, "")
-	_, err = sq.Fetch(pm.superadminDB, sq.SQLite.
-		From(ENCRYPTION_KEYS).
-		OrderBy(ENCRYPTION_KEYS.ID),
-		func(row *sq.Row) error {
-			encryptionKeyCiphertext := row.String(ENCRYPTION_KEYS.KEY_CIPHERTEXT)
-			return row.Accumulate(func() error {
-				encryptionKeyCiphertexts = append(encryptionKeyCiphertexts, encryptionKeyCiphertext)
-				return nil
-			})
-		},
-	)
+	keys, err := pm.encryptionKeys(context.Background())
 	if err != nil {
 		return "", erro.Wrap(err)
 	}
-	for _, encryptionKeyCiphertext := range encryptionKeyCiphertexts {
-		encryptionKey, ok, err := decrypt(pm.innerEncryptionKey, encryptionKeyCiphertext)
+	keyID, body, hasKeyID := ciphertextKeyID(ciphertext)
+	if hasKeyID && keyID > keys[0].id {
+		// the key was added since the keys were cached, most likely by a
+		// rotation from the command line
+		pm.encryptionKeyProvider.invalidate()
+		keys, err = pm.encryptionKeys(context.Background())
 		if err != nil {
 			return "", erro.Wrap(err)
 		}
-		if !ok {
-			return "", erro.Wrap(fmt.Errorf("decryption error"))
+	}
+	for _, key := range keys {
+		if hasKeyID && key.id != keyID {
+			continue
 		}
-		plaintext, ok, err = decrypt([]byte(encryptionKey), ciphertext)
+		plaintext, ok, err := decrypt(key.key, body)
 		if err != nil {
 			return "", erro.Wrap(err)
 		}
@@ -244,6 +459,9 @@ func (pm *PageManager) Decrypt(ciphertext string) (plaintext string, err error)
 		}
 		return plaintext, nil
 	}
+	if hasKeyID {
+		return "", erro.Wrap(fmt.Errorf("decryption error: encryption key %d not found", keyID))
+	}
 	return "", erro.Wrap(fmt.Errorf("decryption error"))
 }
 
@@ -268,3 +486,57 @@ func verifyMAC(key []byte, data string, mac string) bool {
 	}
 	return subtle.ConstantTimeCompare(computedSum, providedSum) == 1
 }
+
+// deriveKeyFromParams re-derives a key from password using the argon2id
+// parameters previously produced by keyDerivation.MarshalParams.
+func deriveKeyFromParams(params string, password string) ([]byte, error) {
+	var kd keyDerivation
+	err := kd.Unmarshal(params)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	key, err := kd.deriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// macKeys returns the decrypted MAC keys, newest first. The newest key is the
+// active key, the one new MACs are made with.
+func (pm *PageManager) macKeys(ctx context.Context) ([][]byte, error) {
+	keys, err := pm.macKeyProvider.keysWithIDs(ctx)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	macKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		macKeys[i] = key.key
+	}
+	return macKeys, nil
+}
+
+// MAC returns a message authentication code for data, signed with the active
+// MAC key.
+func (pm *PageManager) MAC(data string) (mac string, err error) {
+	macKeys, err := pm.macKeys(context.Background())
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return makeMAC(macKeys[0], data), nil
+}
+
+// VerifyMAC reports whether mac was produced by MAC for data, using any of the
+// MAC keys.
+func (pm *PageManager) VerifyMAC(data string, mac string) (bool, error) {
+	macKeys, err := pm.macKeys(context.Background())
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	for _, macKey := range macKeys {
+		if verifyMAC(macKey, data, mac) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,107 @@
+package pagemanager
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+	"golang.org/x/crypto/argon2"
+)
+
+func Test_weakerThan(t *testing.T) {
+	policy := Argon2Params{Memory: 64 * 1024, Time: 2, Threads: 4}
+	tests := []struct {
+		description string
+		kd          keyDerivation
+		want        bool
+	}{
+		{"same", keyDerivation{argon2Version: argon2.Version, memory: 64 * 1024, time: 2, threads: 4}, false},
+		{"stronger", keyDerivation{argon2Version: argon2.Version, memory: 128 * 1024, time: 3, threads: 4}, false},
+		{"fewer threads", keyDerivation{argon2Version: argon2.Version, memory: 64 * 1024, time: 2, threads: 1}, false},
+		{"less memory", keyDerivation{argon2Version: argon2.Version, memory: 32 * 1024, time: 2, threads: 4}, true},
+		{"fewer passes", keyDerivation{argon2Version: argon2.Version, memory: 64 * 1024, time: 1, threads: 4}, true},
+		{"older version", keyDerivation{argon2Version: argon2.Version - 1, memory: 64 * 1024, time: 2, threads: 4}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			is := testutil.New(t)
+			is.Equal(tt.want, tt.kd.weakerThan(policy))
+		})
+	}
+}
+
+func Test_weakerThanPolicy(t *testing.T) {
+	is := testutil.New(t)
+	cheapArgon2(t)
+	kd, err := deriveKeyFromPassword("password")
+	is.NoErr(err)
+	is.True(!weakerThanPolicy(kd.Marshal()))
+	is.True(!weakerThanPolicy(kd.MarshalParams()))
+	argon2Policy.Memory *= 2
+	is.True(weakerThanPolicy(kd.Marshal()))
+	// what cannot be parsed cannot be upgraded either
+	is.True(!weakerThanPolicy("not a hash"))
+}
+
+func Test_BenchmarkArgon2(t *testing.T) {
+	is := testutil.New(t)
+	for _, maxMemory := range []uint32{0, 8*4 - 1} {
+		_, _, err := BenchmarkArgon2(0, 4, maxMemory)
+		is.True(err != nil)
+	}
+	_, _, err := BenchmarkArgon2(0, 0, 1024)
+	is.True(err != nil)
+	params, _, err := BenchmarkArgon2(0, 4, 8*4)
+	is.NoErr(err)
+	is.Equal(Argon2Params{Memory: 8 * 4, Time: 1, Threads: 4}, params)
+}
+
+// Test_rehashOnLogin checks that password hashes and the superadmin's inner
+// key parameters made with an older, weaker policy are upgraded when the
+// password is next entered.
+func Test_rehashOnLogin(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	userID, err := pm.CreateUser(ctx, "alice", "alice@example.com", "correct horse battery staple")
+	is.NoErr(err)
+	ciphertext, err := pm.Encrypt("secret")
+	is.NoErr(err)
+	argon2Policy.Memory *= 2
+	var userHash, superadminHash, encryptionKeyParams string
+	scan := func() {
+		is.NoErr(pm.dataDB.QueryRow("SELECT password_hash FROM pm_users WHERE user_id = ?", userID).Scan(&userHash))
+		is.NoErr(pm.superadminDB.QueryRow("SELECT password_hash, encryption_key_parameters FROM pm_superadmin").Scan(&superadminHash, &encryptionKeyParams))
+	}
+	scan()
+	is.True(weakerThanPolicy(userHash))
+	is.True(weakerThanPolicy(superadminHash))
+
+	// a wrong password upgrades nothing
+	_, err = pm.authenticateUser(ctx, "alice", "wrong password")
+	is.Equal(errIncorrectPassword, err)
+	scan()
+	is.True(weakerThanPolicy(userHash))
+
+	gotUserID, err := pm.authenticateUser(ctx, "alice", "correct horse battery staple")
+	is.NoErr(err)
+	is.Equal(userID, gotUserID)
+	is.NoErr(pm.unlockSuperadmin(ctx, "password"))
+	scan()
+	is.True(!weakerThanPolicy(userHash))
+	is.True(!weakerThanPolicy(superadminHash))
+	is.True(!weakerThanPolicy(encryptionKeyParams))
+	is.True(strings.Contains(userHash, "m=16384,"))
+	// the upgraded hash and keys still work
+	_, err = pm.authenticateUser(ctx, "alice", "correct horse battery staple")
+	is.NoErr(err)
+	pm.innerEncryptionKey, pm.innerMACKey = nil, nil
+	pm.encryptionKeyProvider.invalidate()
+	is.NoErr(pm.unlockSuperadmin(ctx, "password"))
+	plaintext, err := pm.Decrypt(ciphertext)
+	is.NoErr(err)
+	is.Equal("secret", plaintext)
+}
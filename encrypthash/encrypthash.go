@@ -4,7 +4,10 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/bokwoon95/erro"
 	"golang.org/x/crypto/blake2b"
@@ -21,164 +24,287 @@ type Hasher interface {
 	VerifyHash(data []byte, hash []byte) error
 }
 
+// Blackbox encrypts and hashes with the keys of a KeyProvider. The first key
+// is current and the rest are only used for decrypting and verifying, so that
+// keys can be rotated.
+//
+// Everything a Blackbox produces is bound to its purpose (see WithPurpose) and
+// to any associated data passed to the *AD methods, so output meant for one
+// use is rejected by another even though both share the same keys.
 type Blackbox struct {
-	key        []byte
-	getKeys    func() (keys [][]byte, err error)
+	provider   KeyProvider
 	processKey func(input []byte) (output []byte, err error)
+	purpose    string
+	ttl        time.Duration
 }
 
 var _ Encrypter = &Blackbox{}
 var _ Hasher = &Blackbox{}
 
+// The wire format is versioned so that the algorithms can change without
+// breaking existing ciphertexts and hashes. Version 1 is
+//
+//	ciphertext: header | nonce (24 bytes) | secretbox(plaintext)
+//	hash:       header | blake2b-256 MAC of the message (32 bytes)
+//	header:     version (1 byte) | expiry in unix seconds, 0 if none (8 bytes)
+//
+// The secretbox and MAC keys are derived from the key, the purpose, the
+// associated data and the header, so none of them can be changed without the
+// ciphertext or hash failing to verify.
+//
+// Output from before versioning (a bare nonce and secretbox, or a 64 byte
+// blake2b-512 MAC) is still accepted by a Blackbox without a purpose when no
+// associated data is given.
+const (
+	version1   = 1
+	headerSize = 1 + 8
+	nonceSize  = 24
+	hashSize   = 32
+)
+
+var (
+	// ErrInvalid is returned when a ciphertext or hash does not verify.
+	ErrInvalid = errors.New("encrypthash: invalid ciphertext or hash")
+	// ErrExpired is returned when a ciphertext or hash verifies but has
+	// expired.
+	ErrExpired = errors.New("encrypthash: expired")
+)
+
+// now is replaced in tests.
+var now = time.Now
+
 func New(key []byte, getKeys func() (keys [][]byte, err error), processKey func(input []byte) (output []byte, err error)) (*Blackbox, error) {
 	if len(key) == 0 && getKeys == nil {
 		return nil, erro.Wrap(fmt.Errorf("Either keys or getKeys function must be non-nil"))
 	}
-	return &Blackbox{key: key, getKeys: getKeys}, nil
+	var provider KeyProvider = StaticKey(key)
+	if getKeys != nil {
+		provider = KeyProviderFunc(getKeys)
+	}
+	return &Blackbox{provider: provider, processKey: processKey}, nil
 }
 
-func (box *Blackbox) Encrypt(plaintext []byte) (ciphertext []byte, err error) {
-	const nonceSize = 24
-	var key []byte
-	if box.getKeys != nil {
-		var keys [][]byte
-		keys, err = box.getKeys()
-		if err != nil {
-			return nil, erro.Wrap(err)
-		}
-		if len(keys) == 0 {
-			return nil, erro.Wrap(fmt.Errorf("no key found"))
-		}
-		key = keys[0]
-	} else {
-		if len(box.key) == 0 {
-			return nil, erro.Wrap(fmt.Errorf("no key found"))
-		}
-		key = box.key
+// WithPurpose returns a Blackbox with the same keys whose output can only be
+// decrypted or verified by a Blackbox with the same purpose. Purposes name
+// what the output is used for, e.g. "hyforms.csrf".
+func (box *Blackbox) WithPurpose(purpose string) *Blackbox {
+	b := *box
+	b.purpose = purpose
+	return &b
+}
+
+// WithTTL returns a Blackbox whose ciphertexts and hashes expire after ttl.
+// Expired output fails with ErrExpired. A ttl of zero means no expiry.
+func (box *Blackbox) WithTTL(ttl time.Duration) *Blackbox {
+	b := *box
+	b.ttl = ttl
+	return &b
+}
+
+// keyList returns the keys to try, the first one being the one to encrypt
+// with.
+func (box *Blackbox) keyList() ([][]byte, error) {
+	keys, err := box.provider.Keys()
+	if err != nil {
+		return nil, erro.Wrap(err)
 	}
+	if len(keys) == 0 {
+		return nil, erro.Wrap(fmt.Errorf("no key found"))
+	}
+	return keys, nil
+}
+
+// rootKeys hashes key into the root encryption and MAC keys that every other
+// key is derived from.
+func (box *Blackbox) rootKeys(key []byte) (encryptionKey, macKey []byte, err error) {
 	if box.processKey != nil {
 		key, err = box.processKey(key)
 		if err != nil {
-			return nil, erro.Wrap(err)
+			return nil, nil, erro.Wrap(err)
 		}
 	}
 	hashedKey := blake2b.Sum512(key)
-	var hashKeyUpper [32]byte
-	copy(hashKeyUpper[:], hashedKey[:32])
+	return hashedKey[:32], hashedKey[32:], nil
+}
+
+// deriveKey derives the key for one use of rootKey. Every input is length
+// prefixed so that no two different sets of inputs hash the same.
+func (box *Blackbox) deriveKey(rootKey []byte, label string, ad, header []byte) *[32]byte {
+	h, _ := blake2b.New256(rootKey)
+	var n [8]byte
+	for _, b := range [][]byte{[]byte(label), []byte(box.purpose), ad, header} {
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	var key [32]byte
+	copy(key[:], h.Sum(nil))
+	return &key
+}
+
+func (box *Blackbox) newHeader() []byte {
+	header := make([]byte, headerSize)
+	header[0] = version1
+	if box.ttl > 0 {
+		binary.BigEndian.PutUint64(header[1:], uint64(now().Add(box.ttl).Unix()))
+	}
+	return header
+}
+
+// checkExpiry must only be called on a header that has been authenticated.
+func checkExpiry(header []byte) error {
+	expiry := int64(binary.BigEndian.Uint64(header[1:]))
+	if expiry != 0 && now().Unix() >= expiry {
+		return erro.Wrap(ErrExpired)
+	}
+	return nil
+}
+
+// acceptsLegacy reports whether unversioned output may be accepted, which
+// carries neither a purpose nor associated data.
+func (box *Blackbox) acceptsLegacy(ad []byte) bool {
+	return box.purpose == "" && len(ad) == 0
+}
+
+func (box *Blackbox) Encrypt(plaintext []byte) (ciphertext []byte, err error) {
+	return box.EncryptAD(plaintext, nil)
+}
+
+// EncryptAD encrypts plaintext bound to the associated data ad, which is
+// authenticated but not included in the ciphertext. The same ad must be
+// passed to DecryptAD.
+func (box *Blackbox) EncryptAD(plaintext, ad []byte) (ciphertext []byte, err error) {
+	keys, err := box.keyList()
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	encryptionKey, _, err := box.rootKeys(keys[0])
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	header := box.newHeader()
 	var nonce [nonceSize]byte
 	if _, err := rand.Read(nonce[:]); err != nil {
 		return nil, erro.Wrap(err)
 	}
-	ciphertext = secretbox.Seal(nonce[:], plaintext, &nonce, &hashKeyUpper)
+	ciphertext = append(header, nonce[:]...)
+	ciphertext = secretbox.Seal(ciphertext, plaintext, &nonce, box.deriveKey(encryptionKey, "encrypt", ad, header))
 	return ciphertext, nil
 }
 
 func (box *Blackbox) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
-	const nonceSize = 24
-	var keys [][]byte
-	if box.getKeys != nil {
-		keys, err = box.getKeys()
-		if err != nil {
-			return nil, erro.Wrap(err)
-		}
-		if len(keys) == 0 {
-			return nil, erro.Wrap(fmt.Errorf("no key found"))
-		}
-	} else {
-		if len(box.key) == 0 {
-			return nil, erro.Wrap(fmt.Errorf("no key found"))
-		}
-		keys = [][]byte{box.key}
+	return box.DecryptAD(ciphertext, nil)
+}
+
+// DecryptAD decrypts a ciphertext made by EncryptAD with the same ad.
+func (box *Blackbox) DecryptAD(ciphertext, ad []byte) (plaintext []byte, err error) {
+	keys, err := box.keyList()
+	if err != nil {
+		return nil, erro.Wrap(err)
 	}
-	for _, key := range keys {
-		if box.processKey != nil {
-			key, err = box.processKey(key)
+	// a legacy ciphertext starts with a random nonce, so it can look like
+	// version 1 by chance and has to be tried as both
+	if len(ciphertext) >= headerSize+nonceSize+secretbox.Overhead && ciphertext[0] == version1 {
+		header := ciphertext[:headerSize]
+		var nonce [nonceSize]byte
+		copy(nonce[:], ciphertext[headerSize:])
+		for _, key := range keys {
+			encryptionKey, _, err := box.rootKeys(key)
 			if err != nil {
 				return nil, erro.Wrap(err)
 			}
+			plaintext, ok := secretbox.Open(nil, ciphertext[headerSize+nonceSize:], &nonce, box.deriveKey(encryptionKey, "encrypt", ad, header))
+			if !ok {
+				continue
+			}
+			if err := checkExpiry(header); err != nil {
+				return nil, err
+			}
+			return plaintext, nil
 		}
-		hashedKey := blake2b.Sum512(key)
-		var hashedKeyUpper [32]byte
-		copy(hashedKeyUpper[:], hashedKey[:32])
+	}
+	if box.acceptsLegacy(ad) && len(ciphertext) >= nonceSize+secretbox.Overhead {
 		var nonce [nonceSize]byte
 		copy(nonce[:], ciphertext[:nonceSize])
-		plaintext, ok := secretbox.Open(nil, ciphertext[nonceSize:], &nonce, &hashedKeyUpper)
-		if !ok {
-			continue
+		for _, key := range keys {
+			encryptionKey, _, err := box.rootKeys(key)
+			if err != nil {
+				return nil, erro.Wrap(err)
+			}
+			var secretboxKey [32]byte
+			copy(secretboxKey[:], encryptionKey)
+			plaintext, ok := secretbox.Open(nil, ciphertext[nonceSize:], &nonce, &secretboxKey)
+			if !ok {
+				continue
+			}
+			return plaintext, nil
 		}
-		return plaintext, nil
 	}
-	return nil, erro.Wrap(fmt.Errorf("decryption error"))
+	return nil, erro.Wrap(ErrInvalid)
 }
 
 func (box *Blackbox) Hash(msg []byte) (hash []byte, err error) {
-	var key []byte
-	if box.getKeys != nil {
-		var keys [][]byte
-		keys, err = box.getKeys()
-		if err != nil {
-			return nil, erro.Wrap(err)
-		}
-		if len(keys) == 0 {
-			return nil, erro.Wrap(fmt.Errorf("no key found"))
-		}
-		key = keys[0]
-	} else {
-		if len(box.key) == 0 {
-			return nil, erro.Wrap(fmt.Errorf("no key found"))
-		}
-		key = box.key
+	return box.HashAD(msg, nil)
+}
+
+// HashAD hashes msg bound to the associated data ad, which is not included
+// in the hash. The same ad must be passed to VerifyHashAD.
+func (box *Blackbox) HashAD(msg, ad []byte) (hash []byte, err error) {
+	keys, err := box.keyList()
+	if err != nil {
+		return nil, erro.Wrap(err)
 	}
-	if box.processKey != nil {
-		key, err = box.processKey(key)
-		if err != nil {
-			return nil, erro.Wrap(err)
-		}
+	_, macKey, err := box.rootKeys(keys[0])
+	if err != nil {
+		return nil, erro.Wrap(err)
 	}
-	hashedKey := blake2b.Sum512([]byte(key))
-	hashedKeyLower := hashedKey[32:]
-	h, _ := blake2b.New512(hashedKeyLower)
-	h.Reset()
-	h.Write([]byte(msg))
-	sum := h.Sum(nil)
-	return sum, nil
+	header := box.newHeader()
+	return append(header, box.mac(macKey, msg, ad, header)...), nil
+}
+
+func (box *Blackbox) mac(macKey, msg, ad, header []byte) []byte {
+	key := box.deriveKey(macKey, "hash", ad, header)
+	h, _ := blake2b.New256(key[:])
+	h.Write(msg)
+	return h.Sum(nil)
 }
 
 func (box *Blackbox) VerifyHash(msg []byte, hash []byte) error {
-	var err error
-	var keys [][]byte
-	if box.getKeys != nil {
-		keys, err = box.getKeys()
-		if err != nil {
-			return erro.Wrap(err)
-		}
-		if len(keys) == 0 {
-			return erro.Wrap(fmt.Errorf("no key found"))
-		}
-	} else {
-		if len(box.key) == 0 {
-			return erro.Wrap(fmt.Errorf("no key found"))
-		}
-		keys = [][]byte{box.key}
+	return box.VerifyHashAD(msg, nil, hash)
+}
+
+// VerifyHashAD verifies a hash made by HashAD with the same ad.
+func (box *Blackbox) VerifyHashAD(msg, ad, hash []byte) error {
+	keys, err := box.keyList()
+	if err != nil {
+		return erro.Wrap(err)
 	}
-	for _, key := range keys {
-		if box.processKey != nil {
-			key, err = box.processKey(key)
+	switch {
+	case len(hash) == headerSize+hashSize && hash[0] == version1:
+		header := hash[:headerSize]
+		for _, key := range keys {
+			_, macKey, err := box.rootKeys(key)
 			if err != nil {
 				return erro.Wrap(err)
 			}
+			if subtle.ConstantTimeCompare(box.mac(macKey, msg, ad, header), hash[headerSize:]) == 1 {
+				return checkExpiry(header)
+			}
 		}
-		hashedKey := blake2b.Sum512([]byte(key))
-		hashedKeyLower := hashedKey[32:]
-		h, _ := blake2b.New512(hashedKeyLower)
-		h.Reset()
-		h.Write([]byte(msg))
-		computedHash := h.Sum(nil)
-		if subtle.ConstantTimeCompare(computedHash, hash) == 1 {
-			return nil
+	case len(hash) == blake2b.Size && box.acceptsLegacy(ad):
+		for _, key := range keys {
+			_, macKey, err := box.rootKeys(key)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			h, _ := blake2b.New512(macKey)
+			h.Write(msg)
+			if subtle.ConstantTimeCompare(h.Sum(nil), hash) == 1 {
+				return nil
+			}
 		}
 	}
-	return erro.Wrap(fmt.Errorf("hash not valid"))
+	return erro.Wrap(ErrInvalid)
 }
 
 func (box *Blackbox) Base64Encrypt(plaintext []byte) (b64Ciphertext string, err error) {
@@ -1,10 +1,15 @@
 package encrypthash
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/bokwoon95/pagemanager/testutil"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 func Test_Box(t *testing.T) {
@@ -38,3 +43,112 @@ func Test_Box(t *testing.T) {
 		is.True(err != nil)
 	})
 }
+
+func Test_Binding(t *testing.T) {
+	is := testutil.New(t)
+	box, err := New([]byte("abcdefg"), nil, nil)
+	is.NoErr(err)
+	plaintext := []byte("lorem ipsum dolor sit amet")
+	ad := []byte("session id")
+
+	t.Run("purpose", func(t *testing.T) {
+		is := testutil.New(t)
+		a, b := box.WithPurpose("a"), box.WithPurpose("b")
+		ciphertext, err := a.Encrypt(plaintext)
+		is.NoErr(err)
+		got, err := a.Decrypt(ciphertext)
+		is.NoErr(err)
+		is.Equal(plaintext, got)
+		_, err = b.Decrypt(ciphertext)
+		is.True(errors.Is(err, ErrInvalid))
+		_, err = box.Decrypt(ciphertext)
+		is.True(errors.Is(err, ErrInvalid))
+		hash, err := a.Hash(plaintext)
+		is.NoErr(err)
+		is.NoErr(a.VerifyHash(plaintext, hash))
+		is.True(errors.Is(b.VerifyHash(plaintext, hash), ErrInvalid))
+		is.True(errors.Is(box.VerifyHash(plaintext, hash), ErrInvalid))
+	})
+
+	t.Run("associated data", func(t *testing.T) {
+		is := testutil.New(t)
+		ciphertext, err := box.EncryptAD(plaintext, ad)
+		is.NoErr(err)
+		got, err := box.DecryptAD(ciphertext, ad)
+		is.NoErr(err)
+		is.Equal(plaintext, got)
+		_, err = box.DecryptAD(ciphertext, []byte("other session id"))
+		is.True(errors.Is(err, ErrInvalid))
+		_, err = box.Decrypt(ciphertext)
+		is.True(errors.Is(err, ErrInvalid))
+		hash, err := box.HashAD(plaintext, ad)
+		is.NoErr(err)
+		is.NoErr(box.VerifyHashAD(plaintext, ad, hash))
+		is.True(errors.Is(box.VerifyHashAD(plaintext, []byte("other session id"), hash), ErrInvalid))
+		is.True(errors.Is(box.VerifyHash(plaintext, hash), ErrInvalid))
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		is := testutil.New(t)
+		defer func() { now = time.Now }()
+		start := time.Now()
+		now = func() time.Time { return start }
+		expiring := box.WithTTL(time.Minute)
+		ciphertext, err := expiring.Encrypt(plaintext)
+		is.NoErr(err)
+		hash, err := expiring.Hash(plaintext)
+		is.NoErr(err)
+		_, err = box.Decrypt(ciphertext)
+		is.NoErr(err)
+		is.NoErr(box.VerifyHash(plaintext, hash))
+
+		// the expiry is authenticated
+		tampered := append([]byte{}, hash...)
+		tampered[8]++
+		is.True(errors.Is(box.VerifyHash(plaintext, tampered), ErrInvalid))
+		tampered = append([]byte{}, ciphertext...)
+		tampered[8]++
+		_, err = box.Decrypt(tampered)
+		is.True(errors.Is(err, ErrInvalid))
+
+		now = func() time.Time { return start.Add(time.Minute) }
+		_, err = box.Decrypt(ciphertext)
+		is.True(errors.Is(err, ErrExpired))
+		is.True(errors.Is(box.VerifyHash(plaintext, hash), ErrExpired))
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		is := testutil.New(t)
+		hash, err := box.Hash(plaintext)
+		is.NoErr(err)
+		hash[0] = 2
+		is.True(errors.Is(box.VerifyHash(plaintext, hash), ErrInvalid))
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		is := testutil.New(t)
+		// output of the unversioned format
+		hashedKey := blake2b.Sum512([]byte("abcdefg"))
+		var secretboxKey [32]byte
+		copy(secretboxKey[:], hashedKey[:32])
+		var nonce [24]byte
+		_, _ = rand.Read(nonce[:])
+		ciphertext := secretbox.Seal(nonce[:], plaintext, &nonce, &secretboxKey)
+		h, _ := blake2b.New512(hashedKey[32:])
+		h.Write(plaintext)
+		hash := h.Sum(nil)
+
+		got, err := box.Decrypt(ciphertext)
+		is.NoErr(err)
+		is.Equal(plaintext, got)
+		is.NoErr(box.VerifyHash(plaintext, hash))
+		// legacy output carries no purpose or associated data, so it
+		// cannot stand in for output that does
+		_, err = box.WithPurpose("a").Decrypt(ciphertext)
+		is.True(errors.Is(err, ErrInvalid))
+		_, err = box.DecryptAD(ciphertext, ad)
+		is.True(errors.Is(err, ErrInvalid))
+		is.True(errors.Is(box.WithPurpose("a").VerifyHash(plaintext, hash), ErrInvalid))
+		is.True(errors.Is(box.VerifyHashAD(plaintext, ad, hash), ErrInvalid))
+	})
+}
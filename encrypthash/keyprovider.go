@@ -0,0 +1,126 @@
+package encrypthash
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+// KeyProvider supplies the keys a Blackbox encrypts and hashes with. Keys
+// returns the current key first, followed by older keys that are still
+// accepted for decrypting and verifying. Keys is called on every operation,
+// so providers that are expensive to query should cache.
+type KeyProvider interface {
+	Keys() (keys [][]byte, err error)
+}
+
+// KeyProviderFunc adapts a function to a KeyProvider.
+type KeyProviderFunc func() (keys [][]byte, err error)
+
+func (f KeyProviderFunc) Keys() ([][]byte, error) { return f() }
+
+type staticKey []byte
+
+// StaticKey returns a KeyProvider that always provides key.
+func StaticKey(key []byte) KeyProvider { return staticKey(key) }
+
+func (key staticKey) Keys() ([][]byte, error) {
+	if len(key) == 0 {
+		return nil, erro.Wrap(fmt.Errorf("no key found"))
+	}
+	return [][]byte{key}, nil
+}
+
+// NewWithKeyProvider returns a Blackbox that gets its keys from provider.
+func NewWithKeyProvider(provider KeyProvider) (*Blackbox, error) {
+	if provider == nil {
+		return nil, erro.Wrap(fmt.Errorf("provider must be non-nil"))
+	}
+	return &Blackbox{provider: provider}, nil
+}
+
+// KeyFile is a KeyProvider that reads keys from a file, one base64 encoded
+// key per line with the current key first. Blank lines and lines starting
+// with # are ignored. The file is read again whenever it changes, so keys can
+// be rotated by adding a new first line, and retired by removing theirs.
+type KeyFile struct {
+	path    string
+	mu      *sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    [][]byte
+}
+
+// NewKeyFile returns a KeyFile for the file at path. The file is not read
+// until keys are needed.
+func NewKeyFile(path string) *KeyFile {
+	return &KeyFile{path: path, mu: &sync.Mutex{}}
+}
+
+func (kf *KeyFile) Keys() ([][]byte, error) {
+	info, err := os.Stat(kf.path)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+	if kf.keys != nil && info.ModTime().Equal(kf.modTime) && info.Size() == kf.size {
+		return kf.keys, nil
+	}
+	b, err := os.ReadFile(kf.path)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	var keys [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			key, err = base64.RawURLEncoding.DecodeString(string(line))
+		}
+		if err != nil {
+			return nil, erro.Wrap(fmt.Errorf("%s:%d: invalid base64 key", kf.path, lineno))
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, erro.Wrap(fmt.Errorf("%s: no key found", kf.path))
+	}
+	kf.modTime, kf.size, kf.keys = info.ModTime(), info.Size(), keys
+	return keys, nil
+}
+
+// GenerateKeyFile creates a key file at path holding one random key, readable
+// only by its owner. It does nothing if the file already exists.
+func GenerateKeyFile(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return erro.Wrap(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	_, err = f.WriteString("# the first key is current, older keys are still accepted\n" + base64.StdEncoding.EncodeToString(key) + "\n")
+	if err != nil {
+		f.Close()
+		return erro.Wrap(err)
+	}
+	return erro.Wrap(f.Close())
+}
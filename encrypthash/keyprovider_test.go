@@ -0,0 +1,71 @@
+package encrypthash
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_KeyFile(t *testing.T) {
+	is := testutil.New(t)
+	path := filepath.Join(t.TempDir(), "keys")
+	is.NoErr(GenerateKeyFile(path))
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(os.FileMode(0600), info.Mode().Perm())
+	b, err := os.ReadFile(path)
+	is.NoErr(err)
+	// generating again leaves the existing key alone
+	is.NoErr(GenerateKeyFile(path))
+	b2, err := os.ReadFile(path)
+	is.NoErr(err)
+	is.Equal(string(b), string(b2))
+
+	kf := NewKeyFile(path)
+	box, err := NewWithKeyProvider(kf)
+	is.NoErr(err)
+	plaintext := []byte("lorem ipsum dolor sit amet")
+	oldCiphertext, err := box.Encrypt(plaintext)
+	is.NoErr(err)
+
+	// rotate by adding a new first key
+	newKey := base64.StdEncoding.EncodeToString([]byte("a new key that is long enough"))
+	is.NoErr(os.WriteFile(path, append([]byte(newKey+"\n\n"), b...), 0600))
+	keys, err := kf.Keys()
+	is.NoErr(err)
+	is.Equal(2, len(keys))
+	is.Equal("a new key that is long enough", string(keys[0]))
+	got, err := box.Decrypt(oldCiphertext)
+	is.NoErr(err)
+	is.Equal(plaintext, got)
+	newCiphertext, err := box.Encrypt(plaintext)
+	is.NoErr(err)
+
+	// retire the old key
+	is.NoErr(os.WriteFile(path, []byte(newKey+"\n"), 0600))
+	_, err = box.Decrypt(oldCiphertext)
+	is.True(errors.Is(err, ErrInvalid))
+	got, err = box.Decrypt(newCiphertext)
+	is.NoErr(err)
+	is.Equal(plaintext, got)
+
+	is.NoErr(os.WriteFile(path, []byte("# no keys\nnot base64!\n"), 0600))
+	_, err = kf.Keys()
+	is.True(err != nil)
+	_, err = NewKeyFile(filepath.Join(t.TempDir(), "missing")).Keys()
+	is.True(errors.Is(err, os.ErrNotExist))
+}
+
+func Test_StaticKey(t *testing.T) {
+	is := testutil.New(t)
+	box, err := NewWithKeyProvider(StaticKey(nil))
+	is.NoErr(err)
+	_, err = box.Encrypt([]byte("lorem ipsum"))
+	is.True(err != nil)
+	_, err = NewWithKeyProvider(nil)
+	is.True(err != nil)
+}
@@ -0,0 +1,243 @@
+package encrypthash
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bokwoon95/erro"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Streams are encrypted in chunks so that neither side has to hold the whole
+// plaintext in memory. The format is
+//
+//	header: version (1 byte) | nonce prefix (15 random bytes)
+//	chunks: secretbox(chunk) ...
+//
+// Every chunk but the last holds exactly StreamChunkSize bytes of plaintext,
+// the last holds up to StreamChunkSize (possibly none). Chunk i is sealed with
+// the nonce
+//
+//	nonce prefix (15 bytes) | i (8 bytes, big endian) | 1 if last else 0
+//
+// so chunks cannot be reordered or moved between streams, and a stream cut
+// short at a chunk boundary is detected because its new final chunk was not
+// sealed as the last one. The chunk key is derived from the header and the
+// Blackbox's purpose like Encrypt's is; streams never expire.
+const (
+	StreamChunkSize = 64 * 1024
+
+	streamVersion     = 1
+	streamPrefixSize  = 15
+	streamHeaderSize  = 1 + streamPrefixSize
+	streamSealedChunk = StreamChunkSize + secretbox.Overhead
+)
+
+// ErrInvalidStream is returned when an encrypted stream is malformed, was
+// tampered with, or was truncated.
+var ErrInvalidStream = errors.New("encrypthash: invalid or truncated encrypted stream")
+
+func streamNonce(prefix []byte, counter uint64, last bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:streamPrefixSize], prefix)
+	binary.BigEndian.PutUint64(nonce[streamPrefixSize:], counter)
+	if last {
+		nonce[23] = 1
+	}
+	return &nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	key     *[32]byte
+	prefix  []byte
+	counter uint64
+	buf     []byte // plaintext waiting to be sealed
+	out     []byte
+	err     error
+	closed  bool
+}
+
+// EncryptWriter returns a writer that encrypts everything written to it with
+// the current key and writes the result to w. Close must be called to write
+// the final chunk, without it the stream is unreadable. Close does not close
+// w.
+func (box *Blackbox) EncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	keys, err := box.keyList()
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	encryptionKey, _, err := box.rootKeys(keys[0])
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	header := make([]byte, streamHeaderSize)
+	header[0] = streamVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, erro.Wrap(err)
+	}
+	key := box.deriveKey(encryptionKey, "stream", nil, header)
+	if _, err := w.Write(header); err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return &encryptWriter{
+		w:      w,
+		key:    key,
+		prefix: header[1:],
+		buf:    make([]byte, 0, StreamChunkSize),
+		out:    make([]byte, 0, streamSealedChunk),
+	}, nil
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	ew.out = secretbox.Seal(ew.out[:0], ew.buf, streamNonce(ew.prefix, ew.counter, last), ew.key)
+	ew.counter++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+func (ew *encryptWriter) Write(p []byte) (n int, err error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	if ew.closed {
+		return 0, erro.Wrap(fmt.Errorf("write to closed EncryptWriter"))
+	}
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, because the
+		// last chunk has to be sealed differently and that could be it
+		if len(ew.buf) == StreamChunkSize {
+			if ew.err = ew.seal(false); ew.err != nil {
+				return n, erro.Wrap(ew.err)
+			}
+		}
+		m := copy(ew.buf[len(ew.buf):StreamChunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close seals and writes the final chunk.
+func (ew *encryptWriter) Close() error {
+	if ew.err != nil {
+		return ew.err
+	}
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	if ew.err = ew.seal(true); ew.err != nil {
+		return erro.Wrap(ew.err)
+	}
+	return nil
+}
+
+type decryptReader struct {
+	box     *Blackbox
+	r       *bufio.Reader
+	key     *[32]byte // found by opening the first chunk
+	header  []byte
+	prefix  []byte
+	counter uint64
+	in      []byte
+	buf     []byte // decrypted plaintext not yet read
+	done    bool
+	err     error
+}
+
+// DecryptReader returns a reader of the plaintext of a stream written by
+// EncryptWriter, read from r. Every key is tried, so streams written before
+// a key rotation still decrypt. Read returns an error wrapping
+// ErrInvalidStream if the stream has been tampered with, reordered or
+// truncated; plaintext returned before that is authentic but incomplete.
+func (box *Blackbox) DecryptReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, streamSealedChunk+1)
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, erro.Wrap(ErrInvalidStream)
+	}
+	if header[0] != streamVersion {
+		return nil, erro.Wrap(fmt.Errorf("%w: unknown version %d", ErrInvalidStream, header[0]))
+	}
+	return &decryptReader{
+		box:    box,
+		r:      br,
+		header: header,
+		prefix: header[1:],
+		in:     make([]byte, streamSealedChunk),
+	}, nil
+}
+
+// next reads, authenticates and decrypts the next chunk into dr.buf.
+func (dr *decryptReader) next() error {
+	n, err := io.ReadFull(dr.r, dr.in)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && n < secretbox.Overhead) {
+		// the stream ended without a chunk sealed as the last one
+		return erro.Wrap(ErrInvalidStream)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return erro.Wrap(err)
+	}
+	last := n < len(dr.in)
+	if !last {
+		// a full sized chunk is the last one only if nothing follows it
+		_, err := dr.r.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	nonce := streamNonce(dr.prefix, dr.counter, last)
+	if dr.key == nil {
+		keys, err := dr.box.keyList()
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, k := range keys {
+			encryptionKey, _, err := dr.box.rootKeys(k)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			key := dr.box.deriveKey(encryptionKey, "stream", nil, dr.header)
+			if plaintext, ok := secretbox.Open(dr.buf[:0], dr.in[:n], nonce, key); ok {
+				dr.key, dr.buf = key, plaintext
+				break
+			}
+		}
+		if dr.key == nil {
+			return erro.Wrap(ErrInvalidStream)
+		}
+	} else {
+		plaintext, ok := secretbox.Open(dr.buf[:0], dr.in[:n], nonce, dr.key)
+		if !ok {
+			return erro.Wrap(ErrInvalidStream)
+		}
+		dr.buf = plaintext
+	}
+	dr.counter++
+	dr.done = last
+	return nil
+}
+
+func (dr *decryptReader) Read(p []byte) (n int, err error) {
+	for len(dr.buf) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.err = dr.next()
+	}
+	n = copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,175 @@
+package encrypthash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+func encryptStream(t *testing.T, box *Blackbox, plaintext []byte) []byte {
+	is := testutil.New(t)
+	buf := &bytes.Buffer{}
+	w, err := box.EncryptWriter(buf)
+	is.NoErr(err)
+	_, err = w.Write(plaintext)
+	is.NoErr(err)
+	is.NoErr(w.Close())
+	return buf.Bytes()
+}
+
+func decryptStream(box *Blackbox, ciphertext []byte) ([]byte, error) {
+	r, err := box.DecryptReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func Test_Stream(t *testing.T) {
+	is := testutil.New(t)
+	box, err := New([]byte("abcdefg"), nil, nil)
+	is.NoErr(err)
+	const sealed = StreamChunkSize + secretbox.Overhead
+	// chunk i starts at this offset in the ciphertext
+	chunkAt := func(i int) int { return streamHeaderSize + i*sealed }
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, size := range []int{0, 1, 100, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3 * StreamChunkSize} {
+			is := testutil.New(t)
+			plaintext := make([]byte, size)
+			_, _ = rand.Read(plaintext)
+			ciphertext := encryptStream(t, box, plaintext)
+			got, err := decryptStream(box, ciphertext)
+			is.NoErr(err)
+			is.True(bytes.Equal(plaintext, got))
+		}
+	})
+
+	t.Run("small writes", func(t *testing.T) {
+		is := testutil.New(t)
+		plaintext := make([]byte, 2*StreamChunkSize+7)
+		_, _ = rand.Read(plaintext)
+		buf := &bytes.Buffer{}
+		w, err := box.EncryptWriter(buf)
+		is.NoErr(err)
+		for i := 0; i < len(plaintext); i += 1000 {
+			end := i + 1000
+			if end > len(plaintext) {
+				end = len(plaintext)
+			}
+			_, err = w.Write(plaintext[i:end])
+			is.NoErr(err)
+		}
+		is.NoErr(w.Close())
+		got, err := decryptStream(box, buf.Bytes())
+		is.NoErr(err)
+		is.True(bytes.Equal(plaintext, got))
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		is := testutil.New(t)
+		keys := [][]byte{[]byte("old")}
+		rotating, err := New(nil, func() ([][]byte, error) { return keys, nil }, nil)
+		is.NoErr(err)
+		plaintext := []byte("lorem ipsum dolor sit amet")
+		oldCiphertext := encryptStream(t, rotating, plaintext)
+		keys = [][]byte{[]byte("new"), []byte("old")}
+		got, err := decryptStream(rotating, oldCiphertext)
+		is.NoErr(err)
+		is.Equal(plaintext, got)
+		newCiphertext := encryptStream(t, rotating, plaintext)
+		keys = [][]byte{[]byte("old")}
+		_, err = decryptStream(rotating, newCiphertext)
+		is.True(errors.Is(err, ErrInvalidStream))
+	})
+
+	plaintext := make([]byte, 3*StreamChunkSize+10)
+	_, _ = rand.Read(plaintext)
+	ciphertext := encryptStream(t, box, plaintext)
+	is.Equal(chunkAt(3)+10+secretbox.Overhead, len(ciphertext))
+	tampered := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, ciphertext...))
+	}
+	tests := []struct {
+		description string
+		ciphertext  []byte
+	}{
+		{"flip last byte of first chunk", tampered(func(b []byte) []byte {
+			b[chunkAt(1)-1] ^= 1
+			return b
+		})},
+		{"flip first byte of second chunk", tampered(func(b []byte) []byte {
+			b[chunkAt(1)] ^= 1
+			return b
+		})},
+		{"flip nonce prefix", tampered(func(b []byte) []byte {
+			b[1] ^= 1
+			return b
+		})},
+		{"swap chunks", tampered(func(b []byte) []byte {
+			first := append([]byte{}, b[chunkAt(0):chunkAt(1)]...)
+			copy(b[chunkAt(0):], b[chunkAt(1):chunkAt(2)])
+			copy(b[chunkAt(1):], first)
+			return b
+		})},
+		{"drop a chunk", tampered(func(b []byte) []byte {
+			return append(b[:chunkAt(1)], b[chunkAt(2):]...)
+		})},
+		{"truncate at chunk boundary", tampered(func(b []byte) []byte {
+			return b[:chunkAt(3)]
+		})},
+		{"truncate inside chunk", tampered(func(b []byte) []byte {
+			return b[:chunkAt(2)+100]
+		})},
+		{"truncate header", tampered(func(b []byte) []byte {
+			return b[:streamHeaderSize-1]
+		})},
+		{"append data", tampered(func(b []byte) []byte {
+			return append(b, 0)
+		})},
+		{"append chunk", tampered(func(b []byte) []byte {
+			return append(b, b[chunkAt(0):chunkAt(1)]...)
+		})},
+		{"splice chunk from another stream", func() []byte {
+			other := encryptStream(t, box, plaintext)
+			b := append([]byte{}, ciphertext...)
+			copy(b[chunkAt(1):], other[chunkAt(1):chunkAt(2)])
+			return b
+		}()},
+		{"unknown version", tampered(func(b []byte) []byte {
+			b[0] = 99
+			return b
+		})},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			is := testutil.New(t)
+			_, err := decryptStream(box, tt.ciphertext)
+			is.True(errors.Is(err, ErrInvalidStream))
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		is := testutil.New(t)
+		other, err := New([]byte("gfedcba"), nil, nil)
+		is.NoErr(err)
+		_, err = decryptStream(other, ciphertext)
+		is.True(errors.Is(err, ErrInvalidStream))
+	})
+
+	t.Run("plaintext before tampering is still returned", func(t *testing.T) {
+		is := testutil.New(t)
+		// the second chunk looks like the last one but was not sealed as such
+		r, err := box.DecryptReader(bytes.NewReader(ciphertext[:chunkAt(2)]))
+		is.NoErr(err)
+		got, err := io.ReadAll(r)
+		is.True(errors.Is(err, ErrInvalidStream))
+		is.True(bytes.Equal(plaintext[:StreamChunkSize], got))
+	})
+}
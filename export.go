@@ -0,0 +1,597 @@
+package pagemanager
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// exportVersion is the version of the NDJSON export format. Import refuses
+// files with a newer version than it understands.
+const exportVersion = 1
+
+const (
+	exportKindHeader   = "header"
+	exportKindLocale   = "locale"
+	exportKindPage     = "page"
+	exportKindPageData = "pagedata"
+)
+
+// exportRecord is a single line of an NDJSON export. The first line of every
+// export is a header record; every other line holds exactly one of Locale,
+// Page or PageData.
+type exportRecord struct {
+	Kind       string          `json:"kind"`
+	Version    int             `json:"version,omitempty"`
+	ExportedAt *time.Time      `json:"exported_at,omitempty"`
+	Locale     *exportLocale   `json:"locale,omitempty"`
+	Page       *exportPage     `json:"page,omitempty"`
+	PageData   *exportPageData `json:"pagedata,omitempty"`
+}
+
+type exportLocale struct {
+	LocaleCode  string   `json:"locale_code"`
+	Description string   `json:"description,omitempty"`
+	Fallbacks   []string `json:"fallbacks,omitempty"`
+}
+
+type exportPage struct {
+	URL         string  `json:"url"`
+	Disabled    *bool   `json:"disabled,omitempty"`
+	RedirectURL *string `json:"redirect_url,omitempty"`
+	Plugin      *string `json:"plugin,omitempty"`
+	HandlerName *string `json:"handler_name,omitempty"`
+	HandlerURL  *string `json:"handler_url,omitempty"`
+	Content     *string `json:"content,omitempty"`
+	ThemePath   *string `json:"theme_path,omitempty"`
+	Template    *string `json:"template,omitempty"`
+}
+
+type exportPageData struct {
+	LocaleCode string `json:"locale_code"`
+	DataID     string `json:"data_id"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	ArrayIndex *int64 `json:"array_index,omitempty"`
+	Sensitive  bool   `json:"sensitive,omitempty"`
+}
+
+// ContentFilter restricts which content rows an export or import touches.
+// The zero value matches everything.
+type ContentFilter struct {
+	// URLPrefix matches pm_pages.URL and pm_pagedata.DATA_ID.
+	URLPrefix string
+	// LocaleCodes matches pm_locales.LOCALE_CODE and pm_pagedata.LOCALE_CODE.
+	// pm_pages rows are not localized and are always matched.
+	LocaleCodes []string
+}
+
+func (f ContentFilter) matchURL(url string) bool {
+	return strings.HasPrefix(url, f.URLPrefix)
+}
+
+func (f ContentFilter) matchLocale(localeCode string) bool {
+	if len(f.LocaleCodes) == 0 {
+		return true
+	}
+	for _, code := range f.LocaleCodes {
+		if code == localeCode {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixPredicate matches values of field starting with prefix, treating
+// LIKE wildcards in prefix literally.
+func prefixPredicate(field sq.Field, prefix string) sq.Predicate {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return sq.Predicatef(`? LIKE ? ESCAPE '\'`, field, r.Replace(prefix)+"%")
+}
+
+// Export writes pm_locales, pm_pages and pm_pagedata to w as NDJSON, one row
+// per line, streaming rows as they are read from the database. Sensitive page
+// data values are decrypted and marked sensitive, so exporting them needs the
+// keys to be unlocked and the export must be kept as secret as the keys.
+func (pm *PageManager) Export(ctx context.Context, w io.Writer, filter ContentFilter) error {
+	bufw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bufw)
+	now := time.Now().UTC()
+	err := enc.Encode(exportRecord{Kind: exportKindHeader, Version: exportVersion, ExportedAt: &now})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	LOCALES := tables.NEW_LOCALES(ctx, "l")
+	var localePredicates []sq.Predicate
+	if len(filter.LocaleCodes) > 0 {
+		localePredicates = append(localePredicates, LOCALES.LOCALE_CODE.In(filter.LocaleCodes))
+	}
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(LOCALES).
+		Where(localePredicates...).
+		OrderBy(LOCALES.LOCALE_CODE),
+		func(row *sq.Row) error {
+			l := &exportLocale{
+				LocaleCode:  row.String(LOCALES.LOCALE_CODE),
+				Description: row.String(LOCALES.DESCRIPTION),
+			}
+			b := row.Bytes(LOCALES.FALLBACKS)
+			return row.Accumulate(func() error {
+				if len(b) > 0 {
+					err := json.Unmarshal(b, &l.Fallbacks)
+					if err != nil {
+						return erro.Wrap(err)
+					}
+				}
+				return enc.Encode(exportRecord{Kind: exportKindLocale, Locale: l})
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	PAGES := tables.NEW_PAGES(ctx, "p")
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(PAGES).
+		Where(prefixPredicate(PAGES.URL, filter.URLPrefix)).
+		OrderBy(PAGES.URL),
+		func(row *sq.Row) error {
+			p := &exportPage{
+				URL:         row.String(PAGES.URL),
+				Disabled:    nullBoolPtr(row.NullBool(PAGES.DISABLED)),
+				RedirectURL: nullStringPtr(row.NullString(PAGES.REDIRECT_URL)),
+				Plugin:      nullStringPtr(row.NullString(PAGES.PLUGIN)),
+				HandlerName: nullStringPtr(row.NullString(PAGES.HANDLER_NAME)),
+				HandlerURL:  nullStringPtr(row.NullString(PAGES.HANDLER_URL)),
+				Content:     nullStringPtr(row.NullString(PAGES.CONTENT)),
+				ThemePath:   nullStringPtr(row.NullString(PAGES.THEME_PATH)),
+				Template:    nullStringPtr(row.NullString(PAGES.TEMPLATE)),
+			}
+			return row.Accumulate(func() error {
+				return enc.Encode(exportRecord{Kind: exportKindPage, Page: p})
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "pd")
+	pagedataPredicates := []sq.Predicate{prefixPredicate(PAGEDATA.DATA_ID, filter.URLPrefix)}
+	if len(filter.LocaleCodes) > 0 {
+		pagedataPredicates = append(pagedataPredicates, PAGEDATA.LOCALE_CODE.In(filter.LocaleCodes))
+	}
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(PAGEDATA).
+		Where(pagedataPredicates...).
+		OrderBy(PAGEDATA.DATA_ID, PAGEDATA.LOCALE_CODE, PAGEDATA.KEY, PAGEDATA.ARRAY_INDEX),
+		func(row *sq.Row) error {
+			pd := &exportPageData{
+				LocaleCode: row.String(PAGEDATA.LOCALE_CODE),
+				DataID:     row.String(PAGEDATA.DATA_ID),
+				Key:        row.String(PAGEDATA.KEY),
+				ArrayIndex: nullInt64Ptr(row.NullInt64(PAGEDATA.ARRAY_INDEX)),
+			}
+			b := row.Bytes(PAGEDATA.VALUE)
+			return row.Accumulate(func() error {
+				pd.Value = string(b)
+				if strings.HasPrefix(pd.Value, sensitivePrefix) {
+					value, err := pm.openPageValue(pd.Value)
+					if err != nil {
+						return erro.Wrap(fmt.Errorf("%s:%s:%s: %w", pd.LocaleCode, pd.DataID, pd.Key, err))
+					}
+					pd.Value, pd.Sensitive = value, true
+				}
+				return enc.Encode(exportRecord{Kind: exportKindPageData, PageData: pd})
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+const (
+	ImportInsert    = "insert"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+)
+
+// ImportChange describes what an import did (or, for a dry run, would do)
+// to a single row identified by its natural key.
+type ImportChange struct {
+	Kind   string // "locale", "page" or "pagedata"
+	Key    string // natural key of the row
+	Action string // ImportInsert, ImportUpdate or ImportUnchanged
+}
+
+type ImportResult struct {
+	Changes   []ImportChange
+	Inserted  int
+	Updated   int
+	Unchanged int
+}
+
+func (res *ImportResult) add(kind, key, action string) {
+	res.Changes = append(res.Changes, ImportChange{Kind: kind, Key: key, Action: action})
+	switch action {
+	case ImportInsert:
+		res.Inserted++
+	case ImportUpdate:
+		res.Updated++
+	case ImportUnchanged:
+		res.Unchanged++
+	}
+}
+
+// Import reads an NDJSON export from r and upserts every row matching filter
+// using the tables' natural keys, so importing the same file twice is a
+// no-op. If dryRun is true nothing is written and the returned result
+// describes the changes that would have been made. Page data that is marked
+// sensitive in the export or in its template's schema is encrypted before it
+// is stored, which needs the keys to be unlocked.
+func (pm *PageManager) Import(ctx context.Context, r io.Reader, filter ContentFilter, dryRun bool) (ImportResult, error) {
+	var res ImportResult
+	tx, err := pm.dataDB.BeginTx(ctx, nil)
+	if err != nil {
+		return res, erro.Wrap(err)
+	}
+	defer tx.Rollback()
+	touchedURLs := make(map[string]struct{}) // URLs whose search index entries need updating
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var record exportRecord
+		err = dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			if line == 1 {
+				return res, erro.Wrap(fmt.Errorf("empty import"))
+			}
+			break
+		}
+		if err != nil {
+			return res, erro.Wrap(fmt.Errorf("record %d: %w", line, err))
+		}
+		if line == 1 {
+			if record.Kind != exportKindHeader {
+				return res, erro.Wrap(fmt.Errorf("record 1: expected a %s record, got %q", exportKindHeader, record.Kind))
+			}
+			if record.Version > exportVersion {
+				return res, erro.Wrap(fmt.Errorf("export version %d is newer than the supported version %d", record.Version, exportVersion))
+			}
+			continue
+		}
+		switch {
+		case record.Kind == exportKindLocale && record.Locale != nil:
+			if !filter.matchLocale(record.Locale.LocaleCode) {
+				continue
+			}
+			err = importLocale(ctx, tx, record.Locale, dryRun, &res)
+		case record.Kind == exportKindPage && record.Page != nil:
+			if !filter.matchURL(record.Page.URL) {
+				continue
+			}
+			err = importPage(ctx, tx, record.Page, dryRun, &res)
+			if err == nil && res.Changes[len(res.Changes)-1].Action != ImportUnchanged {
+				touchedURLs[record.Page.URL] = struct{}{}
+			}
+		case record.Kind == exportKindPageData && record.PageData != nil:
+			if !filter.matchURL(record.PageData.DataID) || !filter.matchLocale(record.PageData.LocaleCode) {
+				continue
+			}
+			err = pm.importPageData(ctx, tx, record.PageData, dryRun, &res)
+			if err == nil && res.Changes[len(res.Changes)-1].Action != ImportUnchanged {
+				touchedURLs[record.PageData.DataID] = struct{}{}
+			}
+		default:
+			err = fmt.Errorf("unrecognized record kind %q", record.Kind)
+		}
+		if err != nil {
+			return res, erro.Wrap(fmt.Errorf("record %d: %w", line, err))
+		}
+	}
+	if dryRun {
+		return res, nil
+	}
+	err = tx.Commit()
+	if err != nil {
+		return res, erro.Wrap(err)
+	}
+	pm.audit(ctx, AuditContentImport, filter.URLPrefix, map[string]interface{}{
+		"locales":   filter.LocaleCodes,
+		"inserted":  res.Inserted,
+		"updated":   res.Updated,
+		"unchanged": res.Unchanged,
+	})
+	err = pm.loadLocales(ctx)
+	if err != nil {
+		return res, erro.Wrap(err)
+	}
+	urls := make([]string, 0, len(touchedURLs))
+	for url := range touchedURLs {
+		urls = append(urls, url)
+	}
+	err = pm.indexPages(ctx, urls...)
+	if err != nil {
+		return res, erro.Wrap(err)
+	}
+	return res, nil
+}
+
+func importLocale(ctx context.Context, tx *sql.Tx, l *exportLocale, dryRun bool, res *ImportResult) error {
+	var exists bool
+	var description string
+	var fallbacks []byte
+	LOCALES := tables.NEW_LOCALES(ctx, "")
+	_, err := sq.FetchContext(ctx, tx, sq.SQLite.
+		From(LOCALES).
+		Where(LOCALES.LOCALE_CODE.EqString(l.LocaleCode)),
+		func(row *sq.Row) error {
+			description = row.String(LOCALES.DESCRIPTION)
+			fallbacks = row.Bytes(LOCALES.FALLBACKS)
+			return row.Accumulate(func() error {
+				exists = true
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var b []byte
+	if len(l.Fallbacks) > 0 {
+		b, err = json.Marshal(l.Fallbacks)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	action := ImportInsert
+	if exists {
+		action = ImportUpdate
+		if description == l.Description && string(fallbacks) == string(b) {
+			action = ImportUnchanged
+		}
+	}
+	res.add(exportKindLocale, l.LocaleCode, action)
+	if dryRun || action == ImportUnchanged {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+		InsertInto(LOCALES).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(LOCALES.LOCALE_CODE, l.LocaleCode)
+			col.SetString(LOCALES.DESCRIPTION, l.Description)
+			if len(b) > 0 {
+				col.Set(LOCALES.FALLBACKS, string(b))
+			} else {
+				col.Set(LOCALES.FALLBACKS, nil)
+			}
+			return nil
+		}).
+		OnConflict(LOCALES.LOCALE_CODE).
+		DoUpdateSet(sq.SetExcluded(LOCALES.DESCRIPTION), sq.SetExcluded(LOCALES.FALLBACKS)),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func importPage(ctx context.Context, tx *sql.Tx, p *exportPage, dryRun bool, res *ImportResult) error {
+	var existing *exportPage
+	PAGES := tables.NEW_PAGES(ctx, "")
+	_, err := sq.FetchContext(ctx, tx, sq.SQLite.
+		From(PAGES).
+		Where(PAGES.URL.EqString(p.URL)),
+		func(row *sq.Row) error {
+			page := &exportPage{
+				URL:         row.String(PAGES.URL),
+				Disabled:    nullBoolPtr(row.NullBool(PAGES.DISABLED)),
+				RedirectURL: nullStringPtr(row.NullString(PAGES.REDIRECT_URL)),
+				Plugin:      nullStringPtr(row.NullString(PAGES.PLUGIN)),
+				HandlerName: nullStringPtr(row.NullString(PAGES.HANDLER_NAME)),
+				HandlerURL:  nullStringPtr(row.NullString(PAGES.HANDLER_URL)),
+				Content:     nullStringPtr(row.NullString(PAGES.CONTENT)),
+				ThemePath:   nullStringPtr(row.NullString(PAGES.THEME_PATH)),
+				Template:    nullStringPtr(row.NullString(PAGES.TEMPLATE)),
+			}
+			return row.Accumulate(func() error {
+				existing = page
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	action := ImportInsert
+	if existing != nil {
+		action = ImportUpdate
+		if samePage(*existing, *p) {
+			action = ImportUnchanged
+		}
+	}
+	res.add(exportKindPage, p.URL, action)
+	if dryRun || action == ImportUnchanged {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+		InsertInto(PAGES).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(PAGES.URL, p.URL)
+			col.Set(PAGES.DISABLED, p.Disabled)
+			col.Set(PAGES.REDIRECT_URL, p.RedirectURL)
+			col.Set(PAGES.PLUGIN, p.Plugin)
+			col.Set(PAGES.HANDLER_NAME, p.HandlerName)
+			col.Set(PAGES.HANDLER_URL, p.HandlerURL)
+			col.Set(PAGES.CONTENT, p.Content)
+			col.Set(PAGES.THEME_PATH, p.ThemePath)
+			col.Set(PAGES.TEMPLATE, p.Template)
+			return nil
+		}).
+		OnConflict(PAGES.URL).
+		DoUpdateSet(
+			sq.SetExcluded(PAGES.DISABLED),
+			sq.SetExcluded(PAGES.REDIRECT_URL),
+			sq.SetExcluded(PAGES.PLUGIN),
+			sq.SetExcluded(PAGES.HANDLER_NAME),
+			sq.SetExcluded(PAGES.HANDLER_URL),
+			sq.SetExcluded(PAGES.CONTENT),
+			sq.SetExcluded(PAGES.THEME_PATH),
+			sq.SetExcluded(PAGES.TEMPLATE),
+		),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func (pm *PageManager) importPageData(ctx context.Context, tx *sql.Tx, pd *exportPageData, dryRun bool, res *ImportResult) error {
+	// pm_pagedata has no unique constraint to upsert against, so the natural
+	// key (LOCALE_CODE, DATA_ID, KEY, ARRAY_INDEX) is matched by hand
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "")
+	predicates := []sq.Predicate{
+		PAGEDATA.LOCALE_CODE.EqString(pd.LocaleCode),
+		PAGEDATA.DATA_ID.EqString(pd.DataID),
+		PAGEDATA.KEY.EqString(pd.Key),
+	}
+	key := pd.LocaleCode + ":" + pd.DataID + ":" + pd.Key
+	if pd.ArrayIndex != nil {
+		predicates = append(predicates, PAGEDATA.ARRAY_INDEX.EqInt64(*pd.ArrayIndex))
+		key += fmt.Sprintf("[%d]", *pd.ArrayIndex)
+	} else {
+		predicates = append(predicates, PAGEDATA.ARRAY_INDEX.IsNull())
+	}
+	var value sql.NullString
+	rowCount, err := sq.FetchContext(ctx, tx, sq.SQLite.
+		From(PAGEDATA).
+		Where(predicates...).
+		Limit(1),
+		func(row *sq.Row) error {
+			row.ScanInto(&value, PAGEDATA.VALUE)
+			return nil
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	sensitive, err := pm.sensitiveKeys(ctx, tx, pd.DataID)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	// exports made before sensitive values were decrypted on export carry
+	// the stored ciphertext, which is imported as is
+	seal := (pd.Sensitive || sensitive[pd.Key]) && pd.Value != "" && !strings.HasPrefix(pd.Value, sensitivePrefix)
+	// the row's existence decides between insert and update, its value may
+	// be NULL
+	action := ImportInsert
+	if rowCount > 0 {
+		action = ImportUpdate
+		existing := value.String
+		if seal && value.Valid {
+			existing, err = pm.openPageValue(existing)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		if value.Valid && existing == pd.Value {
+			action = ImportUnchanged
+		}
+	}
+	res.add(exportKindPageData, key, action)
+	if dryRun || action == ImportUnchanged {
+		return nil
+	}
+	storedValue := pd.Value
+	if seal {
+		storedValue, err = pm.sealPageValue(pd.Value)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	if action == ImportUpdate {
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			Update(PAGEDATA).
+			Setx(func(col *sq.Column) error {
+				col.Set(PAGEDATA.VALUE, storedValue)
+				return nil
+			}).
+			Where(predicates...),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+		InsertInto(PAGEDATA).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(PAGEDATA.LOCALE_CODE, pd.LocaleCode)
+			col.SetString(PAGEDATA.DATA_ID, pd.DataID)
+			col.SetString(PAGEDATA.KEY, pd.Key)
+			col.Set(PAGEDATA.VALUE, storedValue)
+			col.Set(PAGEDATA.ARRAY_INDEX, pd.ArrayIndex)
+			return nil
+		}),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func samePage(a, b exportPage) bool {
+	sameString := func(x, y *string) bool {
+		return (x == nil && y == nil) || (x != nil && y != nil && *x == *y)
+	}
+	sameBool := (a.Disabled == nil && b.Disabled == nil) ||
+		(a.Disabled != nil && b.Disabled != nil && *a.Disabled == *b.Disabled)
+	return a.URL == b.URL &&
+		sameBool &&
+		sameString(a.RedirectURL, b.RedirectURL) &&
+		sameString(a.Plugin, b.Plugin) &&
+		sameString(a.HandlerName, b.HandlerName) &&
+		sameString(a.HandlerURL, b.HandlerURL) &&
+		sameString(a.Content, b.Content) &&
+		sameString(a.ThemePath, b.ThemePath) &&
+		sameString(a.Template, b.Template)
+}
+
+func nullStringPtr(ns sql.NullString) *string {
+	if !ns.Valid {
+		return nil
+	}
+	return &ns.String
+}
+
+func nullBoolPtr(nb sql.NullBool) *bool {
+	if !nb.Valid {
+		return nil
+	}
+	return &nb.Bool
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
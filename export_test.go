@@ -0,0 +1,90 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_ExportSensitive(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	pm.themes[""]["t"] = theme{themeTemplates: map[string]themeTemplate{
+		"tpl": {Schema: map[string]DataField{"notes": {Type: "string", Sensitive: true}}},
+	}}
+	_, err := pm.dataDB.Exec("INSERT INTO pm_pages (url, theme_path, template) VALUES ('/a', 't', 'tpl')")
+	is.NoErr(err)
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		return pm.savePageDataKey(ctx, tx, "", "/a", "notes", json.RawMessage(`"secret notes"`), true)
+	})
+	is.NoErr(err)
+	storedValue := func() string {
+		var value string
+		PAGEDATA := tables.NEW_PAGEDATA(ctx, "")
+		_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+			From(PAGEDATA).
+			Where(PAGEDATA.DATA_ID.EqString("/a"), PAGEDATA.KEY.EqString("notes")),
+			func(row *sq.Row) error {
+				value = string(row.Bytes(PAGEDATA.VALUE))
+				return nil
+			},
+		)
+		is.NoErr(err)
+		return value
+	}
+	is.True(strings.HasPrefix(storedValue(), sensitivePrefix))
+
+	// exports carry the plaintext, marked sensitive
+	buf := &bytes.Buffer{}
+	is.NoErr(pm.Export(ctx, buf, ContentFilter{}))
+	export := buf.String()
+	is.True(strings.Contains(export, `"value":"secret notes","sensitive":true`))
+	is.True(!strings.Contains(export, sensitivePrefix))
+
+	// imports seal it again
+	_, err = pm.dataDB.Exec("DELETE FROM pm_pagedata")
+	is.NoErr(err)
+	res, err := pm.Import(ctx, strings.NewReader(export), ContentFilter{}, false)
+	is.NoErr(err)
+	is.Equal(1, res.Inserted)
+	value := storedValue()
+	is.True(strings.HasPrefix(value, sensitivePrefix))
+	value, err = pm.openPageValue(value)
+	is.NoErr(err)
+	is.Equal("secret notes", value)
+	res, err = pm.Import(ctx, strings.NewReader(export), ContentFilter{}, false)
+	is.NoErr(err)
+	is.Equal(0, res.Inserted+res.Updated)
+}
+
+func Test_importPageDataNullValue(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	// databases from before VALUE was NOT NULL can hold NULL values
+	_, err := pm.dataDB.Exec("DROP TABLE pm_pagedata")
+	is.NoErr(err)
+	_, err = pm.dataDB.Exec("CREATE TABLE pm_pagedata (locale_code TEXT NOT NULL, data_id TEXT NOT NULL, key TEXT NOT NULL, value JSON, array_index INTEGER)")
+	is.NoErr(err)
+	_, err = pm.dataDB.Exec("INSERT INTO pm_pagedata (locale_code, data_id, key, value) VALUES ('', '/a', 'title', NULL)")
+	is.NoErr(err)
+	export := `{"kind":"header","version":1}` + "\n" +
+		`{"kind":"pagedata","pagedata":{"locale_code":"","data_id":"/a","key":"title","value":"Hello"}}` + "\n"
+	res, err := pm.Import(ctx, strings.NewReader(export), ContentFilter{}, false)
+	is.NoErr(err)
+	is.Equal(1, res.Updated)
+	var count int
+	is.NoErr(pm.dataDB.QueryRow("SELECT COUNT(*) FROM pm_pagedata WHERE data_id = '/a' AND value = 'Hello'").Scan(&count))
+	is.Equal(1, count)
+	is.NoErr(pm.dataDB.QueryRow("SELECT COUNT(*) FROM pm_pagedata").Scan(&count))
+	is.Equal(1, count)
+}
@@ -7,6 +7,7 @@ import (
 	"html/template"
 	"io"
 	"io/fs"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -25,13 +26,42 @@ func (pm *PageManager) PageManager(next http.Handler) http.Handler {
 	mux := http.NewServeMux()
 	mux.Handle("/", next)
 	mux.HandleFunc("/pm-superadmin", pm.superadminLogin)
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/pm-superadmin/password", pm.superadminPassword)
+	mux.HandleFunc("/pm-login", pm.userLogin)
+	mux.HandleFunc("/pm-signup", pm.userSignup)
+	mux.HandleFunc("/pm-forgot-password", pm.forgotPassword)
+	mux.HandleFunc("/pm-reset-password", pm.resetPassword)
+	mux.HandleFunc("/pm-logout", pm.logout)
+	mux.HandleFunc("/pm-sessions", pm.sessionsPage)
+	mux.HandleFunc("/pm-2fa", pm.twoFactorLogin)
+	mux.HandleFunc("/pm-2fa/setup", pm.twoFactorSetup)
+	mux.HandleFunc("/pm-2fa/disable", pm.twoFactorDisable)
+	mux.HandleFunc("/pm-2fa/reset", pm.twoFactorReset)
+	mux.HandleFunc("/pm-save", pm.savePageData)
+	mux.HandleFunc("/pm-blocks", pm.blocksIndex)
+	mux.HandleFunc("/pm-blocks/edit", pm.blocksEdit)
+	mux.HandleFunc("/pm-blocks/delete", pm.blocksDelete)
+	mux.HandleFunc("/pm-api-tokens", pm.apiTokensPage)
+	mux.HandleFunc("/pm-audit", pm.auditLogPage)
+	mux.HandleFunc("/pm-keys", pm.keysPage)
+	mux.HandleFunc("/pm-unlock", pm.unlockPage)
+	return pm.ResolveTenant(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/pm-themes/") ||
 			strings.HasPrefix(r.URL.Path, "/pm-images/") ||
 			strings.HasPrefix(r.URL.Path, "/pm-plugins/pagemanager/") {
 			pm.serveFile(w, r, r.URL.Path)
 			return
 		}
+		r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, clientIP(r)))
+		if strings.HasPrefix(r.URL.Path, "/pm-api/") {
+			pm.serveAPI(w, r)
+			return
+		}
+		r, err := pm.withUser(w, r)
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
 		route, err := pm.getRoute(r.Context(), r.URL.Path)
 		if err != nil {
 			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
@@ -61,7 +91,7 @@ func (pm *PageManager) PageManager(next http.Handler) http.Handler {
 			return
 		}
 		mux.ServeHTTP(w, r2)
-	})
+	}))
 }
 
 const (
@@ -79,7 +109,7 @@ func (pm *PageManager) getRoute(ctx context.Context, path string) (Route, error)
 	if len(elems) >= 2 {
 		head := elems[1]
 		pm.localesMutex.RLock()
-		_, ok := pm.locales[head]
+		_, ok := pm.locales[tenantID(ctx)][head]
 		pm.localesMutex.RUnlock()
 		if ok {
 			route.LocaleCode = head
@@ -125,7 +155,7 @@ func (pm *PageManager) getRoute(ctx context.Context, path string) (Route, error)
 
 func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, route Route) {
 	pm.themesMutex.RLock()
-	theme, ok := pm.themes[route.ThemePath.String]
+	theme, ok := pm.themes[tenantID(r.Context())][route.ThemePath.String]
 	pm.themesMutex.RUnlock()
 	if !ok {
 		http.Error(w, erro.Sdump(fmt.Errorf("No such theme called %s", route.ThemePath.String)), http.StatusInternalServerError)
@@ -149,10 +179,10 @@ func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, rou
 		TemplateVariables map[string]interface{}
 	}
 	t := template.New("").Funcs(pm.funcmap())
-	datafolderFS := os.DirFS(pm.datafolder)
+	themeFS := os.DirFS(theme.folder)
 	for _, filename := range themeTemplate.HTML {
 		filename = strings.TrimPrefix(filename, "/")
-		b, err := fs.ReadFile(datafolderFS, filename)
+		b, err := fs.ReadFile(themeFS, filename)
 		if err != nil {
 			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
 			return
@@ -164,15 +194,19 @@ func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, rou
 		}
 	}
 	t = t.Lookup(strings.TrimPrefix(themeTemplate.HTML[0], "/"))
+	ctx, blockUsages := withBlockUsageCollector(r.Context())
 	data := Data{
 		Page: PageData{
-			Ctx:        r.Context(),
+			Ctx:        ctx,
 			URL:        route.URL.String,
 			DataID:     route.URL.String,
 			LocaleCode: route.LocaleCode,
 			CSSAssets:  themeTemplate.CSS,
 			JSAssets:   themeTemplate.JS,
 			CSP:        themeTemplate.ContentSecurityPolicy,
+			JSON:       make(map[string]interface{}),
+			Schema:     themeTemplate.Schema,
+			Query:      r.URL.Query(),
 		},
 		TemplateVariables: themeTemplate.TemplateVariables,
 	}
@@ -182,16 +216,30 @@ func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, rou
 	case "advanced":
 		data.Page.EditMode = EditModeAdvanced
 	}
+	if data.Page.EditMode != EditModeOff && !pm.checkPerm(w, r, data.Page.DataID, PageUpdate) {
+		return
+	}
 	if data.Page.EditMode == EditModeBasic {
 		data.Page.CSSAssets = append(data.Page.CSSAssets, Asset{Path: "/pm-plugins/pagemanager/editmode.css"})
 		data.Page.JSAssets = append(data.Page.JSAssets, Asset{Path: "/pm-plugins/pagemanager/editmode.js"})
+		data.Page.JSON["pm-schema"] = data.Page.Schema // lets editmode.js pick the right widget for each key
+		csrfToken, err := hyforms.CSRFToken(w, r)
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Page.JSON["pm-page"] = map[string]string{"dataID": data.Page.DataID, "locale": data.Page.LocaleCode, "csrfToken": csrfToken}
 	}
 	err := t.Execute(w, data)
 	if err != nil {
 		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
 		return
 	}
-	return
+	// best effort: failing to record block usages must not break the page
+	err = pm.recordBlockUsages(ctx, data.Page.URL, blockUsages.list())
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 func (pm *PageManager) serveFile(w http.ResponseWriter, r *http.Request, name string) {
@@ -207,18 +255,20 @@ func (pm *PageManager) serveFile(w http.ResponseWriter, r *http.Request, name st
 			http.NotFound(w, r)
 			return
 		}
-		datafolderFS := os.DirFS(pm.datafolder)
-		f, err = datafolderFS.Open(path)
+		// each tenant has its own pm-themes and pm-images folders, except
+		// for the shared themes it uses
+		id := tenantID(r.Context())
+		f, err = os.DirFS(pm.assetFolder(r.Context(), path)).Open(path)
 		if errors.Is(err, os.ErrNotExist) {
 			func() {
 				missingFile := "/" + path
 				pm.themesMutex.RLock()
 				defer pm.themesMutex.RUnlock()
-				themeName, ok := pm.fallbackAssetsIndex[missingFile]
+				themeName, ok := pm.fallbackAssetsIndex[id][missingFile]
 				if !ok {
 					return
 				}
-				theme, ok := pm.themes[themeName]
+				theme, ok := pm.themes[id][themeName]
 				if !ok {
 					return
 				}
@@ -226,7 +276,7 @@ func (pm *PageManager) serveFile(w http.ResponseWriter, r *http.Request, name st
 				if !ok {
 					return
 				}
-				f, err = datafolderFS.Open(strings.TrimPrefix(fallbackFile, "/"))
+				f, err = os.DirFS(theme.folder).Open(strings.TrimPrefix(fallbackFile, "/"))
 			}()
 		}
 	}
@@ -265,10 +315,13 @@ func (pm *PageManager) serveFile(w http.ResponseWriter, r *http.Request, name st
 type superadminLoginData struct {
 	Password   string
 	RememberMe bool
+	ip         string
+	pm         *PageManager
+	ctx        context.Context
 }
 
 func (d *superadminLoginData) Form(form *hyforms.Form) {
-	const acceptTOSMsg = "need to accept our TOS"
+	const incorrectPasswordMsg = "incorrect password"
 	// inputs
 	password := form.
 		Input("password", "pm-superadmin-password", "").
@@ -281,26 +334,35 @@ func (d *superadminLoginData) Form(form *hyforms.Form) {
 	form.Set("#loginform.bg-white", hy.Attr{"name": "loginform", "method": "POST", "action": ""})
 	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("Password:")))
 	form.Append("div", nil, password)
-	if hyforms.ErrMsgsMatch(password.ErrMsgs(), hyforms.NoneOfErrMsg) {
-		form.Append("div.f7.red", nil, hy.Txt("your password is one of the blacklisted passwords, please try another one"))
+	if hyforms.ErrMsgsMatch(password.ErrMsgs(), incorrectPasswordMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("Incorrect password"))
 	}
-	form.Append("div.mv2.pt2", nil, rememberme, hy.H("label.ml1.pointer", hy.Attr{"for": rememberme.ID()}, hy.Txt("Remember Me")))
-	if hyforms.ErrMsgsMatch(rememberme.ErrMsgs(), acceptTOSMsg) {
-		form.Append("div.f7.red", nil, hy.Txt("You need to accept our terms and conditions"))
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
 	}
+	form.Append("div.mv2.pt2", nil, rememberme, hy.H("label.ml1.pointer", hy.Attr{"for": rememberme.ID()}, hy.Txt("Remember Me")))
 	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Log in")))
 
 	// unmarshal
 	form.Unmarshal(func() {
-		d.Password = password.Validate(hyforms.Required, hyforms.NoneOf("1234")).Value()
+		d.Password = password.Validate(hyforms.Required).Value()
 		d.RememberMe = rememberme.Checked()
-		if !d.RememberMe {
-			form.AddInputErrMsgs(rememberme.Name(), acceptTOSMsg)
+		if d.Password == "" {
+			return
+		}
+		err := d.pm.throttleLogin(d.ctx, d.ip, "superadmin", func() error {
+			return d.pm.unlockSuperadmin(d.ctx, d.Password)
+		})
+		if errors.Is(err, errIncorrectPassword) {
+			form.AddInputErrMsgs(password.Name(), incorrectPasswordMsg)
+		} else if err != nil {
+			form.AddErrMsgs(err.Error())
 		}
 	})
 }
 
 func (pm *PageManager) superadminLogin(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-superadmin-login"
 	type Data struct {
 		CSS       template.HTML
 		JS        template.HTML
@@ -311,7 +373,7 @@ func (pm *PageManager) superadminLogin(w http.ResponseWriter, r *http.Request) {
 		data := Data{}
 		var err error
 		d := &superadminLoginData{}
-		_ = hyforms.CookiePop(w, r, "yeetus", d)
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
 		data.LoginForm, err = hyforms.MarshalForm(nil, w, r, d.Form)
 		if err != nil {
 			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
@@ -322,10 +384,6 @@ func (pm *PageManager) superadminLogin(w http.ResponseWriter, r *http.Request) {
 				hy.H("link[rel=stylesheet][type=text/css]", hy.Attr{"href": "/pm-plugins/pagemanager/tachyons.css"}),
 				hy.H("link[rel=stylesheet][type=text/css]", hy.Attr{"href": "/pm-plugins/pagemanager/style.css"}),
 			},
-			&data.JS: hy.Elements{
-				hy.JSON("[data-pm-json]", nil, map[string]interface{}{"yeet": 42069}),
-				hy.H("script", hy.Attr{"src": "/pm-plugins/pagemanager/pmJSON.js"}),
-			},
 		})
 		if err != nil {
 			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
@@ -342,14 +400,17 @@ func (pm *PageManager) superadminLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "POST":
-		var d superadminLoginData
+		d := superadminLoginData{ip: clientIP(r), pm: pm, ctx: r.Context()}
 		err := hyforms.UnmarshalForm(w, r, d.Form)
 		if err != nil {
-			_ = hyforms.CookieSet(w, "yeetus", d, nil)
-			http.Redirect(w, r, LocaleURL(r), http.StatusMovedPermanently)
+			d.Password = "" // never round-trip the password through a cookie
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
 			return
 		}
-		http.Redirect(w, r, LocaleURL(r), http.StatusMovedPermanently)
+		pm.startSession(w, r, 0, true, d.RememberMe)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
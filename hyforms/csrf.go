@@ -0,0 +1,98 @@
+package hyforms
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// CSRF protection uses signed double-submit tokens: a random nonce lives in
+// the csrfCookieName cookie, and every form carries a Blackbox hash of that
+// nonce with the current session ID as associated data. An attacker can neither read the cookie
+// nor forge the hash, and a token minted for one session is useless in
+// another.
+const (
+	// CSRFFieldName is the name of the hidden input holding the CSRF token.
+	CSRFFieldName = "hyforms.csrf"
+	// CSRFHeaderName is the header that scripts send the CSRF token in.
+	CSRFHeaderName = "X-CSRF-Token"
+	csrfCookieName = "hyforms.csrf"
+	csrfPurpose    = "hyforms.csrf"
+)
+
+// ErrInvalidCSRFToken is returned by UnmarshalForm and VerifyCSRF when the
+// request's CSRF token is missing or does not match.
+var ErrInvalidCSRFToken = errors.New("hyforms: missing or invalid CSRF token")
+
+// CSRFSessionKey is the request context key under which the application
+// stores the current session ID (a string). CSRF tokens are bound to it, so
+// they stop working once the session changes.
+type CSRFSessionKey struct{}
+
+func csrfSessionID(r *http.Request) []byte {
+	sessionID, _ := r.Context().Value(CSRFSessionKey{}).(string)
+	return []byte(sessionID)
+}
+
+// CSRFToken returns the CSRF token for r, setting the nonce cookie if the
+// client does not have one yet. Forms made by MarshalForm already include
+// it; use CSRFToken for hand-written forms and scripts.
+func (hyf *Hyforms) CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	var nonce string
+	if c, _ := r.Cookie(csrfCookieName); c != nil && c.Value != "" {
+		nonce = c.Value
+	} else {
+		b := make([]byte, 24)
+		_, err := rand.Read(b)
+		if err != nil {
+			return "", err
+		}
+		nonce = base64.RawURLEncoding.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    nonce,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   hyf.isSecureRequest(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		// so that further forms in the same response use the same nonce
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: nonce})
+	}
+	hash, err := hyf.box.WithPurpose(csrfPurpose).HashAD([]byte(nonce), csrfSessionID(r))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(hash), nil
+}
+
+// VerifyCSRF checks the CSRF token in r's CSRFFieldName form value or
+// CSRFHeaderName header. It returns ErrInvalidCSRFToken if the token is
+// missing or invalid.
+func (hyf *Hyforms) VerifyCSRF(r *http.Request) error {
+	token := r.Header.Get(CSRFHeaderName)
+	if token == "" {
+		token = r.FormValue(CSRFFieldName)
+	}
+	c, _ := r.Cookie(csrfCookieName)
+	if token == "" || c == nil || c.Value == "" {
+		return ErrInvalidCSRFToken
+	}
+	hash, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ErrInvalidCSRFToken
+	}
+	if hyf.box.WithPurpose(csrfPurpose).VerifyHashAD([]byte(c.Value), csrfSessionID(r), hash) != nil {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+func CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	return defaultHyforms.CSRFToken(w, r)
+}
+
+func VerifyCSRF(r *http.Request) error {
+	return defaultHyforms.VerifyCSRF(r)
+}
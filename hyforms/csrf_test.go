@@ -0,0 +1,135 @@
+package hyforms
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/encrypthash"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_CSRF(t *testing.T) {
+	var called bool
+	fn := func(form *Form) {
+		name := form.Text("name", "").Set("#name", nil)
+		form.Set("#form", nil)
+		form.AppendElements(name)
+		form.Unmarshal(func() {
+			called = true
+		})
+	}
+	// marshal returns the CSRF token embedded in the form and the nonce cookie
+	marshal := func(is testutil.I, sessionID string) (token string, cookie *http.Cookie) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), CSRFSessionKey{}, sessionID))
+		w := httptest.NewRecorder()
+		output, err := MarshalForm(nil, w, r, fn)
+		is.NoErr(err)
+		input := regexp.MustCompile(`<input[^>]*name="` + regexp.QuoteMeta(CSRFFieldName) + `"[^>]*>`).FindString(string(output))
+		match := regexp.MustCompile(`value="([^"]+)"`).FindStringSubmatch(input)
+		if match == nil {
+			t.Fatalf("no CSRF token in %s", output)
+		}
+		token = match[1]
+		for _, c := range w.Result().Cookies() {
+			if c.Name == csrfCookieName {
+				cookie = c
+			}
+		}
+		is.True(cookie != nil)
+		return token, cookie
+	}
+	unmarshal := func(sessionID string, form url.Values, header string, cookie *http.Cookie) error {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			r.Header.Set(CSRFHeaderName, header)
+		}
+		if cookie != nil {
+			r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		r = r.WithContext(context.WithValue(r.Context(), CSRFSessionKey{}, sessionID))
+		called = false
+		return UnmarshalForm(httptest.NewRecorder(), r, fn)
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		is := testutil.New(t)
+		token, cookie := marshal(is, "session1")
+		err := unmarshal("session1", url.Values{"name": {"bob"}, CSRFFieldName: {token}}, "", cookie)
+		is.NoErr(err)
+		is.True(called)
+	})
+
+	t.Run("valid header", func(t *testing.T) {
+		is := testutil.New(t)
+		token, cookie := marshal(is, "session1")
+		err := unmarshal("session1", url.Values{"name": {"bob"}}, token, cookie)
+		is.NoErr(err)
+		is.True(called)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		token, cookie := marshal(testutil.New(t), "session1")
+		otherToken, otherCookie := marshal(testutil.New(t), "session1")
+		tests := []struct {
+			description string
+			sessionID   string
+			form        url.Values
+			cookie      *http.Cookie
+		}{
+			{"missing token", "session1", url.Values{}, cookie},
+			{"missing cookie", "session1", url.Values{CSRFFieldName: {token}}, nil},
+			{"tampered token", "session1", url.Values{CSRFFieldName: {token + "A"}}, cookie},
+			{"other session", "session2", url.Values{CSRFFieldName: {token}}, cookie},
+			{"other cookie", "session1", url.Values{CSRFFieldName: {token}}, otherCookie},
+			{"other token", "session1", url.Values{CSRFFieldName: {otherToken}}, cookie},
+		}
+		for _, tt := range tests {
+			tt := tt
+			t.Run(tt.description, func(t *testing.T) {
+				is := testutil.New(t)
+				err := unmarshal(tt.sessionID, tt.form, "", tt.cookie)
+				is.True(errors.Is(err, ErrInvalidCSRFToken))
+				is.True(!called)
+			})
+		}
+	})
+
+	t.Run("one nonce per response", func(t *testing.T) {
+		is := testutil.New(t)
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		token1, err := CSRFToken(w, r)
+		is.NoErr(err)
+		token2, err := CSRFToken(w, r)
+		is.NoErr(err)
+		is.Equal(token1, token2)
+		is.Equal(1, len(w.Result().Cookies()))
+	})
+
+	t.Run("secure cookie", func(t *testing.T) {
+		is := testutil.New(t)
+		hyf, err := New(encrypthash.StaticKey([]byte("0123456789abcdef01234567")))
+		is.NoErr(err)
+		secure := func() bool {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-Forwarded-Proto", "https")
+			w := httptest.NewRecorder()
+			_, err := hyf.CSRFToken(w, r)
+			is.NoErr(err)
+			return w.Result().Cookies()[0].Secure
+		}
+		is.True(!secure())
+		hyf.IsSecureRequest = func(r *http.Request) bool {
+			return r.Header.Get("X-Forwarded-Proto") == "https"
+		}
+		is.True(secure())
+	})
+}
@@ -25,16 +25,20 @@ type Form struct {
 	inputErrMsgs   map[string][]string
 	formErrMsgs    []string
 	marshalErrMsgs []string
+	csrfToken      string
 }
 
 func (f *Form) AppendHTML(buf *strings.Builder) error {
 	if f.mode == FormModeUnmarshal {
 		return nil
 	}
-	// check f.request.Context() for any CSRF token and prepend it into the form as necessary
-	// or should this be done in a hook?
 	f.attrs.Tag = "form"
-	err := hy.AppendHTML(buf, f.attrs, f.children)
+	children := f.children
+	if f.csrfToken != "" {
+		csrfInput := hy.H("input", hy.Attr{"type": "hidden", "name": CSRFFieldName, "value": f.csrfToken})
+		children = append([]hy.Element{csrfInput}, children...)
+	}
+	err := hy.AppendHTML(buf, f.attrs, children)
 	if err != nil {
 		return erro.Wrap(err)
 	}
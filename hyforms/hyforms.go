@@ -29,21 +29,59 @@ func (e *ValidationError) Error() string {
 
 type Hyforms struct {
 	box *encrypthash.Blackbox
+	// IsSecureRequest reports whether r came in over HTTPS, in which case the
+	// CSRF nonce cookie is marked Secure. If nil, only requests with r.TLS set
+	// count, which misses HTTPS terminated by a reverse proxy.
+	IsSecureRequest func(r *http.Request) bool
 }
 
+// Every signed value is hashed with its own purpose, so that e.g. a
+// ValidationError cookie cannot be passed off as some other cookie.
+const validationErrorPurpose = "hyforms.ValidationError"
+
+func (hyf *Hyforms) isSecureRequest(r *http.Request) bool {
+	if hyf.IsSecureRequest != nil {
+		return hyf.IsSecureRequest(r)
+	}
+	return r.TLS != nil
+}
+
+func (hyf *Hyforms) cookieBox(cookieName string) *encrypthash.Blackbox {
+	return hyf.box.WithPurpose("hyforms.cookie:" + cookieName)
+}
+
+// New returns a Hyforms that signs its cookies and CSRF tokens with the keys
+// of provider.
+func New(provider encrypthash.KeyProvider) (*Hyforms, error) {
+	box, err := encrypthash.NewWithKeyProvider(provider)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return &Hyforms{box: box}, nil
+}
+
+// defaultHyforms is used by the package level functions. Until SetDefault is
+// called it uses a random key, so its cookies and CSRF tokens do not survive
+// a restart.
 var defaultHyforms = func() *Hyforms {
 	key := make([]byte, 24)
 	_, err := rand.Read(key)
 	if err != nil {
 		panic(err)
 	}
-	box, err := encrypthash.New(key, nil)
+	hyf, err := New(encrypthash.StaticKey(key))
 	if err != nil {
 		panic(err)
 	}
-	return &Hyforms{box: box}
+	return hyf
 }()
 
+// SetDefault makes hyf the Hyforms used by the package level functions. It
+// must be called before any of them are.
+func SetDefault(hyf *Hyforms) {
+	defaultHyforms = hyf
+}
+
 func (hyf *Hyforms) MarshalForm(s hy.Sanitizer, w http.ResponseWriter, r *http.Request, fn func(*Form)) (template.HTML, error) {
 	form := &Form{
 		request:      r,
@@ -56,7 +94,7 @@ func (hyf *Hyforms) MarshalForm(s hy.Sanitizer, w http.ResponseWriter, r *http.R
 			return
 		}
 		defer http.SetCookie(w, &http.Cookie{Name: "hyforms.ValidationError", MaxAge: -1})
-		b, err := hyf.box.Base64VerifyHash(c.Value)
+		b, err := hyf.box.WithPurpose(validationErrorPurpose).Base64VerifyHash(c.Value)
 		if err != nil {
 			return
 		}
@@ -71,6 +109,11 @@ func (hyf *Hyforms) MarshalForm(s hy.Sanitizer, w http.ResponseWriter, r *http.R
 		form.formErrMsgs = validationErr.FormErrMsgs
 		form.inputErrMsgs = validationErr.InputErrMsgs
 	}()
+	var err error
+	form.csrfToken, err = hyf.CSRFToken(w, r)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
 	fn(form)
 	if len(form.marshalErrMsgs) > 0 {
 		return "", erro.Wrap(fmt.Errorf("marshal errors %v", form.marshalErrMsgs))
@@ -90,32 +133,45 @@ func (hyf *Hyforms) UnmarshalForm(w http.ResponseWriter, r *http.Request, fn fun
 		inputNames:   make(map[string]struct{}),
 		inputErrMsgs: make(map[string][]string),
 	}
+	// fn is never run for a forged request, so none of its side effects happen
+	if hyf.VerifyCSRF(r) != nil {
+		_ = hyf.setValidationError(w, ValidationError{
+			FormErrMsgs: []string{"This form has expired, please try again"},
+			Expires:     time.Now().Add(5 * time.Second),
+		})
+		return ErrInvalidCSRFToken
+	}
 	fn(form)
 	if len(form.formErrMsgs) > 0 || len(form.inputErrMsgs) > 0 {
-		validationErr := ValidationError{
+		return hyf.setValidationError(w, ValidationError{
 			FormErrMsgs:  form.formErrMsgs,
 			InputErrMsgs: form.inputErrMsgs,
 			Expires:      time.Now().Add(5 * time.Second),
-		}
-		buf := &bytes.Buffer{}
-		err := gob.NewEncoder(buf).Encode(validationErr)
-		if err != nil {
-			return fmt.Errorf("%w: failed gob encoding %s", &validationErr, err.Error())
-		}
-		value, err := hyf.box.Base64Hash(buf.Bytes())
-		if err != nil {
-			return erro.Wrap(err)
-		}
-		http.SetCookie(w, &http.Cookie{
-			Name:   "hyforms.ValidationError",
-			Value:  value,
-			MaxAge: 5,
 		})
-		return &validationErr
 	}
 	return nil
 }
 
+// setValidationError hands validationErr to the next MarshalForm through a
+// short-lived cookie and returns it.
+func (hyf *Hyforms) setValidationError(w http.ResponseWriter, validationErr ValidationError) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(validationErr)
+	if err != nil {
+		return fmt.Errorf("%w: failed gob encoding %s", &validationErr, err.Error())
+	}
+	value, err := hyf.box.WithPurpose(validationErrorPurpose).WithTTL(5 * time.Second).Base64Hash(buf.Bytes())
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   "hyforms.ValidationError",
+		Value:  value,
+		MaxAge: 5,
+	})
+	return &validationErr
+}
+
 func (hyf *Hyforms) CookieSet(w http.ResponseWriter, cookieName string, value interface{}, cookieTemplate *http.Cookie) error {
 	buf := &bytes.Buffer{}
 	switch value := value.(type) {
@@ -129,13 +185,18 @@ func (hyf *Hyforms) CookieSet(w http.ResponseWriter, cookieName string, value in
 			return erro.Wrap(err)
 		}
 	}
-	b64HashedValue, err := hyf.box.Base64Hash(buf.Bytes())
-	if err != nil {
-		return erro.Wrap(err)
-	}
 	if cookieTemplate == nil {
 		cookieTemplate = &http.Cookie{}
 	}
+	box := hyf.cookieBox(cookieName)
+	if cookieTemplate.MaxAge > 0 {
+		// a client that ignores MaxAge still cannot use the cookie later
+		box = box.WithTTL(time.Duration(cookieTemplate.MaxAge) * time.Second)
+	}
+	b64HashedValue, err := box.Base64Hash(buf.Bytes())
+	if err != nil {
+		return erro.Wrap(err)
+	}
 	cookieTemplate.Name = cookieName
 	cookieTemplate.Value = b64HashedValue
 	http.SetCookie(w, cookieTemplate)
@@ -150,7 +211,7 @@ func (hyf *Hyforms) CookieGet(r *http.Request, cookieName string, dest interface
 	if c == nil {
 		return nil
 	}
-	data, err := hyf.box.Base64VerifyHash(c.Value)
+	data, err := hyf.cookieBox(cookieName).Base64VerifyHash(c.Value)
 	if err != nil {
 		return erro.Wrap(err)
 	}
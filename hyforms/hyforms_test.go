@@ -0,0 +1,38 @@
+package hyforms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_Cookies(t *testing.T) {
+	is := testutil.New(t)
+	w := httptest.NewRecorder()
+	is.NoErr(CookieSet(w, "a", "lorem ipsum", nil))
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "a" {
+			cookie = c
+		}
+	}
+	is.True(cookie != nil)
+	get := func(name string) (string, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: name, Value: cookie.Value})
+		var value string
+		err := CookieGet(r, name, &value)
+		return value, err
+	}
+
+	value, err := get("a")
+	is.NoErr(err)
+	is.Equal("lorem ipsum", value)
+	// a value signed for one cookie is not valid as another
+	_, err = get("b")
+	is.True(err != nil)
+	_, err = get("hyforms.ValidationError")
+	is.True(err != nil)
+}
@@ -18,6 +18,9 @@ type Input struct {
 
 func (i *Input) AppendHTML(buf *strings.Builder) error {
 	i.attrs.Tag = "input"
+	if i.attrs.Dict == nil { // Set was never called
+		i.attrs.Dict = make(map[string]string)
+	}
 	i.attrs.Dict["type"] = i.inputType
 	i.attrs.Dict["name"] = i.name
 	i.attrs.Dict["value"] = i.defaultValue
@@ -122,6 +125,9 @@ type ToggledInput struct {
 
 func (i *ToggledInput) AppendHTML(buf *strings.Builder) error {
 	i.attrs.Tag = "input"
+	if i.attrs.Dict == nil { // Set was never called
+		i.attrs.Dict = make(map[string]string)
+	}
 	i.attrs.Dict["type"] = i.inputType
 	i.attrs.Dict["name"] = i.name
 	if i.value != "" {
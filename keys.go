@@ -0,0 +1,977 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Key rotation adds a new encryption key and a new MAC key and makes them the
+// active keys. Existing ciphertexts are then re-encrypted with the new
+// encryption key in the background. Old keys stay around, so everything made
+// with them still decrypts and verifies, until RetireKeys finds that nothing
+// depends on them any more.
+
+// Key is a row of pm_encryption_keys or pm_mac_keys. The key material itself
+// is never exposed.
+type Key struct {
+	Kind      string // "encryption" or "mac"
+	ID        int64
+	CreatedAt sql.NullTime
+	Active    bool
+}
+
+// KeyRotation is the progress of a re-encryption job.
+type KeyRotation struct {
+	KeyID      int64 // the encryption key ciphertexts are re-encrypted with
+	StartedAt  time.Time
+	FinishedAt time.Time // zero while the job is running
+	Total      int       // ciphertexts found when the job started
+	Done       int
+	Failed     int    // ciphertexts that could not be decrypted, they are left as they are
+	Err        string // set if the job stopped early
+}
+
+// Running reports whether the job is still running.
+func (kr KeyRotation) Running() bool {
+	return !kr.StartedAt.IsZero() && kr.FinishedAt.IsZero()
+}
+
+// ciphertextColumn is a column holding ciphertexts made by Encrypt.
+// Re-encryption and key retirement go through every ciphertextColumn, so any
+// new column storing Encrypt's output must be added to ciphertextColumns.
+type ciphertextColumn struct {
+	db     *sql.DB
+	table  sq.TableInfo
+	column sq.StringField
+	// if set, only values starting with prefix are ciphertexts, and the
+	// ciphertext follows the prefix
+	prefix string
+}
+
+func (pm *PageManager) ciphertextColumns(ctx context.Context) []ciphertextColumn {
+	SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
+	columns := []ciphertextColumn{
+		{db: pm.superadminDB, table: SUPERADMIN.TableInfo, column: SUPERADMIN.TOTP_SECRET_CIPHERTEXT},
+	}
+	// the keys are shared, so every tenant's ciphertexts depend on them
+	for _, ctx := range pm.tenantContexts(ctx) {
+		USERS := tables.NEW_USERS(ctx, "")
+		PAGEDATA := tables.NEW_PAGEDATA(ctx, "")
+		columns = append(columns,
+			ciphertextColumn{db: pm.dataDB, table: USERS.TableInfo, column: USERS.TOTP_SECRET_CIPHERTEXT},
+			ciphertextColumn{db: pm.dataDB, table: PAGEDATA.TableInfo, column: sq.NewStringField(PAGEDATA.VALUE.GetName(), PAGEDATA.TableInfo), prefix: sensitivePrefix},
+		)
+	}
+	return columns
+}
+
+// ciphertexts matches the values of c that are ciphertexts.
+func (c ciphertextColumn) ciphertexts() sq.Predicate {
+	if c.prefix == "" {
+		return c.column.IsNotNull()
+	}
+	return c.column.LikeString(c.prefix + "%")
+}
+
+// Keys lists the encryption and MAC keys.
+func (pm *PageManager) Keys(ctx context.Context) ([]Key, error) {
+	var keys []Key
+	ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(withoutTenant(ctx), "")
+	_, err := sq.FetchContext(ctx, pm.superadminDB, sq.SQLite.
+		From(ENCRYPTION_KEYS).
+		OrderBy(ENCRYPTION_KEYS.ID.Desc()),
+		func(row *sq.Row) error {
+			key := Key{
+				Kind:      "encryption",
+				ID:        row.Int64(ENCRYPTION_KEYS.ID),
+				CreatedAt: row.NullTime(ENCRYPTION_KEYS.CREATED_AT),
+			}
+			return row.Accumulate(func() error {
+				key.Active = len(keys) == 0
+				keys = append(keys, key)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	n := len(keys)
+	MAC_KEYS := tables.NEW_MAC_KEYS(withoutTenant(ctx), "")
+	_, err = sq.FetchContext(ctx, pm.superadminDB, sq.SQLite.
+		From(MAC_KEYS).
+		OrderBy(MAC_KEYS.ID.Desc()),
+		func(row *sq.Row) error {
+			key := Key{
+				Kind:      "mac",
+				ID:        row.Int64(MAC_KEYS.ID),
+				CreatedAt: row.NullTime(MAC_KEYS.CREATED_AT),
+			}
+			return row.Accumulate(func() error {
+				key.Active = len(keys) == n
+				keys = append(keys, key)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return keys, nil
+}
+
+// KeyRotationStatus returns the progress of the current or last re-encryption
+// job. The zero KeyRotation means no job has run since startup.
+func (pm *PageManager) KeyRotationStatus() KeyRotation {
+	pm.rotationMutex.Lock()
+	defer pm.rotationMutex.Unlock()
+	return pm.rotation
+}
+
+func (pm *PageManager) updateRotation(fn func(kr *KeyRotation)) {
+	pm.rotationMutex.Lock()
+	defer pm.rotationMutex.Unlock()
+	fn(&pm.rotation)
+}
+
+// RotateKeys generates a new encryption key and a new MAC key, wraps them
+// with the superadmin's inner keys and makes them the active keys. It then
+// starts re-encrypting existing ciphertexts in the background, use
+// KeyRotationStatus to follow along. The keys must be unlocked.
+func (pm *PageManager) RotateKeys(ctx context.Context) error {
+	pm.rotationMutex.Lock()
+	if pm.rotation.Running() {
+		pm.rotationMutex.Unlock()
+		return fmt.Errorf("a key rotation is already running")
+	}
+	// read the inner keys under rotationMutex, so that a superadmin password
+	// change cannot swap them out from under the new keys
+	pm.keysMutex.RLock()
+	innerEncryptionKey, innerMACKey := pm.innerEncryptionKey, pm.innerMACKey
+	pm.keysMutex.RUnlock()
+	if len(innerEncryptionKey) == 0 || len(innerMACKey) == 0 {
+		pm.rotationMutex.Unlock()
+		return erro.Wrap(fmt.Errorf("keys are locked, the superadmin needs to log in"))
+	}
+	// claim the job before letting go of the mutex, so that two rotations
+	// cannot start at once
+	pm.rotation = KeyRotation{StartedAt: time.Now().UTC()}
+	pm.rotationMutex.Unlock()
+	encryptionKeyID, macKeyID, err := pm.addKeys(ctx, innerEncryptionKey, innerMACKey)
+	if err != nil {
+		pm.updateRotation(func(kr *KeyRotation) {
+			kr.FinishedAt = time.Now().UTC()
+			kr.Err = err.Error()
+		})
+		return erro.Wrap(err)
+	}
+	pm.encryptionKeyProvider.invalidate()
+	pm.macKeyProvider.invalidate()
+	pm.audit(ctx, AuditKeyRotate, "keys", map[string]interface{}{
+		"encryption_key_id": encryptionKeyID,
+		"mac_key_id":        macKeyID,
+	})
+	pm.updateRotation(func(kr *KeyRotation) { kr.KeyID = encryptionKeyID })
+	go pm.reencrypt(context.Background(), encryptionKeyID)
+	return nil
+}
+
+// addKeys inserts a new encryption key and a new MAC key in one transaction
+// and returns their IDs.
+func (pm *PageManager) addKeys(ctx context.Context, innerEncryptionKey, innerMACKey []byte) (encryptionKeyID, macKeyID int64, err error) {
+	encryptionKey := make([]byte, 32)
+	_, err = rand.Read(encryptionKey)
+	if err != nil {
+		return 0, 0, erro.Wrap(err)
+	}
+	encryptionKeyCiphertext, err := encrypt(innerEncryptionKey, string(encryptionKey))
+	if err != nil {
+		return 0, 0, erro.Wrap(err)
+	}
+	macKey := make([]byte, 32)
+	_, err = rand.Read(macKey)
+	if err != nil {
+		return 0, 0, erro.Wrap(err)
+	}
+	macKeyCiphertext, err := encrypt(innerMACKey, string(macKey))
+	if err != nil {
+		return 0, 0, erro.Wrap(err)
+	}
+	now := time.Now().UTC()
+	err = sq.WithTxContext(ctx, pm.superadminDB, nil, func(tx *sql.Tx) error {
+		ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(withoutTenant(ctx), "")
+		_, err := sq.FetchContext(ctx, tx, sq.SQLite.From(ENCRYPTION_KEYS), func(row *sq.Row) error {
+			encryptionKeyID = row.Int64(sq.Max(ENCRYPTION_KEYS.ID)) + 1
+			return nil
+		})
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(ENCRYPTION_KEYS).
+			Valuesx(func(col *sq.Column) error {
+				col.SetInt64(ENCRYPTION_KEYS.ID, encryptionKeyID)
+				col.SetString(ENCRYPTION_KEYS.KEY_CIPHERTEXT, encryptionKeyCiphertext)
+				col.SetTime(ENCRYPTION_KEYS.CREATED_AT, now)
+				return nil
+			}),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		MAC_KEYS := tables.NEW_MAC_KEYS(withoutTenant(ctx), "")
+		_, err = sq.FetchContext(ctx, tx, sq.SQLite.From(MAC_KEYS), func(row *sq.Row) error {
+			macKeyID = row.Int64(sq.Max(MAC_KEYS.ID)) + 1
+			return nil
+		})
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(MAC_KEYS).
+			Valuesx(func(col *sq.Column) error {
+				col.SetInt64(MAC_KEYS.ID, macKeyID)
+				col.SetString(MAC_KEYS.KEY_CIPHERTEXT, macKeyCiphertext)
+				col.SetTime(MAC_KEYS.CREATED_AT, now)
+				return nil
+			}),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, erro.Wrap(err)
+	}
+	return encryptionKeyID, macKeyID, nil
+}
+
+// reencrypt re-encrypts every ciphertext not yet encrypted with the key
+// keyID, recording its progress in pm.rotation.
+func (pm *PageManager) reencrypt(ctx context.Context, keyID int64) {
+	columns := pm.ciphertextColumns(ctx)
+	total := 0
+	for _, c := range columns {
+		n, err := countStaleCiphertexts(ctx, c, keyID)
+		if err != nil {
+			pm.finishRotation(err)
+			return
+		}
+		total += n
+	}
+	pm.updateRotation(func(kr *KeyRotation) { kr.Total = total })
+	for _, c := range columns {
+		err := pm.reencryptColumn(ctx, c, keyID)
+		if err != nil {
+			pm.finishRotation(err)
+			return
+		}
+	}
+	pm.finishRotation(nil)
+}
+
+func (pm *PageManager) finishRotation(err error) {
+	if err != nil {
+		log.Printf("key rotation: %s", err)
+	}
+	pm.updateRotation(func(kr *KeyRotation) {
+		kr.FinishedAt = time.Now().UTC()
+		if err != nil {
+			kr.Err = err.Error()
+		}
+	})
+}
+
+// staleCiphertexts matches the ciphertexts of c that were not encrypted with
+// the key keyID.
+func staleCiphertexts(c ciphertextColumn, keyID int64) sq.Predicate {
+	return sq.And(
+		c.ciphertexts(),
+		c.column.NotLikeString(c.prefix+strconv.FormatInt(keyID, 10)+":%"),
+	)
+}
+
+func countStaleCiphertexts(ctx context.Context, c ciphertextColumn, keyID int64) (int, error) {
+	var n int
+	_, err := sq.FetchContext(ctx, c.db, sq.SQLite.
+		From(c.table).
+		Where(staleCiphertexts(c, keyID)),
+		func(row *sq.Row) error {
+			n = int(row.Int64(sq.Count()))
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	return n, nil
+}
+
+func (pm *PageManager) reencryptColumn(ctx context.Context, c ciphertextColumn, keyID int64) error {
+	const batchSize = 100
+	type value struct {
+		rowid      int64
+		ciphertext string
+	}
+	ROWID := sq.NewNumberField("rowid", c.table)
+	var lastRowid int64
+	for {
+		var values []value
+		_, err := sq.FetchContext(ctx, c.db, sq.SQLite.
+			From(c.table).
+			Where(
+				ROWID.GtInt64(lastRowid),
+				staleCiphertexts(c, keyID),
+			).
+			OrderBy(ROWID).
+			Limit(batchSize),
+			func(row *sq.Row) error {
+				v := value{
+					rowid:      row.Int64(ROWID),
+					ciphertext: row.String(c.column),
+				}
+				return row.Accumulate(func() error {
+					values = append(values, v)
+					return nil
+				})
+			},
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		for _, v := range values {
+			lastRowid = v.rowid
+			plaintext, err := pm.Decrypt(strings.TrimPrefix(v.ciphertext, c.prefix))
+			if err != nil {
+				log.Printf("key rotation: %s row %d: %s", c.table.Name, v.rowid, err)
+				pm.updateRotation(func(kr *KeyRotation) { kr.Failed++ })
+				continue
+			}
+			ciphertext, err := pm.Encrypt(plaintext)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			ciphertext = c.prefix + ciphertext
+			// only overwrite the value we decrypted, in case it was changed
+			// in the meantime
+			_, _, err = sq.ExecContext(ctx, c.db, sq.SQLite.
+				Update(c.table).
+				Setx(func(col *sq.Column) error {
+					col.SetString(c.column, ciphertext)
+					return nil
+				}).
+				Where(
+					ROWID.EqInt64(v.rowid),
+					c.column.EqString(v.ciphertext),
+				),
+				0,
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			pm.updateRotation(func(kr *KeyRotation) { kr.Done++ })
+		}
+	}
+}
+
+// RetireKeys deletes the inactive keys that nothing depends on any more and
+// returns them. An encryption key is still needed while any ciphertext was
+// encrypted with it (ciphertexts from before key IDs existed need every key).
+// A MAC key is still needed while a sealed audit log entry was made with it,
+// since the audit log cannot be re-sealed, or while a password reset token
+// made with it may still be used. Keys cannot be retired until every
+// process has had keyCacheLifetime to pick up the active keys, because until
+// then a process that cached the previous key may still be using it.
+func (pm *PageManager) RetireKeys(ctx context.Context) ([]Key, error) {
+	if pm.KeyRotationStatus().Running() {
+		return nil, fmt.Errorf("a key rotation is still running")
+	}
+	keys, err := pm.Keys(ctx)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	for _, key := range keys {
+		if !key.Active || !key.CreatedAt.Valid {
+			continue
+		}
+		if age := time.Since(key.CreatedAt.Time); age < keyCacheLifetime {
+			wait := (keyCacheLifetime - age).Truncate(time.Second) + time.Second
+			return nil, fmt.Errorf("the active %s key is too new, other processes may still be using the previous one; try again in %s", key.Kind, wait)
+		}
+	}
+	neededEncryptionKeys, err := pm.neededEncryptionKeys(ctx)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	neededMACKeys, err := pm.neededMACKeys(ctx, keys)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	var retired []Key
+	ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(withoutTenant(ctx), "")
+	MAC_KEYS := tables.NEW_MAC_KEYS(withoutTenant(ctx), "")
+	err = sq.WithTxContext(ctx, pm.superadminDB, nil, func(tx *sql.Tx) error {
+		for _, key := range keys {
+			if key.Active {
+				continue
+			}
+			var q sq.Query
+			switch key.Kind {
+			case "encryption":
+				if neededEncryptionKeys == nil || neededEncryptionKeys[key.ID] {
+					continue
+				}
+				q = sq.SQLite.DeleteFrom(ENCRYPTION_KEYS).Where(ENCRYPTION_KEYS.ID.EqInt64(key.ID))
+			case "mac":
+				if neededMACKeys == nil || neededMACKeys[key.ID] {
+					continue
+				}
+				q = sq.SQLite.DeleteFrom(MAC_KEYS).Where(MAC_KEYS.ID.EqInt64(key.ID))
+			}
+			_, _, err := sq.ExecContext(ctx, tx, q, 0)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			retired = append(retired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	pm.encryptionKeyProvider.invalidate()
+	pm.macKeyProvider.invalidate()
+	for _, key := range retired {
+		pm.audit(ctx, AuditKeyRetire, key.Kind+"-key:"+strconv.FormatInt(key.ID, 10), nil)
+	}
+	return retired, nil
+}
+
+// neededEncryptionKeys returns the IDs of the encryption keys that
+// ciphertexts were encrypted with. It returns nil if some ciphertext has no
+// key ID, in which case every key is needed.
+func (pm *PageManager) neededEncryptionKeys(ctx context.Context) (map[int64]bool, error) {
+	needed := make(map[int64]bool)
+	legacy := false
+	for _, c := range pm.ciphertextColumns(ctx) {
+		_, err := sq.FetchContext(ctx, c.db, sq.SQLite.
+			SelectDistinct(c.column).
+			From(c.table).
+			Where(c.ciphertexts()),
+			func(row *sq.Row) error {
+				ciphertext := row.String(c.column)
+				return row.Accumulate(func() error {
+					keyID, _, ok := ciphertextKeyID(strings.TrimPrefix(ciphertext, c.prefix))
+					if !ok {
+						legacy = true
+					}
+					needed[keyID] = true
+					return nil
+				})
+			},
+		)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+	}
+	if legacy {
+		return nil, nil
+	}
+	return needed, nil
+}
+
+// neededMACKeys returns the IDs of the MAC keys that sealed audit log entries
+// or outstanding password reset tokens may have been made with. It returns
+// nil if every key is needed.
+func (pm *PageManager) neededMACKeys(ctx context.Context, keys []Key) (map[int64]bool, error) {
+	var activeKey Key
+	for _, key := range keys {
+		if key.Kind == "mac" && key.Active {
+			activeKey = key
+		}
+	}
+	macKeys, err := pm.macKeyProvider.keysWithIDs(ctx)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	needed := make(map[int64]bool)
+	for _, ctx := range pm.tenantContexts(ctx) {
+		// password reset tokens don't say which key made them, so any of
+		// them predating the active key keeps every key
+		PASSWORD_RESETS := tables.NEW_PASSWORD_RESETS(ctx, "")
+		predicates := []sq.Predicate{
+			PASSWORD_RESETS.USED_AT.IsNull(),
+			PASSWORD_RESETS.EXPIRES_AT.GtTime(time.Now().UTC()),
+		}
+		if activeKey.CreatedAt.Valid {
+			predicates = append(predicates, PASSWORD_RESETS.CREATED_AT.LtTime(activeKey.CreatedAt.Time))
+		}
+		outstanding, err := sq.ExistsContext(ctx, pm.dataDB, sq.SQLite.From(PASSWORD_RESETS).Where(predicates...))
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+		if outstanding {
+			return nil, nil
+		}
+		var prevMAC string
+		AUDIT_LOG := tables.NEW_AUDIT_LOG(ctx, "")
+		_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+			From(AUDIT_LOG).
+			Where(AUDIT_LOG.MAC.IsNotNull()).
+			OrderBy(AUDIT_LOG.AUDIT_ID),
+			func(row *sq.Row) error {
+				entry := scanAuditEntry(row, AUDIT_LOG)
+				return row.Accumulate(func() error {
+					for _, macKey := range macKeys {
+						if auditMAC(macKey.key, prevMAC, entry) == entry.MAC {
+							needed[macKey.id] = true
+							break
+						}
+					}
+					prevMAC = entry.MAC
+					return nil
+				})
+			},
+		)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+	}
+	return needed, nil
+}
+
+// ChangeSuperadminPassword changes the superadmin password. The inner keys
+// are derived afresh from the new password (with new salts) and every
+// encryption and MAC key is rewrapped with them in one transaction, so all
+// existing ciphertexts and MACs stay valid. Every superadmin session is logged
+// out. It returns errIncorrectPassword if oldPassword is wrong.
+func (pm *PageManager) ChangeSuperadminPassword(ctx context.Context, oldPassword, newPassword string) error {
+	if len(newPassword) < minPasswordLength {
+		return fmt.Errorf("passwords must be at least %d characters long", minPasswordLength)
+	}
+	err := pm.rewrapSuperadminKeys(ctx, oldPassword, newPassword)
+	if err != nil {
+		return err
+	}
+	// the superadmin can log into every tenant
+	for _, ctx := range pm.tenantContexts(ctx) {
+		SESSIONS := tables.NEW_SESSIONS(ctx, "")
+		_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+			DeleteFrom(SESSIONS).
+			Where(SESSIONS.USER_ID.EqInt64(0)),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	pm.audit(ctx, AuditPasswordChange, auditAccount(true, 0), map[string]interface{}{"via": "change", "sessions_revoked": true})
+	return nil
+}
+
+// rewrapSuperadminKeys hashes newPassword and derives new inner keys from it
+// with argon2Policy, then rewraps every encryption and MAC key with the new
+// inner keys. oldPassword and newPassword may be the same, which upgrades the
+// hash and inner keys to the current policy. It returns errIncorrectPassword
+// if oldPassword is wrong.
+func (pm *PageManager) rewrapSuperadminKeys(ctx context.Context, oldPassword, newPassword string) error {
+	// a rotation must not add keys wrapped with the old inner keys once they
+	// have been replaced
+	pm.rotationMutex.Lock()
+	defer pm.rotationMutex.Unlock()
+	if pm.rotation.Running() {
+		return fmt.Errorf("a key rotation is running, try again once it has finished")
+	}
+	var passwordHash, encryptionKeyParams, macKeyParams sql.NullString
+	SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
+	_, err := sq.FetchContext(ctx, pm.superadminDB, sq.SQLite.
+		From(SUPERADMIN).
+		Where(SUPERADMIN.ID.EqInt(1)),
+		func(row *sq.Row) error {
+			passwordHash = row.NullString(SUPERADMIN.PASSWORD_HASH)
+			encryptionKeyParams = row.NullString(SUPERADMIN.ENCRYPTION_KEY_PARAMETERS)
+			macKeyParams = row.NullString(SUPERADMIN.MAC_KEY_PARAMETERS)
+			return nil
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !passwordHash.Valid {
+		return erro.Wrap(fmt.Errorf("superadmin has not been set up, run pagemanager with -pm-superadmin-setup"))
+	}
+	err = verifyHashAndPassword(passwordHash.String, oldPassword)
+	if errors.Is(err, errPasswordHashingBusy) {
+		return err
+	}
+	if err != nil {
+		return errIncorrectPassword
+	}
+	oldEncryptionKey, err := deriveKeyFromParams(encryptionKeyParams.String, oldPassword)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	oldMACKey, err := deriveKeyFromParams(macKeyParams.String, oldPassword)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	newPasswordHash, err := deriveKeyFromPassword(newPassword)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	newEncryptionKey, err := deriveKeyFromPassword(newPassword)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	newMACKey, err := deriveKeyFromPassword(newPassword)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	// hold keysMutex until the new inner keys are in place, so that nothing
+	// reads rewrapped keys with the old inner keys
+	err = func() error {
+		pm.keysMutex.Lock()
+		defer pm.keysMutex.Unlock()
+		err := sq.WithTxContext(ctx, pm.superadminDB, nil, func(tx *sql.Tx) error {
+			ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(withoutTenant(ctx), "")
+			err := rewrapKeys(ctx, tx, ENCRYPTION_KEYS.TableInfo, ENCRYPTION_KEYS.ID, ENCRYPTION_KEYS.KEY_CIPHERTEXT, oldEncryptionKey, newEncryptionKey.key)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			MAC_KEYS := tables.NEW_MAC_KEYS(withoutTenant(ctx), "")
+			err = rewrapKeys(ctx, tx, MAC_KEYS.TableInfo, MAC_KEYS.ID, MAC_KEYS.KEY_CIPHERTEXT, oldMACKey, newMACKey.key)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+				Update(SUPERADMIN).
+				Setx(func(col *sq.Column) error {
+					col.SetString(SUPERADMIN.PASSWORD_HASH, newPasswordHash.Marshal())
+					col.SetString(SUPERADMIN.ENCRYPTION_KEY_PARAMETERS, newEncryptionKey.MarshalParams())
+					col.SetString(SUPERADMIN.MAC_KEY_PARAMETERS, newMACKey.MarshalParams())
+					return nil
+				}).
+				Where(SUPERADMIN.ID.EqInt(1)),
+				0,
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		pm.innerEncryptionKey = newEncryptionKey.key
+		pm.innerMACKey = newMACKey.key
+		return nil
+	}()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// rewrapKeys decrypts every key in table with oldKey and encrypts it again
+// with newKey.
+func rewrapKeys(ctx context.Context, tx *sql.Tx, table sq.TableInfo, id sq.NumberField, keyCiphertext sq.StringField, oldKey, newKey []byte) error {
+	type wrappedKey struct {
+		id         int64
+		ciphertext string
+	}
+	var keys []wrappedKey
+	_, err := sq.FetchContext(ctx, tx, sq.SQLite.
+		From(table).
+		OrderBy(id),
+		func(row *sq.Row) error {
+			key := wrappedKey{id: row.Int64(id), ciphertext: row.String(keyCiphertext)}
+			return row.Accumulate(func() error {
+				keys = append(keys, key)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for _, key := range keys {
+		plaintext, ok, err := decrypt(oldKey, key.ciphertext)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if !ok {
+			return erro.Wrap(fmt.Errorf("%s %d is not wrapped with the superadmin's key", table.Name, key.id))
+		}
+		ciphertext, err := encrypt(newKey, plaintext)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			Update(table).
+			Setx(func(col *sq.Column) error {
+				col.SetString(keyCiphertext, ciphertext)
+				return nil
+			}).
+			Where(id.EqInt64(key.id)),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// migrateMACKeys rewraps the MAC keys that are still wrapped with the inner
+// encryption key, as superadmins set up before the inner MAC key was used
+// have them, with the inner MAC key.
+func migrateMACKeys(ctx context.Context, db *sql.DB, innerEncryptionKey, innerMACKey []byte) (migrated int, err error) {
+	err = sq.WithTxContext(ctx, db, nil, func(tx *sql.Tx) error {
+		type wrappedKey struct {
+			id         int64
+			ciphertext string
+		}
+		var keys []wrappedKey
+		MAC_KEYS := tables.NEW_MAC_KEYS(withoutTenant(ctx), "")
+		_, err := sq.FetchContext(ctx, tx, sq.SQLite.
+			From(MAC_KEYS).
+			OrderBy(MAC_KEYS.ID),
+			func(row *sq.Row) error {
+				key := wrappedKey{id: row.Int64(MAC_KEYS.ID), ciphertext: row.String(MAC_KEYS.KEY_CIPHERTEXT)}
+				return row.Accumulate(func() error {
+					keys = append(keys, key)
+					return nil
+				})
+			},
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, key := range keys {
+			_, ok, err := decrypt(innerMACKey, key.ciphertext)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			if ok {
+				continue
+			}
+			plaintext, ok, err := decrypt(innerEncryptionKey, key.ciphertext)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			if !ok {
+				continue
+			}
+			ciphertext, err := encrypt(innerMACKey, plaintext)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+				Update(MAC_KEYS).
+				Setx(func(col *sq.Column) error {
+					col.SetString(MAC_KEYS.KEY_CIPHERTEXT, ciphertext)
+					return nil
+				}).
+				Where(MAC_KEYS.ID.EqInt64(key.id)),
+				0,
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			migrated++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	return migrated, nil
+}
+
+type superadminPasswordData struct {
+	OldPassword string
+	ip          string
+	pm          *PageManager
+	ctx         context.Context
+}
+
+func (d *superadminPasswordData) Form(form *hyforms.Form) {
+	const incorrectPasswordMsg = "incorrect password"
+	// inputs
+	oldPassword := form.
+		Input("password", "pm-superadmin-old-password", "").
+		Set("#pm-superadmin-old-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "current-password"})
+	password := form.
+		Input("password", "pm-superadmin-password", "").
+		Set("#pm-superadmin-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+	confirmPassword := form.
+		Input("password", "pm-superadmin-confirm-password", "").
+		Set("#pm-superadmin-confirm-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+
+	// marshal
+	form.Set("#loginform.bg-white", hy.Attr{"name": "superadminpasswordform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": oldPassword.ID()}, hy.Txt("Current Password:")))
+	form.Append("div", nil, oldPassword)
+	if hyforms.ErrMsgsMatch(oldPassword.ErrMsgs(), incorrectPasswordMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("Incorrect password"))
+	}
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("New Password:")))
+	form.Append("div", nil, password)
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": confirmPassword.ID()}, hy.Txt("Confirm New Password:")))
+	form.Append("div", nil, confirmPassword)
+	appendPasswordErrMsgs(form, password, confirmPassword)
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Change password")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		d.OldPassword = oldPassword.Validate(hyforms.Required).Value()
+		pw := validateNewPassword(form, password, confirmPassword)
+		if len(oldPassword.ErrMsgs()) > 0 || len(password.ErrMsgs()) > 0 || len(confirmPassword.ErrMsgs()) > 0 {
+			return
+		}
+		// ChangeSuperadminPassword audits the change, it is not a login
+		err := d.pm.throttlePasswordCheck(d.ctx, d.ip, "superadmin", "", func() error {
+			return d.pm.ChangeSuperadminPassword(d.ctx, d.OldPassword, pw)
+		})
+		if errors.Is(err, errIncorrectPassword) {
+			form.AddInputErrMsgs(oldPassword.Name(), incorrectPasswordMsg)
+		} else if err != nil {
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+// superadminPassword lets the superadmin change their password. The browser
+// it is changed from stays logged in, every other superadmin session is
+// logged out.
+func (pm *PageManager) superadminPassword(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-superadmin-password"
+	user, _ := CurrentUser(r)
+	if !user.Superadmin {
+		pm.forbidden(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		d := &superadminPasswordData{}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		page := userFormPage{Title: "Change the superadmin password"}
+		if r.FormValue("done") != "" {
+			page.Message = "Your password has been changed and every other session has been logged out."
+		}
+		pm.serveUserForm(w, r, "unlock.html", page, d.Form)
+	case "POST":
+		d := &superadminPasswordData{ip: clientIP(r), pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			d.OldPassword = "" // never round-trip the password through a cookie
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		token, err := pm.createSession(r, 0, map[string]interface{}{"pm-superadmin": true})
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, r, token, false)
+		http.Redirect(w, r, LocaleURL(r)+"?done=1", http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// keysPage lets the superadmin rotate and retire keys and follow the
+// progress of re-encryption.
+func (pm *PageManager) keysPage(w http.ResponseWriter, r *http.Request) {
+	const (
+		errorCookieName   = "pm-keys-error"
+		messageCookieName = "pm-keys-message"
+	)
+	type Data struct {
+		Keys      []Key
+		Rotation  KeyRotation
+		Message   string
+		Error     string
+		CSRFToken string
+	}
+	user, _ := CurrentUser(r)
+	if !user.Superadmin {
+		pm.forbidden(w, r)
+		return
+	}
+	if !pm.requireUnlocked(w, r) {
+		return
+	}
+	if r.Method == "POST" {
+		if !checkCSRF(w, r) {
+			return
+		}
+		switch {
+		case r.FormValue("rotate") != "":
+			err := pm.RotateKeys(r.Context())
+			if err != nil {
+				_ = hyforms.CookieSet(w, errorCookieName, err.Error(), nil)
+			}
+			http.Redirect(w, r, "/pm-keys", http.StatusFound)
+		case r.FormValue("retire") != "":
+			retired, err := pm.RetireKeys(r.Context())
+			if err != nil {
+				_ = hyforms.CookieSet(w, errorCookieName, err.Error(), nil)
+			} else {
+				_ = hyforms.CookieSet(w, messageCookieName, fmt.Sprintf("%d keys retired", len(retired)), nil)
+			}
+			http.Redirect(w, r, "/pm-keys", http.StatusFound)
+		default:
+			http.Redirect(w, r, "/pm-keys", http.StatusFound)
+		}
+		return
+	}
+	data := Data{Rotation: pm.KeyRotationStatus()}
+	_ = hyforms.CookiePop(w, r, messageCookieName, &data.Message)
+	_ = hyforms.CookiePop(w, r, errorCookieName, &data.Error)
+	var err error
+	data.CSRFToken, err = hyforms.CSRFToken(w, r)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Keys, err = pm.Keys(r.Context())
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := pm.parseTemplates(templatesFS, "keys.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,148 @@
+package pagemanager
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_migrateMACKeys(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	macKey := "mac-key-xxxxxxxxxxxxxxxxxxxxxxxx"
+	// a MAC key wrapped with the inner encryption key, as older setups did
+	ciphertext, err := encrypt(pm.innerEncryptionKey, macKey)
+	is.NoErr(err)
+	_, err = pm.superadminDB.Exec("UPDATE pm_mac_keys SET key_ciphertext = ?", ciphertext)
+	is.NoErr(err)
+	pm.innerEncryptionKey, pm.innerMACKey = nil, nil
+	is.NoErr(pm.unlockSuperadmin(ctx, "password"))
+	is.NoErr(pm.superadminDB.QueryRow("SELECT key_ciphertext FROM pm_mac_keys").Scan(&ciphertext))
+	plaintext, ok, err := decrypt(pm.innerMACKey, ciphertext)
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(macKey, plaintext)
+	// keys that are already wrapped correctly are left alone
+	migrated, err := migrateMACKeys(ctx, pm.superadminDB, pm.innerEncryptionKey, pm.innerMACKey)
+	is.NoErr(err)
+	is.Equal(0, migrated)
+}
+
+func Test_RetireKeys(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	_, _, err := pm.addKeys(ctx, pm.innerEncryptionKey, pm.innerMACKey)
+	is.NoErr(err)
+	// other processes may still have the previous keys cached
+	_, err = pm.RetireKeys(ctx)
+	is.True(err != nil)
+	for _, table := range []string{"pm_encryption_keys", "pm_mac_keys"} {
+		_, err = pm.superadminDB.Exec("UPDATE "+table+" SET created_at = ? WHERE created_at IS NOT NULL", time.Now().Add(-keyCacheLifetime).UTC())
+		is.NoErr(err)
+	}
+	retired, err := pm.RetireKeys(ctx)
+	is.NoErr(err)
+	is.Equal(2, len(retired))
+}
+
+func Test_RotateKeys(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	keys, err := pm.encryptionKeys(ctx)
+	is.NoErr(err)
+	oldKeyID := keys[0].id
+	totpSecret, err := pm.Encrypt("totp secret")
+	is.NoErr(err)
+	_, err = pm.superadminDB.Exec("UPDATE pm_superadmin SET totp_secret_ciphertext = ?", totpSecret)
+	is.NoErr(err)
+	for _, page := range []string{"/a", "/b"} {
+		value, err := pm.sealPageValue("notes for " + page)
+		is.NoErr(err)
+		_, err = pm.dataDB.Exec("INSERT INTO pm_pagedata (locale_code, data_id, key, value) VALUES ('', ?, 'notes', ?)", page, value)
+		is.NoErr(err)
+	}
+	is.NoErr(pm.RotateKeys(ctx))
+	deadline := time.Now().Add(10 * time.Second)
+	for pm.KeyRotationStatus().Running() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := pm.KeyRotationStatus()
+	is.True(!status.Running())
+	is.Equal("", status.Err)
+	is.True(status.KeyID != oldKeyID)
+	is.Equal(3, status.Total)
+	is.Equal(3, status.Done)
+	is.Equal(0, status.Failed)
+	keyPrefix := strconv.FormatInt(status.KeyID, 10) + ":"
+
+	is.NoErr(pm.superadminDB.QueryRow("SELECT totp_secret_ciphertext FROM pm_superadmin").Scan(&totpSecret))
+	is.True(strings.HasPrefix(totpSecret, keyPrefix))
+	plaintext, err := pm.Decrypt(totpSecret)
+	is.NoErr(err)
+	is.Equal("totp secret", plaintext)
+	rows, err := pm.dataDB.Query("SELECT data_id, value FROM pm_pagedata WHERE key = 'notes'")
+	is.NoErr(err)
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var page, value string
+		is.NoErr(rows.Scan(&page, &value))
+		is.True(strings.HasPrefix(value, sensitivePrefix+keyPrefix))
+		plaintext, err := pm.openPageValue(value)
+		is.NoErr(err)
+		is.Equal("notes for "+page, plaintext)
+		n++
+	}
+	is.NoErr(rows.Err())
+	is.Equal(2, n)
+}
+
+func Test_ChangeSuperadminPassword(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	ciphertext, err := pm.Encrypt("secret")
+	is.NoErr(err)
+	mac, err := pm.MAC("data")
+	is.NoErr(err)
+	is.True(errors.Is(pm.ChangeSuperadminPassword(ctx, "wrong password", "new password"), errIncorrectPassword))
+	is.NoErr(pm.ChangeSuperadminPassword(ctx, "password", "new password"))
+	lock := func() {
+		pm.innerEncryptionKey, pm.innerMACKey = nil, nil
+		pm.encryptionKeyProvider.invalidate()
+		pm.macKeyProvider.invalidate()
+	}
+	lock()
+	is.True(errors.Is(pm.unlockSuperadmin(ctx, "password"), errIncorrectPassword))
+	is.True(pm.Locked())
+	is.NoErr(pm.unlockSuperadmin(ctx, "new password"))
+	plaintext, err := pm.Decrypt(ciphertext)
+	is.NoErr(err)
+	is.Equal("secret", plaintext)
+	ok, err := pm.VerifyMAC("data", mac)
+	is.NoErr(err)
+	is.True(ok)
+	// a password change is not a login
+	err = pm.throttlePasswordCheck(ctx, "10.0.0.1", "superadmin", "", func() error {
+		return pm.ChangeSuperadminPassword(ctx, "new password", "newer password")
+	})
+	is.NoErr(err)
+	entries, err := pm.AuditLog(ctx, AuditFilter{Action: "login."})
+	is.NoErr(err)
+	is.Equal(0, len(entries))
+	entries, err = pm.AuditLog(ctx, AuditFilter{Action: AuditPasswordChange})
+	is.NoErr(err)
+	is.Equal(2, len(entries))
+}
@@ -0,0 +1,194 @@
+package pagemanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// localeChain returns the locale codes to try, in order, when looking up a
+// page data key for localeCode. The chain always starts with localeCode
+// itself and always ends with the default locale "".
+func (pm *PageManager) localeChain(ctx context.Context, localeCode string) []string {
+	pm.localesMutex.RLock()
+	fallbacks := pm.localeFallbacks[tenantID(ctx)][localeCode]
+	pm.localesMutex.RUnlock()
+	chain := make([]string, 0, len(fallbacks)+2)
+	seen := make(map[string]struct{})
+	for _, code := range append(append([]string{localeCode}, fallbacks...), "") {
+		if _, ok := seen[code]; ok {
+			continue
+		}
+		seen[code] = struct{}{}
+		chain = append(chain, code)
+	}
+	return chain
+}
+
+// localeOrder orders rows by their locale's position in chain, so that
+// ORDER BY localeOrder(...) LIMIT 1 picks the most preferred locale.
+func localeOrder(field sq.Field, chain []string) sq.SimpleCases {
+	cases := sq.Case(field)
+	for i, code := range chain {
+		cases = cases.When(code, i+1)
+	}
+	return cases.Else(len(chain) + 1)
+}
+
+// Locales returns the locales of the tenant in ctx, keyed by locale code,
+// together with their fallback chains.
+func (pm *PageManager) Locales(ctx context.Context) (locales map[string]string, fallbacks map[string][]string) {
+	pm.localesMutex.RLock()
+	defer pm.localesMutex.RUnlock()
+	locales, fallbacks = make(map[string]string), make(map[string][]string)
+	for code, description := range pm.locales[tenantID(ctx)] {
+		locales[code] = description
+	}
+	for code, chain := range pm.localeFallbacks[tenantID(ctx)] {
+		fallbacks[code] = append([]string(nil), chain...)
+	}
+	return locales, fallbacks
+}
+
+// AddLocale adds a locale to the tenant in ctx, or updates its description
+// if it already exists.
+func (pm *PageManager) AddLocale(ctx context.Context, localeCode, description string) error {
+	if localeCode == "" {
+		return erro.Wrap(fmt.Errorf("locale code cannot be empty"))
+	}
+	LOCALES := tables.NEW_LOCALES(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		InsertInto(LOCALES).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(LOCALES.LOCALE_CODE, localeCode)
+			col.SetString(LOCALES.DESCRIPTION, description)
+			return nil
+		}).
+		OnConflict(LOCALES.LOCALE_CODE).
+		DoUpdateSet(sq.SetExcluded(LOCALES.DESCRIPTION)),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.localesMutex.Lock()
+	pm.locales[tenantID(ctx)][localeCode] = description
+	pm.localesMutex.Unlock()
+	return nil
+}
+
+// SetLocaleFallbacks sets the fallback chain for localeCode. Page data
+// lookups for localeCode will try each fallback in order before finally
+// falling back to the default locale.
+func (pm *PageManager) SetLocaleFallbacks(ctx context.Context, localeCode string, fallbacks []string) error {
+	pm.localesMutex.RLock()
+	locales := pm.locales[tenantID(ctx)]
+	_, ok := locales[localeCode]
+	for _, code := range fallbacks {
+		if _, exists := locales[code]; !exists && code != "" {
+			ok = false
+		}
+	}
+	pm.localesMutex.RUnlock()
+	if !ok {
+		return erro.Wrap(fmt.Errorf("unknown locale in %s => %v", localeCode, fallbacks))
+	}
+	b, err := json.Marshal(fallbacks)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	LOCALES := tables.NEW_LOCALES(ctx, "")
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		Update(LOCALES).
+		Setx(func(col *sq.Column) error {
+			col.Set(LOCALES.FALLBACKS, string(b))
+			return nil
+		}).
+		Where(LOCALES.LOCALE_CODE.EqString(localeCode)),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.localesMutex.Lock()
+	pm.localeFallbacks[tenantID(ctx)][localeCode] = fallbacks
+	pm.localesMutex.Unlock()
+	return nil
+}
+
+// UntranslatedKey is a page data key that has no value in LocaleCode and is
+// instead served from FallbackLocaleCode, or not served at all if Missing.
+type UntranslatedKey struct {
+	LocaleCode         string
+	DataID             string
+	Key                string
+	FallbackLocaleCode string // "" is the default locale, unless Missing
+	Missing            bool   // no locale in LocaleCode's chain has the key
+}
+
+// UntranslatedKeys reports, for every locale, the page data keys that exist
+// in some locale but have no value of their own in that locale. The result
+// is keyed by locale code.
+func (pm *PageManager) UntranslatedKeys(ctx context.Context) (map[string][]UntranslatedKey, error) {
+	type dataKey struct{ dataID, key string }
+	var dataKeys []dataKey
+	present := make(map[dataKey]map[string]struct{}) // dataKey => set of locale codes
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "pd")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		SelectDistinct().
+		From(PAGEDATA).
+		OrderBy(PAGEDATA.DATA_ID, PAGEDATA.KEY),
+		func(row *sq.Row) error {
+			k := dataKey{dataID: row.String(PAGEDATA.DATA_ID), key: row.String(PAGEDATA.KEY)}
+			localeCode := row.String(PAGEDATA.LOCALE_CODE)
+			return row.Accumulate(func() error {
+				if _, ok := present[k]; !ok {
+					present[k] = make(map[string]struct{})
+					dataKeys = append(dataKeys, k)
+				}
+				present[k][localeCode] = struct{}{}
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	pm.localesMutex.RLock()
+	locales := pm.locales[tenantID(ctx)]
+	localeCodes := make([]string, 0, len(locales))
+	for localeCode := range locales {
+		localeCodes = append(localeCodes, localeCode)
+	}
+	pm.localesMutex.RUnlock()
+	sort.Strings(localeCodes)
+	report := make(map[string][]UntranslatedKey)
+	for _, localeCode := range localeCodes {
+		chain := pm.localeChain(ctx, localeCode)
+		for _, k := range dataKeys {
+			if _, ok := present[k][localeCode]; ok {
+				continue
+			}
+			untranslated := UntranslatedKey{
+				LocaleCode: localeCode,
+				DataID:     k.dataID,
+				Key:        k.key,
+				Missing:    true,
+			}
+			for _, code := range chain[1:] {
+				if _, ok := present[k][code]; ok {
+					untranslated.FallbackLocaleCode = code
+					untranslated.Missing = false
+					break
+				}
+			}
+			report[localeCode] = append(report[localeCode], untranslated)
+		}
+	}
+	return report, nil
+}
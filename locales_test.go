@@ -0,0 +1,54 @@
+package pagemanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_Locales(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	is.NoErr(seedData(ctx, pm.dataDB))
+	is.NoErr(pm.loadLocales(ctx))
+	is.NoErr(pm.AddLocale(ctx, "en-gb", "British English"))
+	is.NoErr(pm.SetLocaleFallbacks(ctx, "en-gb", []string{"en"}))
+	is.True(pm.SetLocaleFallbacks(ctx, "en-gb", []string{"fr"}) != nil)
+	// the chain survives the seeding that every start does
+	is.NoErr(seedData(ctx, pm.dataDB))
+	is.NoErr(pm.loadLocales(ctx))
+	locales, fallbacks := pm.Locales(ctx)
+	is.Equal("British English", locales["en-gb"])
+	is.Equal([]string{"en"}, fallbacks["en-gb"])
+	is.Equal([]string{"en-gb", "en", ""}, pm.localeChain(ctx, "en-gb"))
+
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		InsertInto(PAGEDATA).
+		Valuesx(func(col *sq.Column) error {
+			for _, localeCode := range []string{"", "en"} {
+				col.SetString(PAGEDATA.LOCALE_CODE, localeCode)
+				col.SetString(PAGEDATA.DATA_ID, "/about")
+				col.SetString(PAGEDATA.KEY, "title")
+				col.Set(PAGEDATA.VALUE, `"About"`)
+			}
+			return nil
+		}),
+		0,
+	)
+	is.NoErr(err)
+	report, err := pm.UntranslatedKeys(ctx)
+	is.NoErr(err)
+	is.Equal([]UntranslatedKey{{LocaleCode: "en-gb", DataID: "/about", Key: "title", FallbackLocaleCode: "en"}}, report["en-gb"])
+	is.Equal(0, len(report["en"]))
+	// a key only en-gb has is missing from en, not served from the default
+	_, err = pm.dataDB.Exec("INSERT INTO pm_pagedata (locale_code, data_id, key, value) VALUES ('en-gb', '/about', 'colour', 'red')")
+	is.NoErr(err)
+	report, err = pm.UntranslatedKeys(ctx)
+	is.NoErr(err)
+	is.Equal([]UntranslatedKey{{LocaleCode: "en", DataID: "/about", Key: "colour", Missing: true}}, report["en"])
+}
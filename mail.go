@@ -0,0 +1,68 @@
+package pagemanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+// Mailer sends email on PageManager's behalf, for example password reset
+// links. Plug in a real implementation with SetMailer.
+type Mailer interface {
+	SendMail(ctx context.Context, to, subject, body string) error
+}
+
+// WriterMailer writes every email to W instead of sending it. It is meant for
+// local testing.
+type WriterMailer struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (m *WriterMailer) SendMail(ctx context.Context, to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.W, "To: %s\nSubject: %s\nDate: %s\n\n%s\n\n", to, subject, time.Now().Format(time.RFC1123Z), body)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// FileMailer writes every email to its own file in Dir instead of sending it.
+// It is meant for local testing.
+type FileMailer struct {
+	Dir string
+}
+
+func (m FileMailer) SendMail(ctx context.Context, to, subject, body string) error {
+	err := os.MkdirAll(m.Dir, 0775)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	recipient := strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(to)
+	name := filepath.Join(m.Dir, time.Now().Format("20060102T150405.000000000")+"-"+recipient+".eml")
+	f, err := os.Create(name)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer f.Close()
+	err = (&WriterMailer{W: f}).SendMail(ctx, to, subject, body)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// SetMailer replaces the mailer used to send email. By default emails are
+// written to stdout, or into the folder given by -pm-mail-dir.
+func (pm *PageManager) SetMailer(mailer Mailer) {
+	pm.mailer = mailer
+}
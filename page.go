@@ -3,12 +3,15 @@ package pagemanager
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bokwoon95/erro"
@@ -26,12 +29,40 @@ type PageData struct {
 	JSAssets   []Asset
 	CSP        map[string][]string
 	JSON       map[string]interface{}
+	Schema     map[string]DataField
+	Query      url.Values
+}
+
+const (
+	DataTypeString = "string"
+	DataTypeInt    = "int"
+	DataTypeBool   = "bool"
+	DataTypeTime   = "time"
+	DataTypeJSON   = "json"
+	DataTypeImage  = "image"
+)
+
+// DataField describes a page data key declared in a theme's Schema.
+type DataField struct {
+	Type string
+	// Sensitive values are encrypted at rest with Encrypt and kept out of
+	// the search index and the audit log.
+	Sensitive bool
+}
+
+// Image is the structured value of a page data key of type image.
+type Image struct {
+	Src    string
+	Alt    string
+	Width  int
+	Height int
 }
 
 func NewPage() PageData {
 	return PageData{
-		CSP:  make(map[string][]string),
-		JSON: make(map[string]interface{}),
+		CSP:    make(map[string][]string),
+		JSON:   make(map[string]interface{}),
+		Schema: make(map[string]DataField),
 	}
 }
 
@@ -172,21 +203,26 @@ func (pm *PageManager) pmGetValue(pg PageData, key string, opts ...PageDataOptio
 	for _, opt := range opts {
 		opt(&pg)
 	}
+	ns, err := pm.getValue(pg, key)
+	if err != nil {
+		return ns, erro.Wrap(err)
+	}
+	return ns, nil
+}
+
+func (pm *PageManager) getValue(pg PageData, key string) (NullString, error) {
 	var ns NullString
+	chain := pm.localeChain(pg.Ctx, pg.LocaleCode)
 	PAGEDATA := tables.NEW_PAGEDATA(pg.Ctx, "p")
 	_, err := sq.FetchContext(pg.Ctx, pm.dataDB, sq.SQLite.
 		From(PAGEDATA).
 		Where(
-			PAGEDATA.LOCALE_CODE.In([]string{pg.LocaleCode, ""}),
+			PAGEDATA.LOCALE_CODE.In(chain),
 			PAGEDATA.DATA_ID.EqString(pg.DataID),
 			PAGEDATA.KEY.EqString(key),
 			PAGEDATA.ARRAY_INDEX.IsNull(),
 		).
-		OrderBy(sq.
-			Case(PAGEDATA.LOCALE_CODE).
-			When(pg.LocaleCode, 1).
-			When("", 2),
-		).
+		OrderBy(localeOrder(PAGEDATA.LOCALE_CODE, chain)).
 		Limit(1),
 		func(row *sq.Row) error {
 			row.ScanInto(&ns, PAGEDATA.VALUE)
@@ -196,33 +232,153 @@ func (pm *PageManager) pmGetValue(pg PageData, key string, opts ...PageDataOptio
 	if err != nil {
 		return ns, erro.Wrap(err)
 	}
+	if ns.Valid {
+		ns.Str, err = pm.openPageValue(ns.Str)
+		if err != nil {
+			return ns, erro.Wrap(fmt.Errorf("%s: %w", key, err))
+		}
+	}
 	return ns, nil
 }
 
+// sensitivePrefix marks a page data value that was encrypted because its key
+// is declared Sensitive. The value is stored as sensitivePrefix followed by
+// the output of Encrypt, which carries the key ID so that key rotation can
+// re-encrypt it.
+const sensitivePrefix = "pm-encrypted:"
+
+// sealPageValue encrypts a sensitive page data value for storage.
+func (pm *PageManager) sealPageValue(value string) (string, error) {
+	ciphertext, err := pm.Encrypt(value)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return sensitivePrefix + ciphertext, nil
+}
+
+// openPageValue decrypts a value sealed by sealPageValue. Any other value is
+// returned as is.
+func (pm *PageManager) openPageValue(value string) (string, error) {
+	if !strings.HasPrefix(value, sensitivePrefix) {
+		return value, nil
+	}
+	plaintext, err := pm.Decrypt(strings.TrimPrefix(value, sensitivePrefix))
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return plaintext, nil
+}
+
+// sensitiveKeys returns the keys declared Sensitive in the schema of the
+// template that the page dataID uses. Blocks have no schema and so no
+// sensitive keys.
+func (pm *PageManager) sensitiveKeys(ctx context.Context, db sq.Queryer, dataID string) (map[string]bool, error) {
+	var themePath, templateName sql.NullString
+	PAGES := tables.NEW_PAGES(ctx, "p")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(PAGES).
+		Where(PAGES.URL.EqString(dataID)),
+		func(row *sq.Row) error {
+			themePath = row.NullString(PAGES.THEME_PATH)
+			templateName = row.NullString(PAGES.TEMPLATE)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if !themePath.Valid || !templateName.Valid {
+		return nil, nil
+	}
+	pm.themesMutex.RLock()
+	schema := pm.themes[tenantID(ctx)][themePath.String].themeTemplates[templateName.String].Schema
+	pm.themesMutex.RUnlock()
+	var sensitive map[string]bool
+	for key, field := range schema {
+		if !field.Sensitive {
+			continue
+		}
+		if sensitive == nil {
+			sensitive = make(map[string]bool)
+		}
+		sensitive[key] = true
+	}
+	return sensitive, nil
+}
+
+// setPageValue replaces the (non-row) value of key for dataID in localeCode.
+// An empty value deletes the key instead.
+func setPageValue(ctx context.Context, db sq.Queryer, localeCode, dataID, key, value string) error {
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(dataID),
+			PAGEDATA.KEY.EqString(key),
+			PAGEDATA.ARRAY_INDEX.IsNull(),
+		),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if value == "" {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(PAGEDATA).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(PAGEDATA.LOCALE_CODE, localeCode)
+			col.SetString(PAGEDATA.DATA_ID, dataID)
+			col.SetString(PAGEDATA.KEY, key)
+			col.Set(PAGEDATA.VALUE, value)
+			return nil
+		}),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
 func (pm *PageManager) pmGetRows(pg PageData, key string, opts ...PageDataOption) ([]interface{}, error) {
 	for _, opt := range opts {
 		opt(&pg)
 	}
+	// rows are served as a whole list from the first locale in the chain that
+	// has any rows, never as a mix of rows from different locales
+	var localeCode sql.NullString
+	chain := pm.localeChain(pg.Ctx, pg.LocaleCode)
 	PAGEDATA := tables.NEW_PAGEDATA(pg.Ctx, "p")
-	exists, err := sq.ExistsContext(pg.Ctx, pm.dataDB, sq.SQLite.
+	_, err := sq.FetchContext(pg.Ctx, pm.dataDB, sq.SQLite.
 		From(PAGEDATA).
 		Where(
-			PAGEDATA.LOCALE_CODE.EqString(pg.LocaleCode),
+			PAGEDATA.LOCALE_CODE.In(chain),
 			PAGEDATA.DATA_ID.EqString(pg.DataID),
 			PAGEDATA.KEY.EqString(key),
 			PAGEDATA.ARRAY_INDEX.IsNotNull(),
-		),
+		).
+		OrderBy(localeOrder(PAGEDATA.LOCALE_CODE, chain)).
+		Limit(1),
+		func(row *sq.Row) error {
+			localeCode = row.NullString(PAGEDATA.LOCALE_CODE)
+			return nil
+		},
 	)
-	localeCode := pg.LocaleCode
-	if !exists {
-		localeCode = "" // default locale code
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if !localeCode.Valid {
+		return nil, nil
 	}
 	var values []interface{}
 	var b []byte
 	_, err = sq.FetchContext(pg.Ctx, pm.dataDB, sq.SQLite.
 		From(PAGEDATA).
 		Where(
-			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.LOCALE_CODE.EqString(localeCode.String),
 			PAGEDATA.DATA_ID.EqString(pg.DataID),
 			PAGEDATA.KEY.EqString(key),
 			PAGEDATA.ARRAY_INDEX.IsNotNull(),
@@ -231,13 +387,16 @@ func (pm *PageManager) pmGetRows(pg PageData, key string, opts ...PageDataOption
 		func(row *sq.Row) error {
 			b = row.Bytes(PAGEDATA.VALUE)
 			return row.Accumulate(func() error {
+				opened, err := pm.openPageValue(string(b))
+				if err != nil {
+					return erro.Wrap(fmt.Errorf("%s[%d]: %w", key, len(values), err))
+				}
 				value := make(map[string]interface{})
-				err := json.Unmarshal(b, &value)
+				err = json.Unmarshal([]byte(opened), &value)
 				if err != nil {
-					values = append(values, string(b)) // couldn't unmarshal json, switching to string
-				} else {
-					values = append(values, value)
+					return erro.Wrap(fmt.Errorf("%s[%d]: row is not a JSON object: %w", key, len(values), err))
 				}
+				values = append(values, value)
 				return nil
 			})
 		},
@@ -248,13 +407,168 @@ func (pm *PageManager) pmGetRows(pg PageData, key string, opts ...PageDataOption
 	return values, nil
 }
 
+// checkDataType returns an error if key is declared in the page's schema
+// with a type other than dataType. Undeclared keys are not checked.
+func checkDataType(pg PageData, key string, dataType string) error {
+	field, ok := pg.Schema[key]
+	if !ok || field.Type == dataType {
+		return nil
+	}
+	return fmt.Errorf("key %q is declared as %s, not %s", key, field.Type, dataType)
+}
+
+// unquoteValue returns the string contents of value if it is a JSON string,
+// otherwise it returns value as-is. This lets typed values be stored either
+// as bare text (42) or as JSON strings ("42").
+func unquoteValue(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, `"`) {
+		return value
+	}
+	var s string
+	err := json.Unmarshal([]byte(value), &s)
+	if err != nil {
+		return value
+	}
+	return s
+}
+
+func (pm *PageManager) pmGetInt(pg PageData, key string, opts ...PageDataOption) (int, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	err := checkDataType(pg, key, DataTypeInt)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	ns, err := pm.getValue(pg, key)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	if !ns.Valid {
+		return 0, nil
+	}
+	num, err := strconv.Atoi(unquoteValue(ns.Str))
+	if err != nil {
+		return 0, erro.Wrap(fmt.Errorf("%s: %w", key, err))
+	}
+	return num, nil
+}
+
+func (pm *PageManager) pmGetBool(pg PageData, key string, opts ...PageDataOption) (bool, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	err := checkDataType(pg, key, DataTypeBool)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	ns, err := pm.getValue(pg, key)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	if !ns.Valid {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(unquoteValue(ns.Str))
+	if err != nil {
+		return false, erro.Wrap(fmt.Errorf("%s: %w", key, err))
+	}
+	return b, nil
+}
+
+func (pm *PageManager) pmGetTime(pg PageData, key string, opts ...PageDataOption) (time.Time, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	err := checkDataType(pg, key, DataTypeTime)
+	if err != nil {
+		return time.Time{}, erro.Wrap(err)
+	}
+	ns, err := pm.getValue(pg, key)
+	if err != nil {
+		return time.Time{}, erro.Wrap(err)
+	}
+	if !ns.Valid {
+		return time.Time{}, nil
+	}
+	value := unquoteValue(ns.Str)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04", "2006-01-02"} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, erro.Wrap(fmt.Errorf("%s: %q is not a valid time", key, value))
+}
+
+func (pm *PageManager) pmGetJSON(pg PageData, key string, opts ...PageDataOption) (interface{}, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	err := checkDataType(pg, key, DataTypeJSON)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	ns, err := pm.getValue(pg, key)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if !ns.Valid {
+		return nil, nil
+	}
+	var value interface{}
+	err = json.Unmarshal([]byte(ns.Str), &value)
+	if err != nil {
+		return nil, erro.Wrap(fmt.Errorf("%s: %w", key, err))
+	}
+	return value, nil
+}
+
+func (pm *PageManager) pmGetImage(pg PageData, key string, opts ...PageDataOption) (Image, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	var img Image
+	err := checkDataType(pg, key, DataTypeImage)
+	if err != nil {
+		return img, erro.Wrap(err)
+	}
+	ns, err := pm.getValue(pg, key)
+	if err != nil {
+		return img, erro.Wrap(err)
+	}
+	if !ns.Valid {
+		return img, nil
+	}
+	value := strings.TrimSpace(ns.Str)
+	if !strings.HasPrefix(value, "{") {
+		// a bare string is treated as the image src
+		img.Src = unquoteValue(value)
+		return img, nil
+	}
+	err = json.Unmarshal([]byte(value), &img)
+	if err != nil {
+		return img, erro.Wrap(fmt.Errorf("%s: %w", key, err))
+	}
+	return img, nil
+}
+
 func (pm *PageManager) funcmap() map[string]interface{} {
 	return map[string]interface{}{
 		"jsonify":    jsonify,
 		"safeHTML":   safeHTML,
 		"pmGetValue": pm.pmGetValue,
 		"pmGetRows":  pm.pmGetRows,
+		"pmGetInt":   pm.pmGetInt,
+		"pmGetBool":  pm.pmGetBool,
+		"pmGetTime":  pm.pmGetTime,
+		"pmGetJSON":  pm.pmGetJSON,
+		"pmGetImage": pm.pmGetImage,
+		"pmSearch":   pm.pmSearch,
 		"pmLocale":   pmLocale,
 		"pmDataID":   pmDataID,
+		"pmBlock":    pm.pmBlock,
+		"pmUser":     pmUser,
 	}
 }
@@ -0,0 +1,70 @@
+package pagemanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_pmGetTyped(t *testing.T) {
+	pm := newTestPageManager(t)
+	pg := NewPage()
+	pg.Ctx = context.Background()
+	pg.DataID = "/typed"
+	pg.Schema["declared-bool"] = DataField{Type: DataTypeBool}
+	getters := map[string]func(pg PageData, key string) (interface{}, error){
+		DataTypeInt:   func(pg PageData, key string) (interface{}, error) { return pm.pmGetInt(pg, key) },
+		DataTypeBool:  func(pg PageData, key string) (interface{}, error) { return pm.pmGetBool(pg, key) },
+		DataTypeTime:  func(pg PageData, key string) (interface{}, error) { return pm.pmGetTime(pg, key) },
+		DataTypeJSON:  func(pg PageData, key string) (interface{}, error) { return pm.pmGetJSON(pg, key) },
+		DataTypeImage: func(pg PageData, key string) (interface{}, error) { return pm.pmGetImage(pg, key) },
+	}
+	tests := []struct {
+		key      string
+		dataType string
+		value    string // the key has no value if empty
+		want     interface{}
+		wantErr  bool
+	}{
+		{key: "int", dataType: DataTypeInt, value: `42`, want: 42},
+		{key: "int-quoted", dataType: DataTypeInt, value: ` "42" `, want: 42},
+		{key: "int-missing", dataType: DataTypeInt, want: 0},
+		{key: "int-bad", dataType: DataTypeInt, value: `4.2`, wantErr: true},
+		{key: "bool", dataType: DataTypeBool, value: `true`, want: true},
+		{key: "bool-quoted", dataType: DataTypeBool, value: `"false"`, want: false},
+		{key: "bool-missing", dataType: DataTypeBool, want: false},
+		{key: "bool-bad", dataType: DataTypeBool, value: `yes`, wantErr: true},
+		{key: "time-rfc3339", dataType: DataTypeTime, value: `"2021-02-03T04:05:06Z"`, want: time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)},
+		{key: "time-local", dataType: DataTypeTime, value: `2021-02-03T04:05`, want: time.Date(2021, 2, 3, 4, 5, 0, 0, time.UTC)},
+		{key: "time-date", dataType: DataTypeTime, value: `2021-02-03`, want: time.Date(2021, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{key: "time-missing", dataType: DataTypeTime, want: time.Time{}},
+		{key: "time-bad", dataType: DataTypeTime, value: `03/02/2021`, wantErr: true},
+		{key: "json", dataType: DataTypeJSON, value: `{"a": [1, "b"]}`, want: map[string]interface{}{"a": []interface{}{1.0, "b"}}},
+		{key: "json-missing", dataType: DataTypeJSON, want: nil},
+		{key: "json-bad", dataType: DataTypeJSON, value: `{"a":`, wantErr: true},
+		{key: "image", dataType: DataTypeImage, value: `{"Src": "/a.png", "Alt": "A", "Width": 2, "Height": 1}`, want: Image{Src: "/a.png", Alt: "A", Width: 2, Height: 1}},
+		{key: "image-src", dataType: DataTypeImage, value: `"/a.png"`, want: Image{Src: "/a.png"}},
+		{key: "image-missing", dataType: DataTypeImage, want: Image{}},
+		{key: "image-bad", dataType: DataTypeImage, value: `{"Width": "wide"}`, wantErr: true},
+		{key: "declared-bool", dataType: DataTypeInt, value: `1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.key, func(t *testing.T) {
+			is := testutil.New(t)
+			if tt.value != "" {
+				_, err := pm.dataDB.Exec("INSERT INTO pm_pagedata (locale_code, data_id, key, value) VALUES ('', ?, ?, ?)", pg.DataID, tt.key, tt.value)
+				is.NoErr(err)
+			}
+			got, err := getters[tt.dataType](pg, tt.key)
+			if tt.wantErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(tt.want, got)
+		})
+	}
+}
@@ -12,13 +12,17 @@ import (
 	"html/template"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/encrypthash"
+	"github.com/bokwoon95/pagemanager/hyforms"
 	"github.com/bokwoon95/pagemanager/sq"
 	"github.com/bokwoon95/pagemanager/tables"
 )
@@ -28,6 +32,14 @@ var templatesFS fs.FS
 var flagDatafolder = flag.String("pm-datafolder", "", "")
 var flagSuperadminFolder = flag.String("pm-superadmin", "", "")
 var flagSuperadminSetup = flag.String("pm-superadmin-setup", "", "")
+var flagMailDir = flag.String("pm-mail-dir", "", "write outgoing email into this folder instead of stdout")
+var flagUnlock = flag.String("pm-unlock", "", `how to unlock the superadmin's keys at startup: "prompt", "file:<path>" or "env:<NAME>" (default start locked)`)
+var flagArgon2Memory = flag.Uint("pm-argon2-memory", 63, "argon2id memory in MiB for new password hashes and keys")
+var flagArgon2Time = flag.Uint("pm-argon2-time", 1, "argon2id passes for new password hashes and keys")
+var flagArgon2Threads = flag.Uint("pm-argon2-threads", 4, "argon2id threads for new password hashes and keys")
+var flagCookieKeys = flag.String("pm-cookie-keys", "", "key file that cookies and CSRF tokens are signed with (default cookie.keys in the superadmin folder, created if missing)")
+var flagSiteURL = flag.String("pm-site-url", "", `the site's URL, e.g. "https://example.com", used in links sent by email (tenants use their first hostname with the same scheme)`)
+var flagSessionLifetime = flag.Duration("pm-session-lifetime", 0, "log sessions out this long after they were created, however active they are (default never)")
 var bufpool = sync.Pool{
 	New: func() interface{} { return new(bytes.Buffer) },
 }
@@ -46,17 +58,35 @@ func init() {
 }
 
 type PageManager struct {
-	themesMutex         *sync.RWMutex
-	themes              map[string]theme
-	fallbackAssetsIndex map[string]string // asset => theme name
-	datafolder          string
-	superadminfolder    string
-	dataDB              *sql.DB
-	superadminDB        *sql.DB
-	innerEncryptionKey  []byte // key-stretched from user's low-entropy password
-	innerMACKey         []byte // key-stretched from user's low-entropy password
-	localesMutex        *sync.RWMutex
-	locales             map[string]string
+	themesMutex           *sync.RWMutex
+	themes                map[string]map[string]theme  // tenant ID => theme path => theme
+	fallbackAssetsIndex   map[string]map[string]string // tenant ID => asset => theme path
+	datafolder            string
+	superadminfolder      string
+	dataDB                *sql.DB
+	superadminDB          *sql.DB
+	keysMutex             *sync.RWMutex
+	innerEncryptionKey    []byte // key-stretched from user's low-entropy password
+	innerMACKey           []byte // key-stretched from user's low-entropy password
+	encryptionKeyProvider *sqliteKeyProvider
+	macKeyProvider        *sqliteKeyProvider
+	cookieKeyProvider     encrypthash.KeyProvider // signs hyforms cookies and CSRF tokens
+	localesMutex          *sync.RWMutex
+	locales               map[string]map[string]string   // tenant ID => locale code => description
+	localeFallbacks       map[string]map[string][]string // tenant ID => locale code => fallback locale codes
+	tenantsMutex          *sync.RWMutex
+	tenantIDs             []string          // registered tenants, without the default tenant
+	tenantHosts           map[string]string // hostname => tenant ID
+	tenantSharedThemes    map[string]bool   // tenant ID => Tenant.SharedThemes, as last loaded
+	searchErr             error             // non-nil if the full-text search index is unavailable
+	blockUsages           sync.Map          // tenant ID + "\x00" + URL => recordedBlockUsages
+	auditMutex            *sync.Mutex       // serializes sealing of the audit log
+	rotationMutex         *sync.Mutex
+	loginMutex            *sync.Mutex // serializes reserving and releasing login attempts
+	rotation              KeyRotation // the current or last re-encryption job
+	mailer                Mailer
+	sessionMaxAge         time.Duration // absolute session lifetime, 0 for none
+	siteURL               *url.URL      // the default tenant's URL for links sent by email, nil if not configured
 }
 
 type Route struct {
@@ -70,12 +100,53 @@ type Route struct {
 	Template    sql.NullString
 }
 
-func New() (*PageManager, error) {
-	var err error
+// newPageManager returns a PageManager with its mutexes and maps initialized
+// but no databases.
+func newPageManager() *PageManager {
 	pm := &PageManager{}
 	pm.themesMutex = &sync.RWMutex{}
 	pm.localesMutex = &sync.RWMutex{}
-	pm.themes = make(map[string]theme)
+	pm.locales = make(map[string]map[string]string)
+	pm.localeFallbacks = make(map[string]map[string][]string)
+	pm.tenantsMutex = &sync.RWMutex{}
+	pm.tenantHosts = make(map[string]string)
+	pm.keysMutex = &sync.RWMutex{}
+	pm.auditMutex = &sync.Mutex{}
+	pm.rotationMutex = &sync.Mutex{}
+	pm.loginMutex = &sync.Mutex{}
+	pm.encryptionKeyProvider = newSQLiteKeyProvider(pm, "encryption")
+	pm.macKeyProvider = newSQLiteKeyProvider(pm, "mac")
+	pm.themes = make(map[string]map[string]theme)
+	pm.fallbackAssetsIndex = make(map[string]map[string]string)
+	pm.mailer = &WriterMailer{W: os.Stdout}
+	return pm
+}
+
+func New() (*PageManager, error) {
+	var err error
+	pm := newPageManager()
+	if *flagMailDir != "" {
+		pm.mailer = FileMailer{Dir: *flagMailDir}
+	}
+	pm.sessionMaxAge = *flagSessionLifetime
+	if *flagSiteURL != "" {
+		pm.siteURL, err = url.Parse(*flagSiteURL)
+		if err != nil || (pm.siteURL.Scheme != "http" && pm.siteURL.Scheme != "https") || pm.siteURL.Host == "" {
+			return pm, fmt.Errorf("-pm-site-url must be an http or https URL like https://example.com")
+		}
+	}
+	if *flagArgon2Threads > 255 {
+		return pm, fmt.Errorf("-pm-argon2-threads must be at most 255")
+	}
+	argon2Policy = Argon2Params{
+		Memory:  uint32(*flagArgon2Memory) * 1024,
+		Time:    uint32(*flagArgon2Time),
+		Threads: uint8(*flagArgon2Threads),
+	}
+	err = argon2Policy.validate()
+	if err != nil {
+		return pm, erro.Wrap(err)
+	}
 	pm.datafolder, err = LocateDataFolder()
 	if err != nil {
 		return pm, erro.Wrap(err)
@@ -100,44 +171,79 @@ func New() (*PageManager, error) {
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
-	ctx := context.Background()
-	err = sq.EnsureTables(pm.dataDB, "sqlite3",
-		tables.NEW_PAGES(ctx, ""),
-		tables.NEW_PAGEDATA(ctx, ""),
-		tables.NEW_USERS(ctx, ""),
-		tables.NEW_AUTHZ_GROUPS(ctx, ""),
-		tables.NEW_SESSIONS(ctx, ""),
-		tables.NEW_LOCALES(ctx, ""),
-	)
+	// Cookies and CSRF tokens are signed with a key file rather than the
+	// superadmin's MAC keys, because forms (the login form among them) have
+	// to work while those are locked.
+	cookieKeyFile := *flagCookieKeys
+	if cookieKeyFile == "" {
+		cookieKeyFile = filepath.Join(pm.superadminfolder, "cookie.keys")
+		err = encrypthash.GenerateKeyFile(cookieKeyFile)
+		if err != nil {
+			return pm, erro.Wrap(err)
+		}
+	}
+	pm.cookieKeyProvider = encrypthash.NewKeyFile(cookieKeyFile)
+	hyf, err := hyforms.New(pm.cookieKeyProvider)
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
-	err = sq.EnsureTables(pm.superadminDB, "sqlite3",
-		tables.NEW_SUPERADMIN(ctx, ""),
-		tables.NEW_ENCRYPTION_KEYS(ctx, ""),
-		tables.NEW_MAC_KEYS(ctx, ""),
+	hyf.IsSecureRequest = isSecureRequest
+	hyforms.SetDefault(hyf)
+	ctx := context.Background()
+	err = sq.EnsureTables(pm.dataDB, "sqlite3",
+		tables.NEW_TENANTS(ctx, ""),
+		tables.NEW_TENANT_HOSTS(ctx, ""),
 	)
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
-	err = seedData(ctx, pm.dataDB)
+	err = pm.loadTenants(ctx)
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
-	pm.themes, pm.fallbackAssetsIndex, err = getThemes(pm.datafolder)
+	for _, ctx := range pm.tenantContexts(ctx) {
+		err = pm.ensureTenantTables(ctx)
+		if err != nil {
+			return pm, erro.Wrap(err)
+		}
+	}
+	err = sq.EnsureTables(pm.superadminDB, "sqlite3",
+		tables.NEW_SUPERADMIN(withoutTenant(ctx), ""),
+		tables.NEW_ENCRYPTION_KEYS(withoutTenant(ctx), ""),
+		tables.NEW_MAC_KEYS(withoutTenant(ctx), ""),
+	)
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
-	pm.locales, err = getLocales(ctx, pm.dataDB)
+	err = seedData(ctx, pm.dataDB)
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
+	for _, ctx := range pm.tenantContexts(ctx) {
+		err = pm.loadThemes(ctx)
+		if err != nil {
+			return pm, erro.Wrap(err)
+		}
+		err = pm.loadLocales(ctx)
+		if err != nil {
+			return pm, erro.Wrap(err)
+		}
+	}
+	go pm.sweepSessions()
+	go pm.watchTenants()
 	if *flagSuperadminSetup != "" {
 		err = pm.setupSuperadmin()
 		if err != nil {
 			return pm, erro.Wrap(err)
 		}
 	}
+	// setupSuperadmin has already unlocked the keys
+	if pm.Locked() {
+		err = pm.unlockAtStartup(ctx, *flagUnlock)
+		if err != nil {
+			return pm, erro.Wrap(err)
+		}
+	}
 	return pm, nil
 }
 
@@ -276,20 +382,18 @@ func LocateSuperadminFolder(datafolder string) (string, error) {
 func seedData(ctx context.Context, db sq.Queryer) error {
 	p := tables.NEW_PAGES(ctx, "p")
 	db = sq.NewDB(db, nil, sq.Linterpolate|sq.Lcaller)
-	_, _, err := sq.Exec(db, sq.SQLite.DeleteFrom(p), sq.ErowsAffected)
-	if err != nil {
-		return erro.Wrap(err)
-	}
+	// everything here is only seeded if missing, so that running New() (which
+	// every CLI command does) never clobbers pages or locales that were
+	// edited or imported since
 	// pm_pages.content
-	_, _, err = sq.Exec(db, sq.SQLite.
+	_, _, err := sq.Exec(db, sq.SQLite.
 		InsertInto(p).
 		Valuesx(func(col *sq.Column) error {
 			col.SetString(p.URL, `/hello/`)
 			col.SetString(p.CONTENT, `<h1>This is hello</h1>`)
 			return nil
 		}).
-		OnConflict(p.URL).
-		DoUpdateSet(sq.SetExcluded(p.CONTENT)),
+		OnConflict().DoNothing(),
 		sq.ErowsAffected,
 	)
 	if err != nil {
@@ -303,8 +407,7 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 			col.SetString(p.HANDLER_URL, `/`)
 			return nil
 		}).
-		OnConflict(p.URL).
-		DoUpdateSet(sq.SetExcluded(p.HANDLER_URL)),
+		OnConflict().DoNothing(),
 		sq.ErowsAffected,
 	)
 	if err != nil {
@@ -326,8 +429,7 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 			}
 			return nil
 		}).
-		OnConflict(p.URL).
-		DoUpdateSet(sq.SetExcluded(p.THEME_PATH), sq.SetExcluded(p.TEMPLATE)),
+		OnConflict().DoNothing(),
 		sq.ErowsAffected,
 	)
 	if err != nil {
@@ -365,14 +467,6 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 	}
 	// pm_users, pm_authz_groups
 	u, ag := tables.NEW_USERS(ctx, "u"), tables.NEW_AUTHZ_GROUPS(ctx, "ag")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(u), sq.ErowsAffected)
-	if err != nil {
-		return erro.Wrap(err)
-	}
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(ag), sq.ErowsAffected)
-	if err != nil {
-		return erro.Wrap(err)
-	}
 	var users = []struct {
 		userid      int64
 		publicid    string
@@ -396,7 +490,8 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 				col.Set(u.AUTHZ_GROUPS, string(b))
 			}
 			return nil
-		}),
+		}).
+		OnConflict().DoNothing(),
 		sq.ErowsAffected,
 	)
 	if err != nil {
@@ -421,7 +516,8 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 				col.Set(ag.AUTHZ_DATA, string(b))
 			}
 			return nil
-		}),
+		}).
+		OnConflict().DoNothing(),
 		sq.ErowsAffected,
 	)
 	if err != nil {
@@ -429,10 +525,6 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 	}
 	// pm_locales
 	l := tables.NEW_LOCALES(ctx, "l")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(l), sq.ErowsAffected)
-	if err != nil {
-		return erro.Wrap(err)
-	}
 	var locales = []struct {
 		code        string
 		description string
@@ -447,7 +539,8 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 				col.SetString(l.DESCRIPTION, locale.description)
 			}
 			return nil
-		}),
+		}).
+		OnConflict().DoNothing(),
 		sq.ErowsAffected,
 	)
 	if err != nil {
@@ -479,27 +572,37 @@ const (
 	PageDelete
 )
 
-func getLocales(ctx context.Context, db sq.Queryer) (map[string]string, error) {
+func getLocales(ctx context.Context, db sq.Queryer) (locales map[string]string, fallbacks map[string][]string, err error) {
 	l := tables.NEW_LOCALES(ctx, "l")
 	db = sq.NewDB(db, nil, sq.Linterpolate|sq.Lcaller|sq.Lresults)
-	locales := make(map[string]string)
-	_, err := sq.Fetch(db, sq.SQLite.From(l), func(row *sq.Row) error {
+	locales, fallbacks = make(map[string]string), make(map[string][]string)
+	_, err = sq.Fetch(db, sq.SQLite.From(l), func(row *sq.Row) error {
 		localeCode := row.String(l.LOCALE_CODE)
 		description := row.String(l.DESCRIPTION)
+		b := row.Bytes(l.FALLBACKS)
 		return row.Accumulate(func() error {
 			locales[localeCode] = description
+			if len(b) == 0 {
+				return nil
+			}
+			var codes []string
+			err := json.Unmarshal(b, &codes)
+			if err != nil {
+				return erro.Wrap(fmt.Errorf("locale %s has invalid fallbacks %s: %w", localeCode, string(b), err))
+			}
+			fallbacks[localeCode] = codes
 			return nil
 		})
 	})
 	if err != nil {
-		return locales, erro.Wrap(err)
+		return locales, fallbacks, erro.Wrap(err)
 	}
-	return locales, nil
+	return locales, fallbacks, nil
 }
 
 func (pm *PageManager) setupSuperadmin() error {
 	ctx := context.Background()
-	SUPERADMIN := tables.NEW_SUPERADMIN(ctx, "")
+	SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
 	exists, err := sq.ExistsContext(ctx, pm.superadminDB, sq.SQLite.From(SUPERADMIN).Where(SUPERADMIN.ID.EqInt(1)))
 	if err != nil {
 		return erro.Wrap(err)
@@ -510,13 +613,19 @@ func (pm *PageManager) setupSuperadmin() error {
 	}
 	password, err := readPassword(`Creating the superadmin, please enter a superadmin password.
 The superadmin is needed to log into the website in order to make changes to it.
-You can always change your password by deleting the superadmin folder (located at ` + pm.superadminfolder + `) and running this setup again.
+You can change your password later with "pagemanager superadmin-password" or from /pm-superadmin/password.
 Your password will be hidden from you as you type it, do not be alarmed.
 superadmin password: `)
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	pw := string(password)
+	return pm.createSuperadmin(ctx, string(password))
+}
+
+// createSuperadmin creates the superadmin with password pw together with the
+// first encryption and MAC keys, and leaves the keys unlocked.
+func (pm *PageManager) createSuperadmin(ctx context.Context, pw string) error {
+	SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
 	passwordKeyDerivation, err := deriveKeyFromPassword(pw)
 	if err != nil {
 		return erro.Wrap(err)
@@ -545,7 +654,7 @@ superadmin password: `)
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	macKeyCiphertext, err := encrypt(pm.innerEncryptionKey, string(macKey))
+	macKeyCiphertext, err := encrypt(pm.innerMACKey, string(macKey))
 	if err != nil {
 		return erro.Wrap(err)
 	}
@@ -564,7 +673,7 @@ superadmin password: `)
 		if err != nil {
 			return erro.Wrap(err)
 		}
-		ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(ctx, "")
+		ENCRYPTION_KEYS := tables.NEW_ENCRYPTION_KEYS(withoutTenant(ctx), "")
 		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
 			InsertInto(ENCRYPTION_KEYS).
 			Valuesx(func(col *sq.Column) error {
@@ -577,7 +686,7 @@ superadmin password: `)
 		if err != nil {
 			return erro.Wrap(err)
 		}
-		MAC_KEYS := tables.NEW_MAC_KEYS(ctx, "")
+		MAC_KEYS := tables.NEW_MAC_KEYS(withoutTenant(ctx), "")
 		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
 			InsertInto(MAC_KEYS).
 			Valuesx(func(col *sq.Column) error {
@@ -0,0 +1,84 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+// cheapArgon2 makes password hashing fast for the rest of the test.
+func cheapArgon2(t *testing.T) {
+	policy := argon2Policy
+	argon2Policy = Argon2Params{Memory: 8 * 1024, Time: 1, Threads: 1}
+	t.Cleanup(func() { argon2Policy = policy })
+}
+
+// unlockTestPageManager gives pm a superadmin with the password "password"
+// and unlocks its keys.
+func unlockTestPageManager(t *testing.T, pm *PageManager) {
+	is := testutil.New(t)
+	cheapArgon2(t)
+	var err error
+	pm.superadminDB, err = sql.Open("sqlite3", filepath.Join(pm.datafolder, "superadmin.sqlite3"))
+	is.NoErr(err)
+	t.Cleanup(func() { pm.superadminDB.Close() })
+	ctx := withoutTenant(context.Background())
+	is.NoErr(sq.EnsureTables(pm.superadminDB, "sqlite3",
+		tables.NEW_SUPERADMIN(ctx, ""),
+		tables.NEW_ENCRYPTION_KEYS(ctx, ""),
+		tables.NEW_MAC_KEYS(ctx, ""),
+	))
+	is.NoErr(pm.createSuperadmin(ctx, "password"))
+	is.True(!pm.Locked())
+}
+
+func Test_seedData(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	is.NoErr(seedData(ctx, pm.dataDB))
+	// edit a seeded page and a seeded locale, then seed again as the next
+	// New() would
+	PAGES := tables.NEW_PAGES(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		Update(PAGES).
+		Setx(func(col *sq.Column) error {
+			col.SetString(PAGES.CONTENT, "<h1>edited</h1>")
+			return nil
+		}).
+		Where(PAGES.URL.EqString("/hello/")),
+		0,
+	)
+	is.NoErr(err)
+	LOCALES := tables.NEW_LOCALES(ctx, "")
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		Update(LOCALES).
+		Setx(func(col *sq.Column) error {
+			col.Set(LOCALES.FALLBACKS, `[""]`)
+			return nil
+		}).
+		Where(LOCALES.LOCALE_CODE.EqString("en")),
+		0,
+	)
+	is.NoErr(err)
+	is.NoErr(seedData(ctx, pm.dataDB))
+	var content string
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(PAGES).
+		Where(PAGES.URL.EqString("/hello/")),
+		func(row *sq.Row) error {
+			content = row.String(PAGES.CONTENT)
+			return nil
+		},
+	)
+	is.NoErr(err)
+	is.Equal("<h1>edited</h1>", content)
+	_, fallbacks, err := getLocales(ctx, pm.dataDB)
+	is.NoErr(err)
+	is.Equal([]string{""}, fallbacks["en"])
+}
@@ -0,0 +1,347 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// The search index is an SQLite FTS5 table. mattn/go-sqlite3 only includes
+// FTS5 when built with the sqlite_fts5 build tag:
+//
+//     go build -tags sqlite_fts5 ./cmd/pagemanager
+//
+// Without it pagemanager still runs, but Search returns an error and the
+// index is not maintained.
+
+// SearchResult is a single page matching a search query.
+type SearchResult struct {
+	URL     string
+	Title   string
+	Snippet template.HTML // HTML-escaped body excerpt with matches wrapped in <mark>
+}
+
+var stripTags = bluemonday.StrictPolicy()
+
+const (
+	snippetMarkStart = "\x02"
+	snippetMarkEnd   = "\x03"
+)
+
+// Search returns defaultSearchLimit results if asked for none, and never more
+// than maxSearchLimit, since the limit may come straight from a visitor.
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+)
+
+func searchLimit(limit int) int {
+	if limit <= 0 {
+		return defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		return maxSearchLimit
+	}
+	return limit
+}
+
+func ensureSearchIndex(ctx context.Context, db sq.Queryer) error {
+	SEARCH := tables.NEW_SEARCH(ctx, "")
+	_, err := db.ExecContext(ctx, "CREATE VIRTUAL TABLE IF NOT EXISTS "+SEARCH.GetName()+
+		" USING fts5(url UNINDEXED, locale_code UNINDEXED, title, body)")
+	if err != nil {
+		return erro.Wrap(fmt.Errorf("full-text search unavailable (build with -tags sqlite_fts5): %w", err))
+	}
+	return nil
+}
+
+// Search returns up to limit pages in locale matching query, best matches
+// first. query is treated as a list of words that must all appear in the
+// page; FTS5 query syntax is not interpreted. limit is clamped by
+// searchLimit.
+func (pm *PageManager) Search(ctx context.Context, query string, localeCode string, limit int) ([]SearchResult, error) {
+	if pm.searchErr != nil {
+		return nil, erro.Wrap(pm.searchErr)
+	}
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	var results []SearchResult
+	SEARCH := tables.NEW_SEARCH(ctx, "")
+	table := sq.FieldLiteral(SEARCH.GetName())
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(SEARCH).
+		Where(
+			sq.Predicatef("? MATCH ?", table, strings.Join(terms, " ")),
+			SEARCH.LOCALE_CODE.EqString(localeCode),
+		).
+		OrderBy(sq.FieldLiteral("rank")).
+		Limit(int64(searchLimit(limit))),
+		func(row *sq.Row) error {
+			var snippet string
+			result := SearchResult{
+				URL:   row.String(SEARCH.URL),
+				Title: row.String(SEARCH.TITLE),
+			}
+			row.ScanInto(&snippet, sq.Fieldf("snippet(?, 3, ?, ?, ?, 16)", table, snippetMarkStart, snippetMarkEnd, "…"))
+			return row.Accumulate(func() error {
+				snippet = html.EscapeString(snippet)
+				snippet = strings.ReplaceAll(snippet, snippetMarkStart, "<mark>")
+				snippet = strings.ReplaceAll(snippet, snippetMarkEnd, "</mark>")
+				result.Snippet = template.HTML(snippet)
+				results = append(results, result)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return results, nil
+}
+
+func (pm *PageManager) pmSearch(pg PageData, query string, limit int) ([]SearchResult, error) {
+	results, err := pm.Search(pg.Ctx, query, pg.LocaleCode, limit)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return results, nil
+}
+
+// RebuildSearchIndex discards the search index and reindexes every page.
+func (pm *PageManager) RebuildSearchIndex(ctx context.Context) error {
+	if pm.searchErr != nil {
+		return erro.Wrap(pm.searchErr)
+	}
+	var urls []string
+	PAGES := tables.NEW_PAGES(ctx, "p")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(PAGES).
+		OrderBy(PAGES.URL),
+		func(row *sq.Row) error {
+			url := row.String(PAGES.URL)
+			return row.Accumulate(func() error {
+				urls = append(urls, url)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	SEARCH := tables.NEW_SEARCH(ctx, "")
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.DeleteFrom(SEARCH), 0)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.indexPages(ctx, urls...)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// indexPages brings the search index up to date for urls. It must be called
+// after every write to pm_pages or pm_pagedata, passing the affected URLs
+// (page data is indexed under its DATA_ID). It does nothing if full-text
+// search is unavailable.
+func (pm *PageManager) indexPages(ctx context.Context, urls ...string) error {
+	if pm.searchErr != nil || len(urls) == 0 {
+		return nil
+	}
+	pm.localesMutex.RLock()
+	localeCodes := []string{""}
+	for localeCode := range pm.locales[tenantID(ctx)] {
+		localeCodes = append(localeCodes, localeCode)
+	}
+	pm.localesMutex.RUnlock()
+	err := sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		SEARCH := tables.NEW_SEARCH(ctx, "")
+		for _, url := range urls {
+			_, _, err := sq.ExecContext(ctx, tx, sq.SQLite.DeleteFrom(SEARCH).Where(SEARCH.URL.EqString(url)), 0)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			content, ok, err := searchablePage(ctx, tx, url)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			if !ok {
+				continue
+			}
+			values, err := searchablePageData(ctx, tx, url)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			for _, localeCode := range localeCodes {
+				chain := pm.localeChain(ctx, localeCode)
+				title, body := url, []string{content}
+				for _, v := range values.resolve(chain) {
+					if v.key == "title" && !v.isRow {
+						title = v.text
+						continue
+					}
+					body = append(body, v.text)
+				}
+				_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+					InsertInto(SEARCH).
+					Valuesx(func(col *sq.Column) error {
+						col.SetString(SEARCH.URL, url)
+						col.SetString(SEARCH.LOCALE_CODE, localeCode)
+						col.SetString(SEARCH.TITLE, title)
+						col.SetString(SEARCH.BODY, strings.Join(body, "\n"))
+						return nil
+					}),
+					0,
+				)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// searchablePage returns the text content of the page at url, and false if
+// the page should not appear in search results at all.
+func searchablePage(ctx context.Context, db sq.Queryer, url string) (content string, ok bool, err error) {
+	PAGES := tables.NEW_PAGES(ctx, "p")
+	_, err = sq.FetchContext(ctx, db, sq.SQLite.
+		From(PAGES).
+		Where(PAGES.URL.EqString(url)),
+		func(row *sq.Row) error {
+			disabled := row.NullBool(PAGES.DISABLED)
+			redirectURL := row.NullString(PAGES.REDIRECT_URL)
+			handlerURL := row.NullString(PAGES.HANDLER_URL)
+			pageContent := row.NullString(PAGES.CONTENT)
+			return row.Accumulate(func() error {
+				ok = !(disabled.Valid && disabled.Bool) && !redirectURL.Valid && !handlerURL.Valid
+				content = searchText(pageContent.String)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return "", false, erro.Wrap(err)
+	}
+	return content, ok, nil
+}
+
+type searchValue struct {
+	localeCode string
+	key        string
+	isRow      bool
+	text       string
+}
+
+type searchValues []searchValue
+
+// resolve picks the values a visitor in the first locale of chain would see,
+// following the same fallback rules as pmGetValue and pmGetRows.
+func (values searchValues) resolve(chain []string) []searchValue {
+	rank := make(map[string]int)
+	for i, code := range chain {
+		rank[code] = i + 1
+	}
+	best := make(map[string]string) // key => locale code
+	var keys []string
+	for _, v := range values {
+		if rank[v.localeCode] == 0 {
+			continue
+		}
+		current, ok := best[v.key]
+		if !ok {
+			keys = append(keys, v.key)
+		}
+		if !ok || rank[v.localeCode] < rank[current] {
+			best[v.key] = v.localeCode
+		}
+	}
+	var resolved []searchValue
+	for _, key := range keys {
+		for _, v := range values {
+			if v.key == key && v.localeCode == best[key] {
+				resolved = append(resolved, v)
+			}
+		}
+	}
+	return resolved
+}
+
+func searchablePageData(ctx context.Context, db sq.Queryer, dataID string) (searchValues, error) {
+	var values searchValues
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "pd")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(PAGEDATA).
+		Where(PAGEDATA.DATA_ID.EqString(dataID)).
+		OrderBy(PAGEDATA.KEY, PAGEDATA.ARRAY_INDEX),
+		func(row *sq.Row) error {
+			v := searchValue{
+				localeCode: row.String(PAGEDATA.LOCALE_CODE),
+				key:        row.String(PAGEDATA.KEY),
+				isRow:      row.NullInt64(PAGEDATA.ARRAY_INDEX).Valid,
+			}
+			b := row.Bytes(PAGEDATA.VALUE)
+			return row.Accumulate(func() error {
+				if strings.HasPrefix(string(b), sensitivePrefix) {
+					return nil // sensitive values are never indexed
+				}
+				v.text = searchText(string(b))
+				values = append(values, v)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return values, nil
+}
+
+// searchText extracts the human readable text from a page data value, which
+// may be HTML or a JSON document.
+func searchText(value string) string {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var v interface{}
+		if json.Unmarshal([]byte(trimmed), &v) == nil {
+			var texts []string
+			collectStrings(v, &texts)
+			return strings.Join(texts, " ")
+		}
+	}
+	return html.UnescapeString(stripTags.Sanitize(value))
+}
+
+func collectStrings(v interface{}, texts *[]string) {
+	switch v := v.(type) {
+	case string:
+		*texts = append(*texts, html.UnescapeString(stripTags.Sanitize(v)))
+	case []interface{}:
+		for _, item := range v {
+			collectStrings(item, texts)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			collectStrings(item, texts)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_searchLimit(t *testing.T) {
+	tests := []struct {
+		description string
+		limit       int
+		want        int
+	}{
+		{"zero", 0, defaultSearchLimit},
+		{"negative", -1, defaultSearchLimit},
+		{"within range", 5, 5},
+		{"maximum", maxSearchLimit, maxSearchLimit},
+		{"too many", maxSearchLimit + 1, maxSearchLimit},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			is := testutil.New(t)
+			is.Equal(tt.want, searchLimit(tt.limit))
+		})
+	}
+}
+
+func Test_Search(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	if pm.searchErr != nil {
+		t.Skip("full-text search unavailable, run with -tags sqlite_fts5")
+	}
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	pm.themes[""]["t"] = theme{themeTemplates: map[string]themeTemplate{
+		"tpl": {Schema: map[string]DataField{"notes": {Type: "string", Sensitive: true}}},
+	}}
+	_, err := pm.dataDB.Exec("INSERT INTO pm_pages (url, theme_path, template) VALUES ('/a', 't', 'tpl')")
+	is.NoErr(err)
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		for key, value := range map[string]string{
+			"title": "Gardening",
+			"body":  "<p>Tomatoes & <b>peppers</b> need sun</p>",
+			"notes": "secret tomatoes",
+		} {
+			raw, _ := json.Marshal(value)
+			err := pm.savePageDataKey(ctx, tx, "", "/a", key, raw, key == "notes")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+	is.NoErr(pm.indexPages(ctx, "/a"))
+
+	results, err := pm.Search(ctx, "tomatoes", "", 0)
+	is.NoErr(err)
+	is.Equal(1, len(results))
+	is.Equal("/a", results[0].URL)
+	is.Equal("Gardening", results[0].Title)
+	snippet := string(results[0].Snippet)
+	is.True(strings.Contains(snippet, "<mark>Tomatoes</mark> &amp; peppers"))
+	is.True(!strings.Contains(snippet, "<b>"))
+	// sensitive values are never indexed
+	is.True(!strings.Contains(snippet, "secret"))
+	results, err = pm.Search(ctx, "secret", "", 0)
+	is.NoErr(err)
+	is.Equal(0, len(results))
+}
@@ -0,0 +1,617 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	sessionCookieName = "pm-session"
+	// sessions expire after being unused for this long
+	sessionLifetime = 30 * 24 * time.Hour
+	// a session's expiry and last seen time are updated at most once per
+	// sessionRefreshInterval (going by its last seen time, since the absolute
+	// session lifetime can hold its expiry back), so that not every request
+	// has to write to the database
+	sessionRefreshInterval = 5 * time.Minute
+	sessionSweepInterval   = 10 * time.Minute
+)
+
+// UserKey is the request context key under which PageManager stores the
+// logged in User.
+type UserKey struct{}
+
+// User is the user that the current request's session belongs to.
+type User struct {
+	UserID       int64
+	PublicUserID string
+	Username     string
+	AuthzGroups  []string
+	Authz        Authz
+	Superadmin   bool
+	SessionData  map[string]interface{}
+	sessionHash  string
+	// tokenScope is set when the user authenticated with an API token, and
+	// further restricts what the user can do.
+	tokenScope *Authz
+	apiTokenID int64
+}
+
+// UserFromContext returns the logged in user stored in ctx, and false if no
+// one is logged in.
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(UserKey{}).(User)
+	return user, ok
+}
+
+// CurrentUser returns the user logged in for r, and false if no one is.
+func CurrentUser(r *http.Request) (User, bool) {
+	return UserFromContext(r.Context())
+}
+
+// pmUser returns the logged in user, or nil if no one is logged in.
+func pmUser(pg PageData) *User {
+	if pg.Ctx == nil {
+		return nil
+	}
+	user, ok := UserFromContext(pg.Ctx)
+	if !ok {
+		return nil
+	}
+	return &user
+}
+
+// errIncorrectPassword is returned when a login password does not match.
+var errIncorrectPassword = fmt.Errorf("incorrect password")
+
+// hashToken returns the value stored in the database for a secret token
+// (pm_sessions.SESSION_HASH, pm_password_resets.TOKEN_HASH). Only the hash is
+// stored so that a leaked database does not leak usable tokens.
+func hashToken(token string) string {
+	sum := blake2b.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// createSession stores a new session for userID, made from r, and returns its
+// token, which should be handed to the client as the session cookie.
+func (pm *PageManager) createSession(r *http.Request, userID int64, sessionData map[string]interface{}) (token string, err error) {
+	ctx := r.Context()
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	data, err := json.Marshal(sessionData)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	now := time.Now().UTC()
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		InsertInto(SESSIONS).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(SESSIONS.SESSION_HASH, hashToken(token))
+			col.SetInt64(SESSIONS.USER_ID, userID)
+			col.SetTime(SESSIONS.CREATED_AT, now)
+			col.SetTime(SESSIONS.EXPIRES_AT, pm.sessionExpiry(now, now))
+			col.Set(SESSIONS.SESSION_DATA, string(data))
+			col.SetTime(SESSIONS.LAST_SEEN_AT, now)
+			col.SetString(SESSIONS.IP, clientIP(r))
+			col.SetString(SESSIONS.USER_AGENT, r.UserAgent())
+			return nil
+		}),
+		0,
+	)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	superadmin, _ := sessionData["pm-superadmin"].(bool)
+	ctx = context.WithValue(ctx, UserKey{}, User{UserID: userID, Superadmin: superadmin})
+	pm.audit(ctx, AuditSessionCreate, auditAccount(superadmin, userID), nil)
+	return token, nil
+}
+
+// sessionExpiry returns when a session created at createdAt and last used at
+// now expires: sessionLifetime after now, but no later than the absolute
+// session lifetime allows.
+func (pm *PageManager) sessionExpiry(createdAt, now time.Time) time.Time {
+	expiresAt := now.Add(sessionLifetime)
+	if pm.sessionMaxAge > 0 && createdAt.Add(pm.sessionMaxAge).Before(expiresAt) {
+		expiresAt = createdAt.Add(pm.sessionMaxAge)
+	}
+	return expiresAt
+}
+
+// loadUser resolves the session cookie in r to a User. It returns false if
+// there is no session cookie or the session does not exist or has expired.
+func (pm *PageManager) loadUser(r *http.Request) (User, bool, error) {
+	var user User
+	c, _ := r.Cookie(sessionCookieName)
+	if c == nil || c.Value == "" {
+		return user, false, nil
+	}
+	ctx := r.Context()
+	now := time.Now().UTC()
+	var createdAt, expiresAt, lastSeenAt sql.NullTime
+	var sessionData, authzData, authzGroups []byte
+	var found bool
+	SESSIONS, USERS := tables.NEW_SESSIONS(ctx, "s"), tables.NEW_USERS(ctx, "u")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(SESSIONS).
+		LeftJoin(USERS, USERS.USER_ID.Eq(SESSIONS.USER_ID)).
+		Where(SESSIONS.SESSION_HASH.EqString(hashToken(c.Value))),
+		func(row *sq.Row) error {
+			user.UserID = row.Int64(SESSIONS.USER_ID)
+			user.PublicUserID = row.String(USERS.PUBLIC_USER_ID)
+			user.Username = row.String(USERS.USERNAME)
+			authzData = row.Bytes(USERS.AUTHZ_DATA)
+			authzGroups = row.Bytes(USERS.AUTHZ_GROUPS)
+			sessionData = row.Bytes(SESSIONS.SESSION_DATA)
+			createdAt = row.NullTime(SESSIONS.CREATED_AT)
+			expiresAt = row.NullTime(SESSIONS.EXPIRES_AT)
+			lastSeenAt = row.NullTime(SESSIONS.LAST_SEEN_AT)
+			found = true
+			return nil
+		},
+	)
+	if err != nil {
+		return user, false, erro.Wrap(err)
+	}
+	if !found || !expiresAt.Valid || !now.Before(expiresAt.Time) {
+		return user, false, nil
+	}
+	// the absolute lifetime is checked here as well as baked into EXPIRES_AT,
+	// in case it was shortened after the session was created
+	if pm.sessionMaxAge > 0 && (!createdAt.Valid || !now.Before(createdAt.Time.Add(pm.sessionMaxAge))) {
+		return user, false, nil
+	}
+	user.sessionHash = hashToken(c.Value)
+	if len(authzGroups) > 0 {
+		err = json.Unmarshal(authzGroups, &user.AuthzGroups)
+		if err != nil {
+			return user, false, erro.Wrap(err)
+		}
+	}
+	user.Authz, err = loadAuthz(ctx, pm.dataDB, authzData, user.AuthzGroups)
+	if err != nil {
+		return user, false, erro.Wrap(err)
+	}
+	user.SessionData = make(map[string]interface{})
+	if len(sessionData) > 0 {
+		err = json.Unmarshal(sessionData, &user.SessionData)
+		if err != nil {
+			return user, false, erro.Wrap(err)
+		}
+	}
+	user.Superadmin, _ = user.SessionData["pm-superadmin"].(bool)
+	if user.Superadmin && user.Username == "" {
+		user.Username = "superadmin"
+	}
+	if !lastSeenAt.Valid || now.Sub(lastSeenAt.Time) >= sessionRefreshInterval {
+		newExpiresAt := pm.sessionExpiry(createdAt.Time, now)
+		_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+			Update(SESSIONS).
+			Setx(func(col *sq.Column) error {
+				col.SetTime(SESSIONS.EXPIRES_AT, newExpiresAt)
+				col.SetTime(SESSIONS.LAST_SEEN_AT, now)
+				col.SetString(SESSIONS.IP, clientIP(r))
+				return nil
+			}).
+			Where(SESSIONS.SESSION_HASH.EqString(user.sessionHash)),
+			0,
+		)
+		if err != nil {
+			return user, false, erro.Wrap(err)
+		}
+	}
+	return user, true, nil
+}
+
+// withUser returns r with the logged in User (if any) and their session (for
+// CSRF tokens) added to its context.
+// Stale session cookies are cleared.
+func (pm *PageManager) withUser(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	user, ok, err := pm.loadUser(r)
+	if err != nil {
+		return r, erro.Wrap(err)
+	}
+	if !ok {
+		if c, _ := r.Cookie(sessionCookieName); c != nil {
+			clearSessionCookie(w, r)
+		}
+		return r, nil
+	}
+	ctx := context.WithValue(r.Context(), UserKey{}, user)
+	// bind hyforms' CSRF tokens to the session
+	ctx = context.WithValue(ctx, hyforms.CSRFSessionKey{}, user.sessionHash)
+	return r.WithContext(ctx), nil
+}
+
+// sweepSessions periodically deletes expired sessions, stale login attempts
+// and the block usages of deleted pages, and seals the audit log, in every
+// tenant. It never returns.
+func (pm *PageManager) sweepSessions() {
+	for range time.Tick(sessionSweepInterval) {
+		for _, ctx := range pm.tenantContexts(context.Background()) {
+			err := pm.deleteExpiredSessions(ctx)
+			if err != nil {
+				log.Println(err)
+			}
+			err = pm.deleteStaleLoginAttempts(ctx)
+			if err != nil {
+				log.Println(err)
+			}
+			err = pm.deleteStaleBlockUsages(ctx)
+			if err != nil {
+				log.Println(err)
+			}
+			err = pm.sealAuditLog(ctx)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (pm *PageManager) deleteExpiredSessions(ctx context.Context) error {
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(sq.Or(
+			SESSIONS.EXPIRES_AT.IsNull(),
+			SESSIONS.EXPIRES_AT.LeTime(time.Now().UTC()),
+		)),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func (pm *PageManager) deleteSession(ctx context.Context, token string) error {
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(SESSIONS.SESSION_HASH.EqString(hashToken(token))),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// isSecureRequest reports whether r reached us (or the reverse proxy in front
+// of us) over HTTPS, in which case cookies should be marked Secure.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// setSessionCookie hands token to the client. Persistent cookies survive a
+// browser restart, non-persistent cookies are dropped when the browser closes.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, persistent bool) {
+	c := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if persistent {
+		c.MaxAge = int(sessionLifetime / time.Second)
+	}
+	http.SetCookie(w, c)
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// unlockSuperadmin checks password against the superadmin's password hash
+// and, if it matches, re-derives the inner encryption and MAC keys from it.
+// If the hash or keys were derived with weaker parameters than argon2Policy
+// they are upgraded. It returns errIncorrectPassword if the password does not
+// match.
+func (pm *PageManager) unlockSuperadmin(ctx context.Context, password string) error {
+	var passwordHash, encryptionKeyParams, macKeyParams sql.NullString
+	SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
+	_, err := sq.FetchContext(ctx, pm.superadminDB, sq.SQLite.
+		From(SUPERADMIN).
+		Where(SUPERADMIN.ID.EqInt(1)),
+		func(row *sq.Row) error {
+			passwordHash = row.NullString(SUPERADMIN.PASSWORD_HASH)
+			encryptionKeyParams = row.NullString(SUPERADMIN.ENCRYPTION_KEY_PARAMETERS)
+			macKeyParams = row.NullString(SUPERADMIN.MAC_KEY_PARAMETERS)
+			return nil
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !passwordHash.Valid {
+		return erro.Wrap(fmt.Errorf("superadmin has not been set up, run pagemanager with -pm-superadmin-setup"))
+	}
+	err = verifyHashAndPassword(passwordHash.String, password)
+	if errors.Is(err, errPasswordHashingBusy) {
+		return err
+	}
+	if err != nil {
+		return errIncorrectPassword
+	}
+	innerEncryptionKey, err := deriveKeyFromParams(encryptionKeyParams.String, password)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	innerMACKey, err := deriveKeyFromParams(macKeyParams.String, password)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	migrated, err := migrateMACKeys(ctx, pm.superadminDB, innerEncryptionKey, innerMACKey)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if migrated > 0 {
+		log.Printf("rewrapped %d MAC keys that were wrapped with the inner encryption key", migrated)
+	}
+	pm.keysMutex.Lock()
+	pm.innerEncryptionKey = innerEncryptionKey
+	pm.innerMACKey = innerMACKey
+	pm.keysMutex.Unlock()
+	if weakerThanPolicy(passwordHash.String) || weakerThanPolicy(encryptionKeyParams.String) || weakerThanPolicy(macKeyParams.String) {
+		// a failed upgrade is retried on the next login
+		err = pm.rewrapSuperadminKeys(ctx, password, password)
+		if err != nil {
+			log.Printf("upgrading the superadmin's argon2 parameters: %s", err)
+		}
+	}
+	// entries written while the keys were locked can be sealed now
+	err = pm.sealAuditLog(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// UnlockFromTerminal asks for the superadmin password on the terminal and
+// unlocks the keys with it, for commands that need them. It does nothing if
+// the keys were already unlocked by -pm-unlock.
+func (pm *PageManager) UnlockFromTerminal(ctx context.Context) error {
+	if !pm.Locked() {
+		return nil
+	}
+	password, err := readPassword("superadmin password: ")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return pm.unlockSuperadmin(ctx, string(password))
+}
+
+// ChangeSuperadminPasswordFromTerminal asks for the current and new superadmin
+// passwords on the terminal and changes the password.
+func (pm *PageManager) ChangeSuperadminPasswordFromTerminal(ctx context.Context) error {
+	oldPassword, err := readPassword("current superadmin password: ")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	newPassword, err := readPassword("new superadmin password: ")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	confirmPassword, err := readPassword("confirm new superadmin password: ")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if string(newPassword) != string(confirmPassword) {
+		return fmt.Errorf("passwords do not match")
+	}
+	return pm.ChangeSuperadminPassword(ctx, string(oldPassword), string(newPassword))
+}
+
+func (pm *PageManager) logout(w http.ResponseWriter, r *http.Request) {
+	// a GET would let any page log its visitors out with an <img> tag
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+	c, _ := r.Cookie(sessionCookieName)
+	if c != nil && c.Value != "" {
+		err := pm.deleteSession(r.Context(), c.Value)
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		if user, ok := CurrentUser(r); ok {
+			pm.audit(r.Context(), AuditSessionRevoke, auditAccount(user.Superadmin, user.UserID), map[string]interface{}{"reason": "logout"})
+		}
+	}
+	clearSessionCookie(w, r)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Session is an active session, as shown to its owner.
+type Session struct {
+	// ID identifies the session for RevokeSession. It is the hash of the
+	// session token, not the token itself.
+	ID         string
+	CreatedAt  time.Time
+	LastSeenAt sql.NullTime
+	ExpiresAt  time.Time
+	IP         string
+	UserAgent  string
+	Current    bool
+}
+
+// Sessions returns userID's active sessions, most recently seen first.
+// currentID is the ID of the session making the request, if any.
+func (pm *PageManager) Sessions(ctx context.Context, userID int64, currentID string) ([]Session, error) {
+	var sessions []Session
+	now := time.Now().UTC()
+	SESSIONS := tables.NEW_SESSIONS(ctx, "s")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(SESSIONS).
+		Where(
+			SESSIONS.USER_ID.EqInt64(userID),
+			SESSIONS.EXPIRES_AT.GtTime(now),
+		).
+		OrderBy(SESSIONS.LAST_SEEN_AT.Desc(), SESSIONS.CREATED_AT.Desc()),
+		func(row *sq.Row) error {
+			session := Session{
+				ID:         row.String(SESSIONS.SESSION_HASH),
+				CreatedAt:  row.Time(SESSIONS.CREATED_AT),
+				LastSeenAt: row.NullTime(SESSIONS.LAST_SEEN_AT),
+				ExpiresAt:  row.Time(SESSIONS.EXPIRES_AT),
+				IP:         row.String(SESSIONS.IP),
+				UserAgent:  row.String(SESSIONS.USER_AGENT),
+			}
+			return row.Accumulate(func() error {
+				if pm.sessionMaxAge > 0 && !now.Before(session.CreatedAt.Add(pm.sessionMaxAge)) {
+					return nil
+				}
+				session.Current = session.ID == currentID
+				sessions = append(sessions, session)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return sessions, nil
+}
+
+// RevokeSession logs out one of userID's sessions.
+func (pm *PageManager) RevokeSession(ctx context.Context, userID int64, sessionID string) error {
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(
+			SESSIONS.SESSION_HASH.EqString(sessionID),
+			SESSIONS.USER_ID.EqInt64(userID),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return erro.Wrap(fmt.Errorf("no such session"))
+	}
+	return nil
+}
+
+// RevokeOtherSessions logs out all of userID's sessions except keepID, and
+// returns how many were logged out.
+func (pm *PageManager) RevokeOtherSessions(ctx context.Context, userID int64, keepID string) (int64, error) {
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(
+			SESSIONS.USER_ID.EqInt64(userID),
+			SESSIONS.SESSION_HASH.NeString(keepID),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	return rowsAffected, nil
+}
+
+// sessionsPage lists the logged in user's sessions and lets them log any of
+// them out.
+func (pm *PageManager) sessionsPage(w http.ResponseWriter, r *http.Request) {
+	const errorCookieName = "pm-sessions-error"
+	type Data struct {
+		Sessions  []Session
+		Lifetime  time.Duration
+		Error     string
+		CSRFToken string
+	}
+	user, ok := CurrentUser(r)
+	if !ok {
+		http.Redirect(w, r, "/pm-login", http.StatusFound)
+		return
+	}
+	account := auditAccount(user.Superadmin, user.UserID)
+	if r.Method == "POST" {
+		if !checkCSRF(w, r) {
+			return
+		}
+		if r.FormValue("revoke-others") != "" {
+			n, err := pm.RevokeOtherSessions(r.Context(), user.UserID, user.sessionHash)
+			if err != nil {
+				http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+				return
+			}
+			pm.audit(r.Context(), AuditSessionRevoke, account, map[string]interface{}{"reason": "revoke others", "sessions": n})
+			http.Redirect(w, r, "/pm-sessions", http.StatusFound)
+			return
+		}
+		sessionID := r.FormValue("revoke")
+		err := pm.RevokeSession(r.Context(), user.UserID, sessionID)
+		if err != nil {
+			_ = hyforms.CookieSet(w, errorCookieName, err.Error(), nil)
+			http.Redirect(w, r, "/pm-sessions", http.StatusFound)
+			return
+		}
+		pm.audit(r.Context(), AuditSessionRevoke, account, map[string]interface{}{"reason": "revoke", "current": sessionID == user.sessionHash})
+		if sessionID == user.sessionHash {
+			clearSessionCookie(w, r)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/pm-sessions", http.StatusFound)
+		return
+	}
+	data := Data{Lifetime: pm.sessionMaxAge}
+	_ = hyforms.CookiePop(w, r, errorCookieName, &data.Error)
+	var err error
+	data.CSRFToken, err = hyforms.CSRFToken(w, r)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Sessions, err = pm.Sessions(r.Context(), user.UserID, user.sessionHash)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := pm.parseTemplates(templatesFS, "sessions.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, data)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
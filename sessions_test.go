@@ -0,0 +1,116 @@
+package pagemanager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_logout(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	for method, status := range map[string]int{
+		"GET":  http.StatusMethodNotAllowed,
+		"POST": http.StatusForbidden, // no CSRF token
+	} {
+		r := httptest.NewRequest(method, "/pm-logout", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "token"})
+		w := httptest.NewRecorder()
+		pm.logout(w, r)
+		is.Equal(status, w.Code)
+		is.Equal(0, len(w.Result().Cookies()))
+	}
+}
+
+func Test_sessionExpiry(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	now := time.Now().UTC()
+	is.Equal(now.Add(sessionLifetime), pm.sessionExpiry(now.Add(-365*24*time.Hour), now))
+	pm.sessionMaxAge = 24 * time.Hour
+	is.Equal(now.Add(23*time.Hour), pm.sessionExpiry(now.Add(-time.Hour), now))
+	pm.sessionMaxAge = 60 * 24 * time.Hour
+	is.Equal(now.Add(sessionLifetime), pm.sessionExpiry(now.Add(-time.Hour), now))
+}
+
+func Test_Sessions(t *testing.T) {
+	is := testutil.New(t)
+	cheapArgon2(t)
+	pm := newTestPageManager(t)
+	pm.sessionMaxAge = 24 * time.Hour
+	ctx := context.Background()
+	aliceID, err := pm.CreateUser(ctx, "alice", "alice@example.com", "correct horse battery staple")
+	is.NoErr(err)
+	bobID, err := pm.CreateUser(ctx, "bob", "bob@example.com", "correct horse battery staple")
+	is.NoErr(err)
+	newSession := func(userID int64) string {
+		token, err := pm.createSession(httptest.NewRequest("GET", "/", nil), userID, nil)
+		is.NoErr(err)
+		return token
+	}
+	lastSeen := func(token string) (t time.Time) {
+		is.NoErr(pm.dataDB.QueryRow("SELECT last_seen_at FROM pm_sessions WHERE session_hash = ?", hashToken(token)).Scan(&t))
+		return t
+	}
+	setLastSeen := func(token string, t time.Time) {
+		_, err := pm.dataDB.Exec("UPDATE pm_sessions SET last_seen_at = ? WHERE session_hash = ?", t, hashToken(token))
+		is.NoErr(err)
+	}
+	load := func(token string) bool {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		_, ok, err := pm.loadUser(r)
+		is.NoErr(err)
+		return ok
+	}
+	current, other, expired, bobs := newSession(aliceID), newSession(aliceID), newSession(aliceID), newSession(bobID)
+	_, err = pm.dataDB.Exec("UPDATE pm_sessions SET created_at = ? WHERE session_hash = ?", time.Now().UTC().Add(-25*time.Hour), hashToken(expired))
+	is.NoErr(err)
+
+	t.Run("refresh", func(t *testing.T) {
+		is := testutil.New(t)
+		// EXPIRES_AT is held back by the absolute lifetime, so it cannot
+		// tell a session that was just refreshed from one that was not
+		seen := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+		setLastSeen(current, seen)
+		is.True(load(current))
+		is.True(lastSeen(current).Equal(seen))
+		setLastSeen(current, seen.Add(-sessionRefreshInterval))
+		is.True(load(current))
+		is.True(lastSeen(current).After(seen))
+		is.True(!load(expired))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		is := testutil.New(t)
+		setLastSeen(other, time.Now().UTC().Add(-time.Hour))
+		sessions, err := pm.Sessions(ctx, aliceID, hashToken(current))
+		is.NoErr(err)
+		is.Equal(2, len(sessions))
+		is.Equal(hashToken(current), sessions[0].ID)
+		is.True(sessions[0].Current)
+		is.Equal(hashToken(other), sessions[1].ID)
+		is.True(!sessions[1].Current)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		is := testutil.New(t)
+		// a user cannot revoke someone else's session
+		is.True(pm.RevokeSession(ctx, aliceID, hashToken(bobs)) != nil)
+		is.True(load(bobs))
+		is.NoErr(pm.RevokeSession(ctx, aliceID, hashToken(other)))
+		is.True(!load(other))
+		is.True(pm.RevokeSession(ctx, aliceID, hashToken(other)) != nil)
+		another := newSession(aliceID)
+		n, err := pm.RevokeOtherSessions(ctx, aliceID, hashToken(current))
+		is.NoErr(err)
+		is.Equal(int64(2), n) // another and expired
+		is.True(load(current))
+		is.True(!load(another))
+		is.True(load(bobs))
+	})
+}
@@ -14,6 +14,9 @@ type PM_SUPERADMIN struct {
 	PASSWORD_HASH             sq.StringField
 	ENCRYPTION_KEY_PARAMETERS sq.StringField
 	MAC_KEY_PARAMETERS        sq.StringField
+	TOTP_SECRET_CIPHERTEXT    sq.StringField
+	TOTP_RECOVERY_CODES       sq.JSONField
+	TOTP_LAST_STEP            sq.NumberField
 }
 
 func NEW_SUPERADMIN(ctx context.Context, alias string) PM_SUPERADMIN {
@@ -117,10 +120,15 @@ type PM_USERS struct {
 	USER_ID        sq.NumberField `sq:"type=INTEGER misc=PRIMARY_KEY"`
 	PUBLIC_USER_ID sq.StringField `sq:"type=TEXT misc=NOT_NULL,UNIQUE"`
 	USERNAME       sq.StringField
+	EMAIL          sq.StringField
 	PASSWORD_HASH  sq.StringField
 	AUTHZ_DATA     sq.JSONField
 	AUTHZ_GROUPS   sq.JSONField
 	USER_DATA      sq.JSONField
+	// two-factor authentication
+	TOTP_SECRET_CIPHERTEXT sq.StringField
+	TOTP_RECOVERY_CODES    sq.JSONField // JSON array of hashed one-time recovery codes
+	TOTP_LAST_STEP         sq.NumberField
 }
 
 func NEW_USERS(ctx context.Context, alias string) PM_USERS {
@@ -156,7 +164,11 @@ type PM_SESSIONS struct {
 	SESSION_HASH sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
 	USER_ID      sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
 	CREATED_AT   sq.TimeField
+	EXPIRES_AT   sq.TimeField
 	SESSION_DATA sq.JSONField
+	LAST_SEEN_AT sq.TimeField
+	IP           sq.StringField
+	USER_AGENT   sq.StringField
 }
 
 func NEW_SESSIONS(ctx context.Context, alias string) PM_SESSIONS {
@@ -174,6 +186,7 @@ type PM_LOCALES struct {
 	sq.TableInfo
 	LOCALE_CODE sq.StringField `sq:"type=TEXT misc=PRIMARY_KEY"`
 	DESCRIPTION sq.StringField
+	FALLBACKS   sq.JSONField // JSON array of locale codes to try, in order, when a key is missing
 }
 
 func NEW_LOCALES(ctx context.Context, alias string) PM_LOCALES {
@@ -186,3 +199,210 @@ func NEW_LOCALES(ctx context.Context, alias string) PM_LOCALES {
 	_ = sq.ReflectTable(&tbl)
 	return tbl
 }
+
+// PM_SEARCH is an FTS5 virtual table and cannot be created with
+// sq.EnsureTables, see the pagemanager package for its DDL.
+type PM_SEARCH struct {
+	sq.TableInfo
+	URL         sq.StringField
+	LOCALE_CODE sq.StringField
+	TITLE       sq.StringField
+	BODY        sq.StringField
+}
+
+func NEW_SEARCH(ctx context.Context, alias string) PM_SEARCH {
+	tbl := PM_SEARCH{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_search"
+	} else {
+		tbl.TableInfo.Name = "pm_search"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+type PM_BLOCKS struct {
+	sq.TableInfo
+	NAME        sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
+	DESCRIPTION sq.StringField
+	CREATED_AT  sq.TimeField
+}
+
+func NEW_BLOCKS(ctx context.Context, alias string) PM_BLOCKS {
+	tbl := PM_BLOCKS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_blocks"
+	} else {
+		tbl.TableInfo.Name = "pm_blocks"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+// PM_BLOCK_USAGES records which page URLs have rendered which blocks.
+type PM_BLOCK_USAGES struct {
+	sq.TableInfo
+	BLOCK_NAME   sq.StringField `sq:"misc=NOT_NULL"`
+	URL          sq.StringField `sq:"misc=NOT_NULL"`
+	LAST_USED_AT sq.TimeField
+}
+
+func NEW_BLOCK_USAGES(ctx context.Context, alias string) PM_BLOCK_USAGES {
+	tbl := PM_BLOCK_USAGES{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_block_usages"
+	} else {
+		tbl.TableInfo.Name = "pm_block_usages"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+// PM_PASSWORD_RESETS holds outstanding password reset tokens. Only a hash of
+// each token is stored.
+type PM_PASSWORD_RESETS struct {
+	sq.TableInfo
+	TOKEN_HASH sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
+	USER_ID    sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	CREATED_AT sq.TimeField
+	EXPIRES_AT sq.TimeField
+	USED_AT    sq.TimeField
+}
+
+func NEW_PASSWORD_RESETS(ctx context.Context, alias string) PM_PASSWORD_RESETS {
+	tbl := PM_PASSWORD_RESETS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_password_resets"
+	} else {
+		tbl.TableInfo.Name = "pm_password_resets"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+// PM_LOGIN_ATTEMPTS counts recent failed logins per throttle key, which is
+// either "ip:<address>" or "account:<login>".
+type PM_LOGIN_ATTEMPTS struct {
+	sq.TableInfo
+	ATTEMPT_KEY     sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
+	FAILURES        sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	LAST_FAILURE_AT sq.TimeField
+	LOCKED_UNTIL    sq.TimeField
+}
+
+func NEW_LOGIN_ATTEMPTS(ctx context.Context, alias string) PM_LOGIN_ATTEMPTS {
+	tbl := PM_LOGIN_ATTEMPTS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_login_attempts"
+	} else {
+		tbl.TableInfo.Name = "pm_login_attempts"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+// PM_LOGIN_LOCKOUTS is an append-only record of every lockout.
+type PM_LOGIN_LOCKOUTS struct {
+	sq.TableInfo
+	LOCKOUT_ID   sq.NumberField `sq:"type=INTEGER misc=PRIMARY_KEY"`
+	ATTEMPT_KEY  sq.StringField `sq:"type=TEXT misc=NOT_NULL"`
+	FAILURES     sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	LOCKED_AT    sq.TimeField
+	LOCKED_UNTIL sq.TimeField
+}
+
+func NEW_LOGIN_LOCKOUTS(ctx context.Context, alias string) PM_LOGIN_LOCKOUTS {
+	tbl := PM_LOGIN_LOCKOUTS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_login_lockouts"
+	} else {
+		tbl.TableInfo.Name = "pm_login_lockouts"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+// PM_API_TOKENS holds the bearer tokens accepted by the /pm-api/ JSON API.
+// Only a hash of each token is stored. AUTHZ_DATA has the same shape as
+// pm_users.AUTHZ_DATA and narrows down (never widens) what the token's user
+// may do.
+type PM_API_TOKENS struct {
+	sq.TableInfo
+	TOKEN_ID     sq.NumberField `sq:"type=INTEGER misc=PRIMARY_KEY"`
+	TOKEN_HASH   sq.StringField `sq:"type=TEXT misc=NOT_NULL,UNIQUE"`
+	USER_ID      sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	NAME         sq.StringField
+	AUTHZ_DATA   sq.JSONField
+	CREATED_AT   sq.TimeField
+	EXPIRES_AT   sq.TimeField
+	LAST_USED_AT sq.TimeField
+}
+
+func NEW_API_TOKENS(ctx context.Context, alias string) PM_API_TOKENS {
+	tbl := PM_API_TOKENS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_api_tokens"
+	} else {
+		tbl.TableInfo.Name = "pm_api_tokens"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+// PM_AUDIT_LOG is an append-only record of who did what. Each entry's MAC
+// covers the entry and the previous entry's MAC, so that editing, deleting
+// or reordering entries breaks the chain. MAC is NULL until the entry has
+// been sealed, which needs the MAC keys to be unlocked.
+type PM_AUDIT_LOG struct {
+	sq.TableInfo
+	AUDIT_ID      sq.NumberField `sq:"type=INTEGER misc=PRIMARY_KEY"`
+	CREATED_AT    sq.TimeField   `sq:"misc=NOT_NULL"`
+	ACTION        sq.StringField `sq:"type=TEXT misc=NOT_NULL"`
+	ACTOR         sq.StringField
+	ACTOR_USER_ID sq.NumberField
+	IP            sq.StringField
+	TARGET        sq.StringField
+	PAYLOAD       sq.JSONField
+	MAC           sq.StringField
+}
+
+func NEW_AUDIT_LOG(ctx context.Context, alias string) PM_AUDIT_LOG {
+	tbl := PM_AUDIT_LOG{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_audit_log"
+	} else {
+		tbl.TableInfo.Name = "pm_audit_log"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+// PM_TENANTS and PM_TENANT_HOSTS make up the tenant registry. There is one
+// registry per installation, so unlike every other table their names do not
+// depend on TenantIDKey.
+type PM_TENANTS struct {
+	sq.TableInfo
+	TENANT_ID     sq.StringField `sq:"type=TEXT misc=PRIMARY_KEY"`
+	CREATED_AT    sq.TimeField
+	SHARED_THEMES sq.BooleanField // whether the tenant can use the shared themes
+}
+
+func NEW_TENANTS(ctx context.Context, alias string) PM_TENANTS {
+	tbl := PM_TENANTS{TableInfo: sq.TableInfo{Alias: alias}}
+	tbl.TableInfo.Name = "pm_tenants"
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+type PM_TENANT_HOSTS struct {
+	sq.TableInfo
+	HOSTNAME  sq.StringField `sq:"type=TEXT misc=PRIMARY_KEY"`
+	TENANT_ID sq.StringField `sq:"type=TEXT misc=NOT_NULL"`
+}
+
+func NEW_TENANT_HOSTS(ctx context.Context, alias string) PM_TENANT_HOSTS {
+	tbl := PM_TENANT_HOSTS{TableInfo: sq.TableInfo{Alias: alias}}
+	tbl.TableInfo.Name = "pm_tenant_hosts"
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
@@ -0,0 +1,558 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Tenants are separate sites served by one PageManager, told apart by the
+// hostname of the request. Every tenant has its own copy of the tables in the
+// data database, named pm_<tenant ID>_<table> (see tables.TenantIDKey), its
+// own locales and its own folder under pm-tenants in the data folder, holding
+// its pm-themes and pm-images folders. Tenants can opt into the themes in the
+// shared themes folder, pm-shared/pm-themes in the data folder. The
+// superadmin and the encryption and MAC keys are shared by all tenants.
+// Requests for hostnames missing from the registry are served by the default
+// tenant, whose tenant ID is "" and whose tables are the unprefixed ones. The
+// default tenant always uses the shared themes.
+
+// tenantIDPattern keeps tenant IDs safe to splice into table names. Tenant
+// IDs have no underscores so that no two tenants' table names can collide.
+var tenantIDPattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,31}$`)
+
+// Tenant is an entry in the tenant registry.
+type Tenant struct {
+	TenantID     string
+	Hostnames    []string
+	CreatedAt    sql.NullTime
+	SharedThemes bool
+}
+
+// WithTenant returns a copy of ctx whose tables belong to the tenant
+// tenantID. Use "" for the default tenant.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tables.TenantIDKey{}, tenantID)
+}
+
+// tenantID returns the tenant ID in ctx, "" for the default tenant.
+func tenantID(ctx context.Context) string {
+	id, _ := ctx.Value(tables.TenantIDKey{}).(string)
+	return id
+}
+
+// withoutTenant returns ctx for the tables of the superadmin database, which
+// are shared by all tenants.
+func withoutTenant(ctx context.Context) context.Context {
+	return WithTenant(ctx, "")
+}
+
+// normalizeHostname strips the port and trailing dot from host and lowercases
+// it.
+func normalizeHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ResolveTenant is middleware that looks up the request's hostname in the
+// tenant registry and injects its tenant ID into the request context.
+// PageManager applies it already; it only needs to be used directly for
+// handlers that are not wrapped by PageManager.
+func (pm *PageManager) ResolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pm.tenantsMutex.RLock()
+		id := pm.tenantHosts[normalizeHostname(r.Host)]
+		pm.tenantsMutex.RUnlock()
+		next.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), id)))
+	})
+}
+
+// TenantFolder returns the folder holding the files of the tenant id. The
+// default tenant's folder is the data folder itself.
+func (pm *PageManager) TenantFolder(id string) string {
+	if id == "" {
+		return pm.datafolder
+	}
+	return filepath.Join(pm.datafolder, "pm-tenants", id)
+}
+
+// tenantContexts returns a copy of ctx for the default tenant followed by one
+// for each registered tenant, for work that has to be done in every tenant.
+func (pm *PageManager) tenantContexts(ctx context.Context) []context.Context {
+	pm.tenantsMutex.RLock()
+	defer pm.tenantsMutex.RUnlock()
+	ctxs := make([]context.Context, 0, len(pm.tenantIDs)+1)
+	ctxs = append(ctxs, WithTenant(ctx, ""))
+	for _, id := range pm.tenantIDs {
+		ctxs = append(ctxs, WithTenant(ctx, id))
+	}
+	return ctxs
+}
+
+// ensureTenantTables creates the tables of the tenant in ctx if they do not
+// exist yet.
+func (pm *PageManager) ensureTenantTables(ctx context.Context) error {
+	err := sq.EnsureTables(pm.dataDB, "sqlite3",
+		tables.NEW_PAGES(ctx, ""),
+		tables.NEW_PAGEDATA(ctx, ""),
+		tables.NEW_USERS(ctx, ""),
+		tables.NEW_AUTHZ_GROUPS(ctx, ""),
+		tables.NEW_SESSIONS(ctx, ""),
+		tables.NEW_LOCALES(ctx, ""),
+		tables.NEW_BLOCKS(ctx, ""),
+		tables.NEW_BLOCK_USAGES(ctx, ""),
+		tables.NEW_PASSWORD_RESETS(ctx, ""),
+		tables.NEW_LOGIN_ATTEMPTS(ctx, ""),
+		tables.NEW_LOGIN_LOCKOUTS(ctx, ""),
+		tables.NEW_API_TOKENS(ctx, ""),
+		tables.NEW_AUDIT_LOG(ctx, ""),
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = ensureAuditLogTriggers(ctx, pm.dataDB)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = ensureBlockUsagesIndex(ctx, pm.dataDB)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	// whether full-text search is available is decided by the default
+	// tenant, the other tenants only need their own index when it is
+	if tenantID(ctx) == "" {
+		pm.searchErr = ensureSearchIndex(ctx, pm.dataDB)
+	} else if pm.searchErr == nil {
+		err = ensureSearchIndex(ctx, pm.dataDB)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// loadLocales reads the locales of the tenant in ctx into pm.locales and
+// pm.localeFallbacks.
+func (pm *PageManager) loadLocales(ctx context.Context) error {
+	locales, localeFallbacks, err := getLocales(ctx, pm.dataDB)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	id := tenantID(ctx)
+	pm.localesMutex.Lock()
+	pm.locales[id], pm.localeFallbacks[id] = locales, localeFallbacks
+	pm.localesMutex.Unlock()
+	return nil
+}
+
+// tenantReloadInterval is how often a running PageManager rereads the tenant
+// registry, so that tenants created, changed or deleted from the command line
+// are picked up without a restart.
+const tenantReloadInterval = time.Minute
+
+// loadTenants reads the tenant registry into pm.tenantIDs and pm.tenantHosts.
+func (pm *PageManager) loadTenants(ctx context.Context) error {
+	tenants, err := pm.Tenants(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.setTenants(tenants)
+	return nil
+}
+
+func (pm *PageManager) setTenants(tenants []Tenant) {
+	tenantIDs := make([]string, 0, len(tenants))
+	tenantHosts := make(map[string]string)
+	tenantSharedThemes := make(map[string]bool)
+	for _, tenant := range tenants {
+		tenantIDs = append(tenantIDs, tenant.TenantID)
+		for _, hostname := range tenant.Hostnames {
+			tenantHosts[hostname] = tenant.TenantID
+		}
+		tenantSharedThemes[tenant.TenantID] = tenant.SharedThemes
+	}
+	pm.tenantsMutex.Lock()
+	pm.tenantIDs, pm.tenantHosts, pm.tenantSharedThemes = tenantIDs, tenantHosts, tenantSharedThemes
+	pm.tenantsMutex.Unlock()
+}
+
+// reloadTenants rereads the tenant registry. Tenants that are new get their
+// locales and themes loaded, tenants whose shared themes setting changed get
+// their themes reloaded, and tenants that are gone are forgotten so that
+// their hostnames go back to the default tenant.
+func (pm *PageManager) reloadTenants(ctx context.Context) error {
+	tenants, err := pm.Tenants(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.tenantsMutex.RLock()
+	known := make(map[string]bool, len(pm.tenantSharedThemes))
+	for id, shared := range pm.tenantSharedThemes {
+		known[id] = shared
+	}
+	pm.tenantsMutex.RUnlock()
+	for _, tenant := range tenants {
+		shared, ok := known[tenant.TenantID]
+		delete(known, tenant.TenantID)
+		if ok && shared == tenant.SharedThemes {
+			continue
+		}
+		tenantCtx := WithTenant(ctx, tenant.TenantID)
+		if !ok {
+			err = pm.ensureTenantTables(tenantCtx)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			err = pm.loadLocales(tenantCtx)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		err = pm.loadThemes(tenantCtx)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	for id := range known {
+		pm.forgetTenant(id)
+	}
+	pm.setTenants(tenants)
+	return nil
+}
+
+// watchTenants reloads the tenant registry every tenantReloadInterval. It
+// never returns.
+func (pm *PageManager) watchTenants() {
+	for range time.Tick(tenantReloadInterval) {
+		err := pm.reloadTenants(context.Background())
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// forgetTenant drops the locales and themes of the deleted tenant id.
+func (pm *PageManager) forgetTenant(id string) {
+	pm.localesMutex.Lock()
+	delete(pm.locales, id)
+	delete(pm.localeFallbacks, id)
+	pm.localesMutex.Unlock()
+	pm.themesMutex.Lock()
+	delete(pm.themes, id)
+	delete(pm.fallbackAssetsIndex, id)
+	pm.themesMutex.Unlock()
+}
+
+// Tenants lists the registered tenants, ordered by tenant ID. The default
+// tenant is not included.
+func (pm *PageManager) Tenants(ctx context.Context) ([]Tenant, error) {
+	var tenants []Tenant
+	index := make(map[string]int)
+	TENANTS := tables.NEW_TENANTS(ctx, "")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(TENANTS).
+		OrderBy(TENANTS.TENANT_ID),
+		func(row *sq.Row) error {
+			tenant := Tenant{
+				TenantID:     row.String(TENANTS.TENANT_ID),
+				CreatedAt:    row.NullTime(TENANTS.CREATED_AT),
+				SharedThemes: row.Bool(TENANTS.SHARED_THEMES),
+			}
+			return row.Accumulate(func() error {
+				index[tenant.TenantID] = len(tenants)
+				tenants = append(tenants, tenant)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	TENANT_HOSTS := tables.NEW_TENANT_HOSTS(ctx, "")
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(TENANT_HOSTS).
+		OrderBy(TENANT_HOSTS.HOSTNAME),
+		func(row *sq.Row) error {
+			hostname := row.String(TENANT_HOSTS.HOSTNAME)
+			id := row.String(TENANT_HOSTS.TENANT_ID)
+			return row.Accumulate(func() error {
+				if i, ok := index[id]; ok {
+					tenants[i].Hostnames = append(tenants[i].Hostnames, hostname)
+				}
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return tenants, nil
+}
+
+// CreateTenant registers the tenant id, served for the given hostnames, and
+// creates its tables and folders. Hostnames must not already belong to
+// another tenant.
+// A PageManager running in another process starts serving the tenant
+// within tenantReloadInterval.
+func (pm *PageManager) CreateTenant(ctx context.Context, id string, hostnames []string) error {
+	if !tenantIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid tenant ID %q: must be a lowercase letter followed by up to 31 lowercase letters or digits", id)
+	}
+	if len(hostnames) == 0 {
+		return fmt.Errorf("tenant %s needs at least one hostname", id)
+	}
+	hostnames = append([]string(nil), hostnames...)
+	for i, hostname := range hostnames {
+		hostnames[i] = normalizeHostname(hostname)
+		if hostnames[i] == "" {
+			return fmt.Errorf("empty hostname for tenant %s", id)
+		}
+	}
+	TENANTS := tables.NEW_TENANTS(ctx, "")
+	TENANT_HOSTS := tables.NEW_TENANT_HOSTS(ctx, "")
+	err := sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		exists, err := sq.ExistsContext(ctx, tx, sq.SQLite.From(TENANTS).Where(TENANTS.TENANT_ID.EqString(id)))
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if exists {
+			return fmt.Errorf("tenant %s already exists", id)
+		}
+		exists, err = sq.ExistsContext(ctx, tx, sq.SQLite.From(TENANT_HOSTS).Where(TENANT_HOSTS.HOSTNAME.In(hostnames)))
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if exists {
+			return fmt.Errorf("some of the hostnames %v already belong to a tenant", hostnames)
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(TENANTS).
+			Valuesx(func(col *sq.Column) error {
+				col.SetString(TENANTS.TENANT_ID, id)
+				col.SetTime(TENANTS.CREATED_AT, time.Now().UTC())
+				return nil
+			}),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(TENANT_HOSTS).
+			Valuesx(func(col *sq.Column) error {
+				for _, hostname := range hostnames {
+					col.SetString(TENANT_HOSTS.HOSTNAME, hostname)
+					col.SetString(TENANT_HOSTS.TENANT_ID, id)
+				}
+				return nil
+			}),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tenantCtx := WithTenant(ctx, id)
+	err = pm.ensureTenantTables(tenantCtx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for _, dir := range []string{"pm-themes", "pm-images"} {
+		err = os.MkdirAll(filepath.Join(pm.TenantFolder(id), dir), 0755)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	err = pm.loadLocales(tenantCtx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.loadThemes(tenantCtx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.loadTenants(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.audit(withoutTenant(ctx), AuditTenantCreate, id, map[string]interface{}{"hostnames": hostnames})
+	return nil
+}
+
+// DeleteTenant unregisters the tenant id and drops its tables, which deletes
+// all of its pages, users and audit log. The tenant's folder is left on disk.
+// A PageManager running in another process keeps routing the tenant's
+// hostnames to the dropped tables, failing every request, for up to
+// tenantReloadInterval.
+func (pm *PageManager) DeleteTenant(ctx context.Context, id string) error {
+	if id == "" {
+		return fmt.Errorf("the default tenant cannot be deleted")
+	}
+	tenantCtx := WithTenant(ctx, id)
+	names := []string{
+		tables.NEW_SEARCH(tenantCtx, "").GetName(),
+		tables.NEW_PAGES(tenantCtx, "").GetName(),
+		tables.NEW_PAGEDATA(tenantCtx, "").GetName(),
+		tables.NEW_USERS(tenantCtx, "").GetName(),
+		tables.NEW_AUTHZ_GROUPS(tenantCtx, "").GetName(),
+		tables.NEW_SESSIONS(tenantCtx, "").GetName(),
+		tables.NEW_LOCALES(tenantCtx, "").GetName(),
+		tables.NEW_BLOCKS(tenantCtx, "").GetName(),
+		tables.NEW_BLOCK_USAGES(tenantCtx, "").GetName(),
+		tables.NEW_PASSWORD_RESETS(tenantCtx, "").GetName(),
+		tables.NEW_LOGIN_ATTEMPTS(tenantCtx, "").GetName(),
+		tables.NEW_LOGIN_LOCKOUTS(tenantCtx, "").GetName(),
+		tables.NEW_API_TOKENS(tenantCtx, "").GetName(),
+		tables.NEW_AUDIT_LOG(tenantCtx, "").GetName(),
+	}
+	TENANTS := tables.NEW_TENANTS(ctx, "")
+	TENANT_HOSTS := tables.NEW_TENANT_HOSTS(ctx, "")
+	err := sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		rowsAffected, _, err := sq.ExecContext(ctx, tx, sq.SQLite.
+			DeleteFrom(TENANTS).
+			Where(TENANTS.TENANT_ID.EqString(id)),
+			sq.ErowsAffected,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("tenant %s does not exist", id)
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			DeleteFrom(TENANT_HOSTS).
+			Where(TENANT_HOSTS.TENANT_ID.EqString(id)),
+			0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		// the names come from tenantIDPattern and the tables package, so
+		// they are safe to splice in
+		for _, name := range names {
+			_, err = tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+name)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	pm.forgetTenant(id)
+	err = pm.loadTenants(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.audit(withoutTenant(ctx), AuditTenantDelete, id, nil)
+	return nil
+}
+
+// usesSharedThemes reports whether the tenant in ctx uses the shared themes.
+func (pm *PageManager) usesSharedThemes(ctx context.Context) (bool, error) {
+	id := tenantID(ctx)
+	if id == "" {
+		return true, nil
+	}
+	var shared bool
+	TENANTS := tables.NEW_TENANTS(ctx, "")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(TENANTS).
+		Where(TENANTS.TENANT_ID.EqString(id)),
+		func(row *sq.Row) error {
+			shared = row.Bool(TENANTS.SHARED_THEMES)
+			return nil
+		},
+	)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	return shared, nil
+}
+
+// SetSharedThemes sets whether the tenant id can use the shared themes, and
+// reloads its themes.
+func (pm *PageManager) SetSharedThemes(ctx context.Context, id string, shared bool) error {
+	if id == "" {
+		return fmt.Errorf("the default tenant always uses the shared themes")
+	}
+	TENANTS := tables.NEW_TENANTS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		Update(TENANTS).
+		Setx(func(col *sq.Column) error {
+			col.SetBool(TENANTS.SHARED_THEMES, shared)
+			return nil
+		}).
+		Where(TENANTS.TENANT_ID.EqString(id)),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("tenant %s does not exist", id)
+	}
+	err = pm.loadThemes(WithTenant(ctx, id))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// tenantURL returns the URL of the tenant in ctx without a trailing slash, for
+// links that are sent by email and so cannot be relative. It is never taken
+// from the request, whose Host header is chosen by the client: the default
+// tenant uses -pm-site-url, other tenants their first registered hostname.
+func (pm *PageManager) tenantURL(ctx context.Context) (string, error) {
+	id := tenantID(ctx)
+	scheme := "https"
+	if pm.siteURL != nil {
+		scheme = pm.siteURL.Scheme
+	}
+	if id == "" {
+		if pm.siteURL == nil {
+			return "", fmt.Errorf("the site URL is not configured, start pagemanager with -pm-site-url")
+		}
+		return scheme + "://" + pm.siteURL.Host + strings.TrimSuffix(pm.siteURL.Path, "/"), nil
+	}
+	var hostname string
+	TENANT_HOSTS := tables.NEW_TENANT_HOSTS(ctx, "")
+	ROWID := sq.NewNumberField("rowid", TENANT_HOSTS.TableInfo)
+	rowCount, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(TENANT_HOSTS).
+		Where(TENANT_HOSTS.TENANT_ID.EqString(id)).
+		OrderBy(ROWID).
+		Limit(1),
+		func(row *sq.Row) error {
+			hostname = row.String(TENANT_HOSTS.HOSTNAME)
+			return nil
+		},
+	)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	if rowCount == 0 {
+		return "", fmt.Errorf("tenant %s has no hostname", id)
+	}
+	return scheme + "://" + hostname, nil
+}
@@ -0,0 +1,308 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func newTestPageManager(t *testing.T) *PageManager {
+	is := testutil.New(t)
+	pm := newPageManager()
+	pm.datafolder = t.TempDir()
+	var err error
+	pm.dataDB, err = sql.Open("sqlite3", filepath.Join(pm.datafolder, "database.sqlite3?_foreign_keys=on"))
+	is.NoErr(err)
+	t.Cleanup(func() { pm.dataDB.Close() })
+	ctx := context.Background()
+	is.NoErr(sq.EnsureTables(pm.dataDB, "sqlite3", tables.NEW_TENANTS(ctx, ""), tables.NEW_TENANT_HOSTS(ctx, "")))
+	is.NoErr(pm.ensureTenantTables(ctx))
+	is.NoErr(pm.loadLocales(ctx))
+	is.NoErr(pm.loadThemes(ctx))
+	return pm
+}
+
+func Test_Tenants(t *testing.T) {
+	is := testutil.New(t)
+	policy := argon2Policy
+	argon2Policy = Argon2Params{Memory: 8 * 1024, Time: 1, Threads: 1}
+	defer func() { argon2Policy = policy }()
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	is.NoErr(pm.CreateTenant(ctx, "alpha", []string{"Alpha.example.com", "www.alpha.example.com"}))
+	is.NoErr(pm.CreateTenant(ctx, "beta", []string{"beta.example.com"}))
+	alphaCtx, betaCtx := WithTenant(ctx, "alpha"), WithTenant(ctx, "beta")
+
+	t.Run("registry", func(t *testing.T) {
+		is := testutil.New(t)
+		for _, id := range []string{"", "Gamma", "ga_mma", "1gamma", strings.Repeat("g", 33)} {
+			is.True(pm.CreateTenant(ctx, id, []string{"gamma.example.com"}) != nil)
+		}
+		is.True(pm.CreateTenant(ctx, "alpha", []string{"gamma.example.com"}) != nil)
+		is.True(pm.CreateTenant(ctx, "gamma", []string{"alpha.example.com"}) != nil)
+		is.True(pm.CreateTenant(ctx, "gamma", nil) != nil)
+		tenants, err := pm.Tenants(ctx)
+		is.NoErr(err)
+		is.Equal(2, len(tenants))
+		is.Equal("alpha", tenants[0].TenantID)
+		is.Equal([]string{"alpha.example.com", "www.alpha.example.com"}, tenants[0].Hostnames)
+		is.Equal("beta", tenants[1].TenantID)
+		is.Equal([]string{"beta.example.com"}, tenants[1].Hostnames)
+		for _, dir := range []string{"pm-themes", "pm-images"} {
+			_, err := os.Stat(filepath.Join(pm.datafolder, "pm-tenants", "alpha", dir))
+			is.NoErr(err)
+		}
+		// links sent by email never come from the Host header
+		_, err = pm.tenantURL(ctx)
+		is.True(err != nil)
+		pm.siteURL, err = url.Parse("http://example.com/")
+		is.NoErr(err)
+		defer func() { pm.siteURL = nil }()
+		siteURL, err := pm.tenantURL(ctx)
+		is.NoErr(err)
+		is.Equal("http://example.com", siteURL)
+		siteURL, err = pm.tenantURL(alphaCtx)
+		is.NoErr(err)
+		is.Equal("http://alpha.example.com", siteURL)
+	})
+
+	t.Run("middleware", func(t *testing.T) {
+		is := testutil.New(t)
+		var got string
+		handler := pm.ResolveTenant(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = tenantID(r.Context())
+		}))
+		for host, want := range map[string]string{
+			"alpha.example.com":      "alpha",
+			"ALPHA.example.com:8080": "alpha",
+			"www.alpha.example.com.": "alpha",
+			"beta.example.com":       "beta",
+			"example.com":            "",
+			"localhost:80":           "",
+		} {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = host
+			// a tenant ID already in the context must not survive
+			r = r.WithContext(WithTenant(r.Context(), "beta"))
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			is.Equal(want, got)
+		}
+	})
+
+	PAGES := tables.NEW_PAGES(alphaCtx, "")
+	_, _, err := sq.ExecContext(alphaCtx, pm.dataDB, sq.SQLite.
+		InsertInto(PAGES).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(PAGES.URL, "/secret/")
+			col.SetString(PAGES.CONTENT, "alpha's secret")
+			return nil
+		}),
+		0,
+	)
+	is.NoErr(err)
+	is.NoErr(sq.WithTxContext(alphaCtx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		return pm.savePageDataKey(alphaCtx, tx, "", "/secret/", "title", []byte(`"alpha's title"`), false)
+	}))
+	LOCALES := tables.NEW_LOCALES(alphaCtx, "")
+	_, _, err = sq.ExecContext(alphaCtx, pm.dataDB, sq.SQLite.
+		InsertInto(LOCALES).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(LOCALES.LOCALE_CODE, "fr")
+			col.SetString(LOCALES.DESCRIPTION, "French")
+			return nil
+		}),
+		0,
+	)
+	is.NoErr(err)
+	is.NoErr(pm.loadLocales(alphaCtx))
+	alphaUserID, err := pm.CreateUser(alphaCtx, "alice", "alice@example.com", "correct horse battery staple")
+	is.NoErr(err)
+	is.NoErr(pm.Audit(alphaCtx, AuditPageCreate, "/secret/", nil))
+
+	t.Run("isolation", func(t *testing.T) {
+		for _, ctx := range []context.Context{betaCtx, ctx} {
+			is := testutil.New(t)
+			buf := &bytes.Buffer{}
+			is.NoErr(pm.Export(ctx, buf, ContentFilter{}))
+			is.True(!strings.Contains(buf.String(), "secret"))
+			is.True(!strings.Contains(buf.String(), "alpha's"))
+			_, err := pm.UserIDByUsername(ctx, "alice")
+			is.True(err != nil)
+			route, err := pm.getRoute(ctx, "/fr/secret/")
+			is.NoErr(err)
+			is.Equal("", route.LocaleCode)
+			is.True(!route.Content.Valid)
+			entries, err := pm.AuditLog(ctx, AuditFilter{})
+			is.NoErr(err)
+			for _, entry := range entries {
+				is.True(entry.Target != "/secret/")
+			}
+		}
+		// the same username can be taken in every tenant
+		betaUserID, err := pm.CreateUser(betaCtx, "alice", "alice@example.com", "correct horse battery staple")
+		is.NoErr(err)
+		userID, err := pm.UserIDByUsername(alphaCtx, "alice")
+		is.NoErr(err)
+		is.Equal(alphaUserID, userID)
+		userID, err = pm.UserIDByUsername(betaCtx, "alice")
+		is.NoErr(err)
+		is.Equal(betaUserID, userID)
+		// alpha itself still sees its own rows
+		route, err := pm.getRoute(alphaCtx, "/fr/secret/")
+		is.NoErr(err)
+		is.Equal("fr", route.LocaleCode)
+		is.Equal("alpha's secret", route.Content.String)
+		buf := &bytes.Buffer{}
+		is.NoErr(pm.Export(alphaCtx, buf, ContentFilter{}))
+		is.True(strings.Contains(buf.String(), "alpha's title"))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		is := testutil.New(t)
+		is.True(pm.DeleteTenant(ctx, "") != nil)
+		is.True(pm.DeleteTenant(ctx, "gamma") != nil)
+		is.NoErr(pm.DeleteTenant(ctx, "alpha"))
+		tenants, err := pm.Tenants(ctx)
+		is.NoErr(err)
+		is.Equal(1, len(tenants))
+		is.Equal("beta", tenants[0].TenantID)
+		_, err = pm.UserIDByUsername(alphaCtx, "alice")
+		is.True(err != nil)
+		_, err = pm.UserIDByUsername(betaCtx, "alice")
+		is.NoErr(err)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "alpha.example.com"
+		pm.ResolveTenant(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			is.Equal("", tenantID(r.Context()))
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		// the ID and hostnames can be reused, starting from empty tables
+		is.NoErr(pm.CreateTenant(ctx, "alpha", []string{"alpha.example.com"}))
+		_, err = pm.UserIDByUsername(alphaCtx, "alice")
+		is.True(err != nil)
+	})
+}
+
+func Test_reloadTenants(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	// the command line is another PageManager on the same database
+	cli := newPageManager()
+	cli.datafolder, cli.dataDB, cli.searchErr = pm.datafolder, pm.dataDB, pm.searchErr
+	is.NoErr(cli.loadTenants(ctx))
+	resolve := func(host string) (id string) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		pm.ResolveTenant(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id = tenantID(r.Context())
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		return id
+	}
+
+	is.NoErr(cli.CreateTenant(ctx, "alpha", []string{"alpha.example.com"}))
+	is.Equal("", resolve("alpha.example.com"))
+	is.NoErr(pm.reloadTenants(ctx))
+	is.Equal("alpha", resolve("alpha.example.com"))
+	is.Equal(2, len(pm.tenantContexts(ctx)))
+	pm.localesMutex.RLock()
+	_, ok := pm.locales["alpha"]
+	pm.localesMutex.RUnlock()
+	is.True(ok)
+
+	is.NoErr(cli.SetSharedThemes(ctx, "alpha", true))
+	is.NoErr(pm.reloadTenants(ctx))
+	is.True(pm.tenantSharedThemes["alpha"])
+
+	is.NoErr(cli.DeleteTenant(ctx, "alpha"))
+	is.NoErr(pm.reloadTenants(ctx))
+	is.Equal("", resolve("alpha.example.com"))
+	is.Equal(1, len(pm.tenantContexts(ctx)))
+	pm.localesMutex.RLock()
+	_, ok = pm.locales["alpha"]
+	pm.localesMutex.RUnlock()
+	is.True(!ok)
+}
+
+func Test_TenantThemes(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	is.NoErr(pm.CreateTenant(ctx, "alpha", []string{"alpha.example.com"}))
+	is.NoErr(pm.CreateTenant(ctx, "beta", []string{"beta.example.com"}))
+	files := map[string]string{
+		"pm-themes/plain/theme-config.js":                  `return {Name: "Plain"}`,
+		"pm-themes/plain/index.css":                        "default plain",
+		"pm-tenants/alpha/pm-themes/plain/theme-config.js": `return {Name: "Plain"}`,
+		"pm-tenants/alpha/pm-themes/plain/index.css":       "alpha plain",
+		"pm-tenants/alpha/pm-images/logo.png":              "alpha logo",
+		"pm-shared/pm-themes/plain/theme-config.js":        `return {Name: "Plain"}`,
+		"pm-shared/pm-themes/plain/index.css":              "shared plain",
+		"pm-shared/pm-themes/fancy/theme-config.js":        `return {Name: "Fancy", FallbackAssets: {"/pm-images/banner.png": "banner.png"}}`,
+		"pm-shared/pm-themes/fancy/index.css":              "shared fancy",
+		"pm-shared/pm-themes/fancy/banner.png":             "shared banner",
+	}
+	for name, content := range files {
+		name = filepath.Join(pm.datafolder, filepath.FromSlash(name))
+		is.NoErr(os.MkdirAll(filepath.Dir(name), 0755))
+		is.NoErr(os.WriteFile(name, []byte(content), 0644))
+	}
+	is.NoErr(pm.SetSharedThemes(ctx, "alpha", true))
+	for _, ctx := range pm.tenantContexts(ctx) {
+		is.NoErr(pm.loadThemes(ctx))
+	}
+	handler := pm.PageManager(http.NotFoundHandler())
+	get := func(host, path string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			return strconv.Itoa(w.Code)
+		}
+		return w.Body.String()
+	}
+	const alpha, beta, other = "alpha.example.com", "beta.example.com", "example.com"
+
+	// a tenant's own theme wins over a shared one with the same path
+	is.Equal("alpha plain", get(alpha, "/pm-themes/plain/index.css"))
+	is.Equal("default plain", get(other, "/pm-themes/plain/index.css"))
+	is.Equal("404", get(beta, "/pm-themes/plain/index.css"))
+	// shared themes are only served to tenants that use them
+	is.Equal("shared fancy", get(alpha, "/pm-themes/fancy/index.css"))
+	is.Equal("shared fancy", get(other, "/pm-themes/fancy/index.css"))
+	is.Equal("404", get(beta, "/pm-themes/fancy/index.css"))
+	// images are never shared
+	is.Equal("alpha logo", get(alpha, "/pm-images/logo.png"))
+	is.Equal("404", get(beta, "/pm-images/logo.png"))
+	is.Equal("404", get(other, "/pm-images/logo.png"))
+	is.Equal("404", get(other, "/pm-tenants/alpha/pm-images/logo.png"))
+	// fallback assets of shared themes
+	is.Equal("shared banner", get(alpha, "/pm-images/banner.png"))
+	is.Equal("404", get(beta, "/pm-images/banner.png"))
+
+	is.NoErr(pm.SetSharedThemes(ctx, "beta", true))
+	is.Equal("shared plain", get(beta, "/pm-themes/plain/index.css"))
+	is.Equal("shared fancy", get(beta, "/pm-themes/fancy/index.css"))
+	is.Equal("shared banner", get(beta, "/pm-images/banner.png"))
+	is.NoErr(pm.SetSharedThemes(ctx, "alpha", false))
+	is.Equal("404", get(alpha, "/pm-themes/fancy/index.css"))
+	is.Equal("alpha plain", get(alpha, "/pm-themes/plain/index.css"))
+	is.True(pm.SetSharedThemes(ctx, "", false) != nil)
+	is.True(pm.SetSharedThemes(ctx, "gamma", true) != nil)
+	tenants, err := pm.Tenants(ctx)
+	is.NoErr(err)
+	is.Equal(false, tenants[0].SharedThemes)
+	is.Equal(true, tenants[1].SharedThemes)
+}
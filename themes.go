@@ -1,6 +1,7 @@
 package pagemanager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -33,22 +34,32 @@ type themeTemplate struct {
 	JS                    []Asset
 	TemplateVariables     map[string]interface{}
 	ContentSecurityPolicy map[string][]string
+	Schema                map[string]DataField
 }
 
 type theme struct {
 	err            error  // any error encountered when parsing theme-config.js
+	folder         string // the folder holding the "pm-themes" folder the theme is in
 	path           string // path to the theme folder in the "pm-themes" folder
 	name           string
 	description    string
 	fallbackAssets map[string]string
 	themeTemplates map[string]themeTemplate
+	schema         map[string]DataField // schema shared by all templates in the theme
 }
 
+// getThemes reads the themes in the "pm-themes" folder of datafolder, which
+// may be the data folder, a tenant's folder or the shared themes folder. A
+// missing "pm-themes" folder holds no themes.
 func getThemes(datafolder string) (themes map[string]theme, fallbackAssetsIndex map[string]string, err error) {
 	themes, fallbackAssetsIndex = make(map[string]theme), make(map[string]string)
 	if datafolder == "" {
 		return themes, fallbackAssetsIndex, erro.Wrap(fmt.Errorf("pm.datafolder is empty"))
 	}
+	_, err = os.Stat(filepath.Join(datafolder, "pm-themes"))
+	if errors.Is(err, os.ErrNotExist) {
+		return themes, fallbackAssetsIndex, nil
+	}
 	err = filepath.WalkDir(filepath.Join(datafolder, "pm-themes"), func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -68,9 +79,11 @@ func getThemes(datafolder string) (themes map[string]theme, fallbackAssetsIndex
 			cwd = strings.ReplaceAll(cwd, `\`, `/`) // theme_path is always stored with unix-style forward slashes
 		}
 		t := theme{
+			folder:         datafolder,
 			path:           strings.TrimPrefix(cwd, "/pm-themes/"),
 			fallbackAssets: make(map[string]string),
 			themeTemplates: make(map[string]themeTemplate),
+			schema:         make(map[string]DataField),
 		}
 		vm := goja.New()
 		vm.Set("$THEME_PATH", cwd+"/")
@@ -95,6 +108,65 @@ func getThemes(datafolder string) (themes map[string]theme, fallbackAssetsIndex
 	return themes, fallbackAssetsIndex, nil
 }
 
+// sharedThemesFolder returns the folder holding the "pm-themes" folder of
+// the themes that tenants can share.
+func (pm *PageManager) sharedThemesFolder() string {
+	return filepath.Join(pm.datafolder, "pm-shared")
+}
+
+// loadThemes reads the themes of the tenant in ctx into pm.themes and
+// pm.fallbackAssetsIndex, together with the shared themes if the tenant uses
+// them. The tenant's own themes and fallback assets win over shared ones with
+// the same path.
+func (pm *PageManager) loadThemes(ctx context.Context) error {
+	id := tenantID(ctx)
+	themes, fallbackAssetsIndex, err := getThemes(pm.TenantFolder(id))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	shared, err := pm.usesSharedThemes(ctx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if shared {
+		sharedThemes, sharedFallbackAssetsIndex, err := getThemes(pm.sharedThemesFolder())
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for themePath, t := range sharedThemes {
+			if _, ok := themes[themePath]; !ok {
+				themes[themePath] = t
+			}
+		}
+		for asset, themePath := range sharedFallbackAssetsIndex {
+			_, ok := fallbackAssetsIndex[asset]
+			if !ok && themes[themePath].folder == pm.sharedThemesFolder() {
+				fallbackAssetsIndex[asset] = themePath
+			}
+		}
+	}
+	pm.themesMutex.Lock()
+	pm.themes[id], pm.fallbackAssetsIndex[id] = themes, fallbackAssetsIndex
+	pm.themesMutex.Unlock()
+	return nil
+}
+
+// assetFolder returns the folder that name, a path in the "pm-themes" or
+// "pm-images" folder, is served from for the tenant in ctx. Files of a shared
+// theme come from the shared themes folder, everything else from the
+// tenant's folder.
+func (pm *PageManager) assetFolder(ctx context.Context, name string) string {
+	id := tenantID(ctx)
+	pm.themesMutex.RLock()
+	defer pm.themesMutex.RUnlock()
+	for themePath, t := range pm.themes[id] {
+		if strings.HasPrefix(name, "pm-themes/"+themePath+"/") {
+			return t.folder
+		}
+	}
+	return pm.TenantFolder(id)
+}
+
 func (t *theme) Unmarshal(data interface{}) {
 	data2, ok := data.(map[string]interface{})
 	if !ok {
@@ -115,11 +187,14 @@ func (t *theme) Unmarshal(data interface{}) {
 			t.fallbackAssets[asset] = themePath + "/" + fallback
 		}
 	}
+	schema, _ := data2["Schema"].(map[string]interface{})
+	unmarshalSchema(t.schema, schema)
 	templates, _ := data2["Templates"].(map[string]interface{})
 	for templateName, __template__ := range templates {
 		tt := themeTemplate{
 			TemplateVariables:     make(map[string]interface{}),
 			ContentSecurityPolicy: make(map[string][]string),
+			Schema:                make(map[string]DataField),
 		}
 		template, _ := __template__.(map[string]interface{})
 		HTMLs, _ := template["HTML"].([]interface{})
@@ -184,6 +259,35 @@ func (t *theme) Unmarshal(data interface{}) {
 				tt.ContentSecurityPolicy[name] = append(tt.ContentSecurityPolicy[name], policy)
 			}
 		}
+		// template-level schema entries take precedence over theme-level ones
+		for key, field := range t.schema {
+			tt.Schema[key] = field
+		}
+		schema, _ := template["Schema"].(map[string]interface{})
+		unmarshalSchema(tt.Schema, schema)
 		t.themeTemplates[templateName] = tt
 	}
 }
+
+// unmarshalSchema reads a theme-config.js schema into dest. Each key may be
+// declared either as a bare type string e.g. {title: "string"} or as an
+// object e.g. {title: {Type: "string"}} or {notes: {Type: "string",
+// Sensitive: true}}.
+func unmarshalSchema(dest map[string]DataField, schema map[string]interface{}) {
+	for key, __field__ := range schema {
+		var field DataField
+		switch f := __field__.(type) {
+		case string:
+			field.Type = f
+		case map[string]interface{}:
+			field.Type, _ = f["Type"].(string)
+			field.Sensitive, _ = f["Sensitive"].(bool)
+		default:
+			continue
+		}
+		if field.Type == "" {
+			field.Type = DataTypeString
+		}
+		dest[key] = field
+	}
+}
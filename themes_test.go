@@ -0,0 +1,53 @@
+package pagemanager
+
+import (
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_unmarshalSchema(t *testing.T) {
+	tests := []struct {
+		description string
+		schema      map[string]interface{}
+		want        map[string]DataField
+	}{
+		{
+			description: "type names",
+			schema:      map[string]interface{}{"title": "string", "count": "int"},
+			want:        map[string]DataField{"title": {Type: DataTypeString}, "count": {Type: DataTypeInt}},
+		},
+		{
+			description: "objects",
+			schema: map[string]interface{}{
+				"notes":  map[string]interface{}{"Type": "string", "Sensitive": true},
+				"avatar": map[string]interface{}{"Type": "image"},
+			},
+			want: map[string]DataField{"notes": {Type: DataTypeString, Sensitive: true}, "avatar": {Type: DataTypeImage}},
+		},
+		{
+			description: "type defaults to string",
+			schema:      map[string]interface{}{"a": "", "b": map[string]interface{}{"Sensitive": true}},
+			want:        map[string]DataField{"a": {Type: DataTypeString}, "b": {Type: DataTypeString, Sensitive: true}},
+		},
+		{
+			description: "wrongly typed attributes are ignored",
+			schema:      map[string]interface{}{"a": map[string]interface{}{"Type": 5, "Sensitive": "yes"}},
+			want:        map[string]DataField{"a": {Type: DataTypeString}},
+		},
+		{
+			description: "other values are skipped",
+			schema:      map[string]interface{}{"a": 5.0, "b": nil, "c": []interface{}{"int"}},
+			want:        map[string]DataField{},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			is := testutil.New(t)
+			got := make(map[string]DataField)
+			unmarshalSchema(got, tt.schema)
+			is.Equal(tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Failed logins are counted both per client IP and per account. After
+// loginFreeAttempts failures a key is locked for loginBackoffBase, doubling
+// with every further failure up to loginMaxBackoff. The counts live in
+// pm_login_attempts so that restarting the server does not reset them.
+const (
+	loginFreeAttempts = 3
+	loginBackoffBase  = time.Second
+	loginMaxBackoff   = time.Hour
+	// failures at or beyond this count are recorded in pm_login_lockouts
+	loginLockoutThreshold = 10
+	// failures older than this are forgotten
+	loginFailureWindow = 24 * time.Hour
+)
+
+// loginLockedError is returned instead of checking a password while the IP or
+// account is locked.
+type loginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *loginLockedError) Error() string {
+	retryAfter := e.RetryAfter.Truncate(time.Second) + time.Second
+	return fmt.Sprintf("too many failed login attempts, please try again in %s", retryAfter)
+}
+
+// clientIP returns the IP address r came from. X-Forwarded-For is ignored
+// because anyone can set it to dodge the per-IP limit.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginBackoff returns how long a key is locked after its nth failure.
+func loginBackoff(failures int) time.Duration {
+	if failures < loginFreeAttempts {
+		return 0
+	}
+	shift := failures - loginFreeAttempts
+	if shift >= 32 {
+		return loginMaxBackoff
+	}
+	backoff := loginBackoffBase << uint(shift)
+	if backoff > loginMaxBackoff {
+		return loginMaxBackoff
+	}
+	return backoff
+}
+
+// throttleLogin runs fn, which checks the credentials for account, unless ip
+// or account is locked. Every attempt is counted as a failure before fn runs,
+// so that concurrent guesses cannot slip past the lockout while fn is busy.
+// fn returning errIncorrectPassword leaves the failure counted, fn returning
+// nil clears the account's failures. The IP's earlier failures are left to
+// expire so that an attacker cannot reset them by logging into an account of
+// their own.
+func (pm *PageManager) throttleLogin(ctx context.Context, ip, account string, fn func() error) error {
+	return pm.throttlePasswordCheck(ctx, ip, account, AuditLoginSuccess, fn)
+}
+
+// throttlePasswordCheck is throttleLogin for password checks that are not
+// logins, such as confirming the current password before changing it. The
+// success action is audited when fn succeeds; it may be empty if fn audits
+// what it did itself.
+func (pm *PageManager) throttlePasswordCheck(ctx context.Context, ip, account, successAction string, fn func() error) error {
+	keys := []string{"ip:" + ip, "account:" + strings.ToLower(account)}
+	retryAfter, err := pm.reserveLoginAttempt(ctx, keys)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if retryAfter > 0 {
+		pm.audit(ctx, AuditLoginLocked, account, map[string]interface{}{"retry_after": retryAfter.String()})
+		return &loginLockedError{RetryAfter: retryAfter}
+	}
+	err = fn()
+	if errors.Is(err, errIncorrectPassword) {
+		pm.audit(ctx, AuditLoginFailure, account, nil)
+		return err
+	}
+	if err != nil {
+		// the credentials were never checked, so the attempt does not count
+		releaseErr := pm.releaseLoginAttempt(ctx, keys)
+		if releaseErr != nil {
+			log.Println(releaseErr)
+		}
+		return err
+	}
+	if successAction != "" {
+		pm.audit(ctx, successAction, account, nil)
+	}
+	err = pm.releaseLoginAttempt(ctx, keys[:1])
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	LOGIN_ATTEMPTS := tables.NEW_LOGIN_ATTEMPTS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(LOGIN_ATTEMPTS).
+		Where(LOGIN_ATTEMPTS.ATTEMPT_KEY.EqString(keys[1])),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// reserveLoginAttempt counts a failure against every key, unless one of them
+// is locked in which case nothing is counted and how much longer the most
+// locked key stays locked is returned. Reservations are serialized so that
+// no two attempts can both see a key as unlocked.
+func (pm *PageManager) reserveLoginAttempt(ctx context.Context, keys []string) (retryAfter time.Duration, err error) {
+	pm.loginMutex.Lock()
+	defer pm.loginMutex.Unlock()
+	now := time.Now().UTC()
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		type attempt struct {
+			failures      int
+			lastFailureAt sql.NullTime
+		}
+		attempts := make(map[string]attempt)
+		LOGIN_ATTEMPTS := tables.NEW_LOGIN_ATTEMPTS(ctx, "")
+		LOGIN_LOCKOUTS := tables.NEW_LOGIN_LOCKOUTS(ctx, "")
+		_, err := sq.FetchContext(ctx, tx, sq.SQLite.
+			From(LOGIN_ATTEMPTS).
+			Where(LOGIN_ATTEMPTS.ATTEMPT_KEY.In(keys)),
+			func(row *sq.Row) error {
+				key := row.String(LOGIN_ATTEMPTS.ATTEMPT_KEY)
+				a := attempt{
+					failures:      row.Int(LOGIN_ATTEMPTS.FAILURES),
+					lastFailureAt: row.NullTime(LOGIN_ATTEMPTS.LAST_FAILURE_AT),
+				}
+				lockedUntil := row.NullTime(LOGIN_ATTEMPTS.LOCKED_UNTIL)
+				return row.Accumulate(func() error {
+					attempts[key] = a
+					if lockedUntil.Valid && lockedUntil.Time.Sub(now) > retryAfter {
+						retryAfter = lockedUntil.Time.Sub(now)
+					}
+					return nil
+				})
+			},
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if retryAfter > 0 {
+			return nil
+		}
+		for _, key := range keys {
+			failures := attempts[key].failures
+			lastFailureAt := attempts[key].lastFailureAt
+			if !lastFailureAt.Valid || now.Sub(lastFailureAt.Time) > loginFailureWindow {
+				failures = 0
+			}
+			failures++
+			backoff := loginBackoff(failures)
+			_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+				InsertInto(LOGIN_ATTEMPTS).
+				Valuesx(func(col *sq.Column) error {
+					col.SetString(LOGIN_ATTEMPTS.ATTEMPT_KEY, key)
+					col.SetInt(LOGIN_ATTEMPTS.FAILURES, failures)
+					col.SetTime(LOGIN_ATTEMPTS.LAST_FAILURE_AT, now)
+					if backoff > 0 {
+						col.SetTime(LOGIN_ATTEMPTS.LOCKED_UNTIL, now.Add(backoff))
+					} else {
+						col.Set(LOGIN_ATTEMPTS.LOCKED_UNTIL, nil)
+					}
+					return nil
+				}).
+				OnConflict(LOGIN_ATTEMPTS.ATTEMPT_KEY).
+				DoUpdateSet(
+					sq.SetExcluded(LOGIN_ATTEMPTS.FAILURES),
+					sq.SetExcluded(LOGIN_ATTEMPTS.LAST_FAILURE_AT),
+					sq.SetExcluded(LOGIN_ATTEMPTS.LOCKED_UNTIL),
+				),
+				0,
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			if failures < loginLockoutThreshold {
+				continue
+			}
+			log.Printf("login: %s locked out until %s after %d failed attempts", key, now.Add(backoff).Format(time.RFC3339), failures)
+			_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+				InsertInto(LOGIN_LOCKOUTS).
+				Valuesx(func(col *sq.Column) error {
+					col.SetString(LOGIN_LOCKOUTS.ATTEMPT_KEY, key)
+					col.SetInt(LOGIN_LOCKOUTS.FAILURES, failures)
+					col.SetTime(LOGIN_LOCKOUTS.LOCKED_AT, now)
+					col.SetTime(LOGIN_LOCKOUTS.LOCKED_UNTIL, now.Add(backoff))
+					return nil
+				}),
+				0,
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	return retryAfter, nil
+}
+
+// releaseLoginAttempt takes back the failure that reserveLoginAttempt counted
+// against keys, along with any lock that the failure set.
+func (pm *PageManager) releaseLoginAttempt(ctx context.Context, keys []string) error {
+	pm.loginMutex.Lock()
+	defer pm.loginMutex.Unlock()
+	return sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		LOGIN_ATTEMPTS := tables.NEW_LOGIN_ATTEMPTS(ctx, "")
+		for _, key := range keys {
+			var failures int
+			var lastFailureAt sql.NullTime
+			_, err := sq.FetchContext(ctx, tx, sq.SQLite.
+				From(LOGIN_ATTEMPTS).
+				Where(LOGIN_ATTEMPTS.ATTEMPT_KEY.EqString(key)),
+				func(row *sq.Row) error {
+					failures = row.Int(LOGIN_ATTEMPTS.FAILURES)
+					lastFailureAt = row.NullTime(LOGIN_ATTEMPTS.LAST_FAILURE_AT)
+					return nil
+				},
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			if failures == 0 {
+				continue
+			}
+			failures--
+			backoff := loginBackoff(failures)
+			_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+				Update(LOGIN_ATTEMPTS).
+				Setx(func(col *sq.Column) error {
+					col.SetInt(LOGIN_ATTEMPTS.FAILURES, failures)
+					if backoff > 0 && lastFailureAt.Valid {
+						col.SetTime(LOGIN_ATTEMPTS.LOCKED_UNTIL, lastFailureAt.Time.Add(backoff))
+					} else {
+						col.Set(LOGIN_ATTEMPTS.LOCKED_UNTIL, nil)
+					}
+					return nil
+				}).
+				Where(LOGIN_ATTEMPTS.ATTEMPT_KEY.EqString(key)),
+				0,
+			)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+// deleteStaleLoginAttempts forgets failures that are past loginFailureWindow
+// and no longer locking anything.
+func (pm *PageManager) deleteStaleLoginAttempts(ctx context.Context) error {
+	now := time.Now().UTC()
+	LOGIN_ATTEMPTS := tables.NEW_LOGIN_ATTEMPTS(ctx, "")
+	_, _, err := sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		DeleteFrom(LOGIN_ATTEMPTS).
+		Where(
+			LOGIN_ATTEMPTS.LAST_FAILURE_AT.LtTime(now.Add(-loginFailureWindow)),
+			sq.Or(
+				LOGIN_ATTEMPTS.LOCKED_UNTIL.IsNull(),
+				LOGIN_ATTEMPTS.LOCKED_UNTIL.LtTime(now),
+			),
+		),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
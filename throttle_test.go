@@ -0,0 +1,55 @@
+package pagemanager
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_throttleLogin(t *testing.T) {
+	t.Run("concurrent guesses", func(t *testing.T) {
+		is := testutil.New(t)
+		pm := newTestPageManager(t)
+		ctx := context.Background()
+		var checked int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pm.throttleLogin(ctx, "10.0.0.1", "alice", func() error {
+					atomic.AddInt32(&checked, 1)
+					time.Sleep(20 * time.Millisecond)
+					return errIncorrectPassword
+				})
+			}()
+		}
+		wg.Wait()
+		is.Equal(int32(loginFreeAttempts), checked)
+		var lockedErr *loginLockedError
+		err := pm.throttleLogin(ctx, "10.0.0.2", "alice", func() error { return nil })
+		is.True(errors.As(err, &lockedErr))
+	})
+	t.Run("success clears the account", func(t *testing.T) {
+		is := testutil.New(t)
+		pm := newTestPageManager(t)
+		ctx := context.Background()
+		for i := 0; i < loginFreeAttempts-1; i++ {
+			err := pm.throttleLogin(ctx, "10.0.0.1", "alice", func() error { return errIncorrectPassword })
+			is.True(errors.Is(err, errIncorrectPassword))
+		}
+		is.NoErr(pm.throttleLogin(ctx, "10.0.0.1", "alice", func() error { return nil }))
+		// neither the account nor the IP counted the successful attempt
+		for i := 0; i < loginFreeAttempts-1; i++ {
+			err := pm.throttleLogin(ctx, "10.0.0.2", "alice", func() error { return errIncorrectPassword })
+			is.True(errors.Is(err, errIncorrectPassword))
+		}
+		err := pm.throttleLogin(ctx, "10.0.0.1", "bob", func() error { return errIncorrectPassword })
+		is.True(errors.Is(err, errIncorrectPassword))
+	})
+}
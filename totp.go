@@ -0,0 +1,867 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// TOTP (RFC 6238) with the parameters every authenticator app supports:
+// HMAC-SHA1, 6 digits, 30 second steps.
+const (
+	totpDigits    = 6
+	totpPeriod    = 30
+	totpSkew      = 1 // accept codes up to this many steps early or late
+	recoveryCodes = 10
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	h := hmac.New(sha1.New, secret)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// matchTOTP returns the step that code is valid for at time t, and false if
+// it is not valid for any step within the allowed skew.
+func matchTOTP(secret []byte, code string, t time.Time) (step int64, ok bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(t)
+	for step = current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func newTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return secret, nil
+}
+
+// totpURI returns the otpauth:// URI that authenticator apps scan as a QR
+// code to enroll secret.
+func totpURI(issuer, accountName string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", base32NoPadding.EncodeToString(secret))
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + accountName,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// newRecoveryCodes returns recovery codes to show to the user once, and their
+// hashes to store.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodes; i++ {
+		b := make([]byte, 5)
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, nil, erro.Wrap(err)
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// twoFactor is the second factor state of either the superadmin or a user.
+type twoFactor struct {
+	secretCiphertext sql.NullString
+	recoveryCodes    []string // hashed
+	lastStep         int64    // codes for this step or earlier are rejected, to stop replays
+	// rawRecoveryCodes is TOTP_RECOVERY_CODES as loaded, so that using a
+	// recovery code only succeeds if nobody else used one in the meantime
+	rawRecoveryCodes string
+}
+
+func (tf twoFactor) enabled() bool {
+	return tf.secretCiphertext.Valid && tf.secretCiphertext.String != ""
+}
+
+func (pm *PageManager) loadTwoFactor(ctx context.Context, superadmin bool, userID int64) (twoFactor, error) {
+	var tf twoFactor
+	var b []byte
+	var err error
+	if superadmin {
+		SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
+		_, err = sq.FetchContext(ctx, pm.superadminDB, sq.SQLite.
+			From(SUPERADMIN).
+			Where(SUPERADMIN.ID.EqInt(1)),
+			func(row *sq.Row) error {
+				tf.secretCiphertext = row.NullString(SUPERADMIN.TOTP_SECRET_CIPHERTEXT)
+				b = row.Bytes(SUPERADMIN.TOTP_RECOVERY_CODES)
+				tf.lastStep = row.Int64(SUPERADMIN.TOTP_LAST_STEP)
+				return nil
+			},
+		)
+	} else {
+		USERS := tables.NEW_USERS(ctx, "")
+		_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+			From(USERS).
+			Where(USERS.USER_ID.EqInt64(userID)),
+			func(row *sq.Row) error {
+				tf.secretCiphertext = row.NullString(USERS.TOTP_SECRET_CIPHERTEXT)
+				b = row.Bytes(USERS.TOTP_RECOVERY_CODES)
+				tf.lastStep = row.Int64(USERS.TOTP_LAST_STEP)
+				return nil
+			},
+		)
+	}
+	if err != nil {
+		return tf, erro.Wrap(err)
+	}
+	if len(b) > 0 {
+		tf.rawRecoveryCodes = string(b)
+		err = json.Unmarshal(b, &tf.recoveryCodes)
+		if err != nil {
+			return tf, erro.Wrap(err)
+		}
+	}
+	return tf, nil
+}
+
+// saveTwoFactor overwrites the second factor state. A zero twoFactor turns
+// two-factor authentication off.
+func (pm *PageManager) saveTwoFactor(ctx context.Context, superadmin bool, userID int64, tf twoFactor) error {
+	var recoveryCodes interface{}
+	if len(tf.recoveryCodes) > 0 {
+		b, err := json.Marshal(tf.recoveryCodes)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		recoveryCodes = string(b)
+	}
+	var err error
+	if superadmin {
+		SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
+		_, _, err = sq.ExecContext(ctx, pm.superadminDB, sq.SQLite.
+			Update(SUPERADMIN).
+			Setx(func(col *sq.Column) error {
+				col.Set(SUPERADMIN.TOTP_SECRET_CIPHERTEXT, tf.secretCiphertext)
+				col.Set(SUPERADMIN.TOTP_RECOVERY_CODES, recoveryCodes)
+				col.SetInt64(SUPERADMIN.TOTP_LAST_STEP, tf.lastStep)
+				return nil
+			}).
+			Where(SUPERADMIN.ID.EqInt(1)),
+			0,
+		)
+	} else {
+		USERS := tables.NEW_USERS(ctx, "")
+		_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+			Update(USERS).
+			Setx(func(col *sq.Column) error {
+				col.Set(USERS.TOTP_SECRET_CIPHERTEXT, tf.secretCiphertext)
+				col.Set(USERS.TOTP_RECOVERY_CODES, recoveryCodes)
+				col.SetInt64(USERS.TOTP_LAST_STEP, tf.lastStep)
+				return nil
+			}).
+			Where(USERS.USER_ID.EqInt64(userID)),
+			0,
+		)
+	}
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func (pm *PageManager) twoFactorEnabled(ctx context.Context, superadmin bool, userID int64) (bool, error) {
+	tf, err := pm.loadTwoFactor(ctx, superadmin, userID)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	return tf.enabled(), nil
+}
+
+// verifySecondFactor checks code, which is either a TOTP code or an unused
+// recovery code. Accepted codes cannot be used again.
+func (pm *PageManager) verifySecondFactor(ctx context.Context, superadmin bool, userID int64, code string) (bool, error) {
+	tf, err := pm.loadTwoFactor(ctx, superadmin, userID)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	if !tf.enabled() {
+		return false, nil
+	}
+	secret, err := pm.Decrypt(tf.secretCiphertext.String)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	if step, ok := matchTOTP([]byte(secret), code, time.Now()); ok {
+		if step <= tf.lastStep {
+			return false, nil
+		}
+		return pm.useTOTPStep(ctx, superadmin, userID, step)
+	}
+	hash := hashToken(normalizeRecoveryCode(code))
+	for i, recoveryCode := range tf.recoveryCodes {
+		if !hmac.Equal([]byte(recoveryCode), []byte(hash)) {
+			continue
+		}
+		remaining := append(tf.recoveryCodes[:i:i], tf.recoveryCodes[i+1:]...)
+		return pm.useRecoveryCode(ctx, superadmin, userID, tf.rawRecoveryCodes, remaining)
+	}
+	return false, nil
+}
+
+// useTOTPStep records step as the last step used, unless it has been used
+// already by a concurrent login. ok is false if it has.
+func (pm *PageManager) useTOTPStep(ctx context.Context, superadmin bool, userID int64, step int64) (ok bool, err error) {
+	var rowsAffected int64
+	if superadmin {
+		SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
+		rowsAffected, _, err = sq.ExecContext(ctx, pm.superadminDB, sq.SQLite.
+			Update(SUPERADMIN).
+			Setx(func(col *sq.Column) error {
+				col.SetInt64(SUPERADMIN.TOTP_LAST_STEP, step)
+				return nil
+			}).
+			Where(
+				SUPERADMIN.ID.EqInt(1),
+				sq.Or(SUPERADMIN.TOTP_LAST_STEP.IsNull(), SUPERADMIN.TOTP_LAST_STEP.LtInt64(step)),
+			),
+			sq.ErowsAffected,
+		)
+	} else {
+		USERS := tables.NEW_USERS(ctx, "")
+		rowsAffected, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+			Update(USERS).
+			Setx(func(col *sq.Column) error {
+				col.SetInt64(USERS.TOTP_LAST_STEP, step)
+				return nil
+			}).
+			Where(
+				USERS.USER_ID.EqInt64(userID),
+				sq.Or(USERS.TOTP_LAST_STEP.IsNull(), USERS.TOTP_LAST_STEP.LtInt64(step)),
+			),
+			sq.ErowsAffected,
+		)
+	}
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// useRecoveryCode replaces the recovery codes with remaining, unless they
+// are no longer rawRecoveryCodes because a concurrent login used a code
+// first. ok is false if they are not.
+func (pm *PageManager) useRecoveryCode(ctx context.Context, superadmin bool, userID int64, rawRecoveryCodes string, remaining []string) (ok bool, err error) {
+	var recoveryCodes interface{}
+	if len(remaining) > 0 {
+		b, err := json.Marshal(remaining)
+		if err != nil {
+			return false, erro.Wrap(err)
+		}
+		recoveryCodes = string(b)
+	}
+	var rowsAffected int64
+	if superadmin {
+		SUPERADMIN := tables.NEW_SUPERADMIN(withoutTenant(ctx), "")
+		rowsAffected, _, err = sq.ExecContext(ctx, pm.superadminDB, sq.SQLite.
+			Update(SUPERADMIN).
+			Setx(func(col *sq.Column) error {
+				col.Set(SUPERADMIN.TOTP_RECOVERY_CODES, recoveryCodes)
+				return nil
+			}).
+			Where(
+				SUPERADMIN.ID.EqInt(1),
+				sq.Predicatef("? = ?", SUPERADMIN.TOTP_RECOVERY_CODES, rawRecoveryCodes),
+			),
+			sq.ErowsAffected,
+		)
+	} else {
+		USERS := tables.NEW_USERS(ctx, "")
+		rowsAffected, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+			Update(USERS).
+			Setx(func(col *sq.Column) error {
+				col.Set(USERS.TOTP_RECOVERY_CODES, recoveryCodes)
+				return nil
+			}).
+			Where(
+				USERS.USER_ID.EqInt64(userID),
+				sq.Predicatef("? = ?", USERS.TOTP_RECOVERY_CODES, rawRecoveryCodes),
+			),
+			sq.ErowsAffected,
+		)
+	}
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// enableTwoFactor turns on two-factor authentication with secret, provided
+// code proves the user's authenticator app is set up with it. It returns the
+// recovery codes to show to the user.
+func (pm *PageManager) enableTwoFactor(ctx context.Context, superadmin bool, userID int64, secret []byte, code string) (codes []string, ok bool, err error) {
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, false, nil
+	}
+	secretCiphertext, err := pm.Encrypt(string(secret))
+	if err != nil {
+		return nil, false, erro.Wrap(err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, false, erro.Wrap(err)
+	}
+	err = pm.saveTwoFactor(ctx, superadmin, userID, twoFactor{
+		secretCiphertext: sql.NullString{String: secretCiphertext, Valid: true},
+		recoveryCodes:    hashes,
+		lastStep:         step,
+	})
+	if err != nil {
+		return nil, false, erro.Wrap(err)
+	}
+	pm.audit(ctx, AuditTwoFactorEnable, auditAccount(superadmin, userID), nil)
+	return codes, true, nil
+}
+
+// ResetTwoFactor turns off two-factor authentication for a user, for when
+// they have lost both their authenticator and their recovery codes.
+func (pm *PageManager) ResetTwoFactor(ctx context.Context, userID int64) error {
+	err := pm.saveTwoFactor(ctx, false, userID, twoFactor{})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.audit(ctx, AuditTwoFactorDisable, auditAccount(false, userID), map[string]interface{}{"reset": true})
+	return nil
+}
+
+// ResetSuperadminTwoFactor turns off two-factor authentication for the
+// superadmin. It is only reachable from the command line.
+func (pm *PageManager) ResetSuperadminTwoFactor(ctx context.Context) error {
+	err := pm.saveTwoFactor(ctx, true, 0, twoFactor{})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.audit(ctx, AuditTwoFactorDisable, auditAccount(true, 0), map[string]interface{}{"reset": true})
+	return nil
+}
+
+// UserIDByUsername returns the USER_ID of the user called username.
+func (pm *PageManager) UserIDByUsername(ctx context.Context, username string) (int64, error) {
+	var userID int64
+	USERS := tables.NEW_USERS(ctx, "u")
+	rowCount, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(USERS).
+		Where(USERS.USERNAME.EqString(username), USERS.USER_ID.NeInt(0)),
+		func(row *sq.Row) error {
+			userID = row.Int64(USERS.USER_ID)
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	if rowCount == 0 {
+		return 0, erro.Wrap(fmt.Errorf("no such user %q", username))
+	}
+	return userID, nil
+}
+
+const (
+	twoFactorPendingCookieName = "pm-2fa-pending"
+	twoFactorSecretCookieName  = "pm-2fa-secret"
+	// how long a user has to enter their code after entering their password
+	twoFactorPendingLifetime = 5 * time.Minute
+)
+
+// pendingLogin is the login that has passed the password check and is
+// waiting for its second factor. It is kept in a MAC'd cookie.
+type pendingLogin struct {
+	UserID     int64
+	Superadmin bool
+	RememberMe bool
+	ExpiresAt  time.Time
+}
+
+// startSession logs in a user who has passed the password check. If the user
+// has two-factor authentication turned on, they are sent to /pm-2fa for their
+// code instead.
+func (pm *PageManager) startSession(w http.ResponseWriter, r *http.Request, userID int64, superadmin, rememberMe bool) {
+	enabled, err := pm.twoFactorEnabled(r.Context(), superadmin, userID)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		err = hyforms.CookieSet(w, twoFactorPendingCookieName, pendingLogin{
+			UserID:     userID,
+			Superadmin: superadmin,
+			RememberMe: rememberMe,
+			ExpiresAt:  time.Now().Add(twoFactorPendingLifetime),
+		}, &http.Cookie{
+			Path:     "/",
+			MaxAge:   int(twoFactorPendingLifetime / time.Second),
+			HttpOnly: true,
+			Secure:   isSecureRequest(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/pm-2fa", http.StatusFound)
+		return
+	}
+	pm.finishLogin(w, r, pendingLogin{UserID: userID, Superadmin: superadmin, RememberMe: rememberMe})
+}
+
+func (pm *PageManager) finishLogin(w http.ResponseWriter, r *http.Request, login pendingLogin) {
+	sessionData := map[string]interface{}{}
+	if login.Superadmin {
+		sessionData["pm-superadmin"] = true
+	}
+	token, err := pm.createSession(r, login.UserID, sessionData)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token, login.RememberMe)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func clearCookie(w http.ResponseWriter, r *http.Request, name, path string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type twoFactorCodeData struct {
+	Submit string
+	login  pendingLogin
+	ip     string
+	pm     *PageManager
+	ctx    context.Context
+}
+
+// Form asks for a TOTP or recovery code. It is shared by the second login
+// step and the form that turns two-factor authentication off.
+func (d *twoFactorCodeData) Form(form *hyforms.Form) {
+	const incorrectCodeMsg = "incorrect code"
+	// inputs
+	code := form.
+		Text("pm-2fa-code", "").
+		Set("#pm-2fa-code.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "one-time-code", "autofocus": hy.Enabled})
+
+	// marshal
+	form.Set("#twofactorform.bg-white", hy.Attr{"name": "twofactorform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": code.ID()}, hy.Txt("Authentication code or recovery code:")))
+	form.Append("div", nil, code)
+	if hyforms.ErrMsgsMatch(code.ErrMsgs(), incorrectCodeMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("Incorrect code"))
+	}
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt(d.Submit)))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		value := code.Validate(hyforms.Required).Value()
+		if value == "" {
+			return
+		}
+		account := fmt.Sprintf("2fa:%d", d.login.UserID)
+		if d.login.Superadmin {
+			account = "2fa:superadmin"
+		}
+		err := d.pm.throttleLogin(d.ctx, d.ip, account, func() error {
+			ok, err := d.pm.verifySecondFactor(d.ctx, d.login.Superadmin, d.login.UserID, value)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errIncorrectPassword
+			}
+			return nil
+		})
+		if errors.Is(err, errIncorrectPassword) {
+			form.AddInputErrMsgs(code.Name(), incorrectCodeMsg)
+		} else if err != nil {
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+type twoFactorSetupData struct {
+	secret []byte
+	codes  []string
+	user   User
+	pm     *PageManager
+	ctx    context.Context
+}
+
+func (d *twoFactorSetupData) Form(form *hyforms.Form) {
+	const incorrectCodeMsg = "incorrect code"
+	// inputs
+	code := form.
+		Text("pm-2fa-code", "").
+		Set("#pm-2fa-code.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "one-time-code"})
+
+	// marshal
+	form.Set("#twofactorform.bg-white", hy.Attr{"name": "twofactorform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": code.ID()}, hy.Txt("Code from your authenticator app:")))
+	form.Append("div", nil, code)
+	if hyforms.ErrMsgsMatch(code.ErrMsgs(), incorrectCodeMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("Incorrect code, check that your device's clock is correct"))
+	}
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Turn on two-factor authentication")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		value := code.Validate(hyforms.Required).Value()
+		if value == "" {
+			return
+		}
+		var ok bool
+		var err error
+		d.codes, ok, err = d.pm.enableTwoFactor(d.ctx, d.user.Superadmin, d.user.UserID, d.secret, value)
+		if err != nil {
+			form.AddErrMsgs(err.Error())
+		} else if !ok {
+			form.AddInputErrMsgs(code.Name(), incorrectCodeMsg)
+		}
+	})
+}
+
+type twoFactorResetData struct {
+	Username string
+	pm       *PageManager
+	ctx      context.Context
+}
+
+func (d *twoFactorResetData) Form(form *hyforms.Form) {
+	// inputs
+	username := form.
+		Text("pm-user-username", d.Username).
+		Set("#pm-user-username.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled})
+
+	// marshal
+	form.Set("#twofactorresetform.bg-white", hy.Attr{"name": "twofactorresetform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": username.ID()}, hy.Txt("Username:")))
+	form.Append("div", nil, username)
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Reset two-factor authentication")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		d.Username = username.Validate(hyforms.Required).Value()
+		if d.Username == "" {
+			return
+		}
+		userID, err := d.pm.UserIDByUsername(d.ctx, d.Username)
+		if err != nil {
+			form.AddErrMsgs(err.Error())
+			return
+		}
+		err = d.pm.ResetTwoFactor(d.ctx, userID)
+		if err != nil {
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+// twoFactorPage is the data passed to the two-factor.html template.
+type twoFactorPage struct {
+	Title         string
+	Message       string
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+	Form          template.HTML
+}
+
+func (pm *PageManager) serveTwoFactorPage(w http.ResponseWriter, r *http.Request, page twoFactorPage, fn func(*hyforms.Form)) {
+	var err error
+	if fn != nil {
+		page.Form, err = hyforms.MarshalForm(nil, w, r, fn)
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	t, err := pm.parseTemplates(templatesFS, "two-factor.html")
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, page)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// twoFactorLogin is the second login step.
+func (pm *PageManager) twoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-2fa-login"
+	if !pm.requireUnlocked(w, r) {
+		return
+	}
+	var login pendingLogin
+	err := hyforms.CookieGet(r, twoFactorPendingCookieName, &login)
+	if err != nil || login.ExpiresAt.Before(time.Now()) {
+		clearCookie(w, r, twoFactorPendingCookieName, "/")
+		if login.Superadmin {
+			http.Redirect(w, r, "/pm-superadmin", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/pm-login", http.StatusFound)
+		}
+		return
+	}
+	switch r.Method {
+	case "GET":
+		d := &twoFactorCodeData{Submit: "Log in"}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		pm.serveTwoFactorPage(w, r, twoFactorPage{
+			Title:   "Two-factor authentication",
+			Message: "Enter the code from your authenticator app, or one of your recovery codes.",
+		}, d.Form)
+	case "POST":
+		d := &twoFactorCodeData{Submit: "Log in", login: login, ip: clientIP(r), pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		clearCookie(w, r, twoFactorPendingCookieName, "/")
+		pm.finishLogin(w, r, login)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// twoFactorSetup lets the logged in user turn on two-factor authentication.
+// The secret being enrolled is kept encrypted in a cookie until the user
+// confirms it with a code.
+func (pm *PageManager) twoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-2fa-setup"
+	user, ok := CurrentUser(r)
+	if !ok {
+		http.Redirect(w, r, "/pm-login", http.StatusFound)
+		return
+	}
+	if !pm.requireUnlocked(w, r) {
+		return
+	}
+	enabled, err := pm.twoFactorEnabled(r.Context(), user.Superadmin, user.UserID)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Redirect(w, r, "/pm-2fa/disable", http.StatusFound)
+		return
+	}
+	var secret []byte
+	var secretCiphertext string
+	_ = hyforms.CookieGet(r, twoFactorSecretCookieName, &secretCiphertext)
+	if secretCiphertext != "" {
+		s, err := pm.Decrypt(secretCiphertext)
+		if err == nil {
+			secret = []byte(s)
+		}
+	}
+	switch r.Method {
+	case "GET":
+		if len(secret) == 0 {
+			secret, err = newTOTPSecret()
+			if err != nil {
+				http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+				return
+			}
+			secretCiphertext, err = pm.Encrypt(string(secret))
+			if err != nil {
+				http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+				return
+			}
+			err = hyforms.CookieSet(w, twoFactorSecretCookieName, secretCiphertext, &http.Cookie{
+				Path:     "/pm-2fa",
+				MaxAge:   int(time.Hour / time.Second),
+				HttpOnly: true,
+				Secure:   isSecureRequest(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+			if err != nil {
+				http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		d := &twoFactorSetupData{}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		pm.serveTwoFactorPage(w, r, twoFactorPage{
+			Title:   "Set up two-factor authentication",
+			Message: "Scan the QR code for the link below with your authenticator app, or enter the secret into it by hand. Then enter the code it shows.",
+			Secret:  base32NoPadding.EncodeToString(secret),
+			URI:     totpURI("PageManager", user.Username, secret),
+		}, d.Form)
+	case "POST":
+		if len(secret) == 0 {
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		d := &twoFactorSetupData{secret: secret, user: user, pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		clearCookie(w, r, twoFactorSecretCookieName, "/pm-2fa")
+		// the recovery codes are only ever shown here, so render them
+		// directly instead of redirecting
+		pm.serveTwoFactorPage(w, r, twoFactorPage{
+			Title:         "Two-factor authentication is on",
+			Message:       "Save these recovery codes somewhere safe. Each one logs you in once if you lose your authenticator app. They will not be shown again.",
+			RecoveryCodes: d.codes,
+		}, nil)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// twoFactorDisable lets the logged in user turn off two-factor
+// authentication, provided they can still produce a code.
+func (pm *PageManager) twoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-2fa-disable"
+	user, ok := CurrentUser(r)
+	if !ok {
+		http.Redirect(w, r, "/pm-login", http.StatusFound)
+		return
+	}
+	if !pm.requireUnlocked(w, r) {
+		return
+	}
+	tf, err := pm.loadTwoFactor(r.Context(), user.Superadmin, user.UserID)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	if !tf.enabled() {
+		http.Redirect(w, r, "/pm-2fa/setup", http.StatusFound)
+		return
+	}
+	login := pendingLogin{UserID: user.UserID, Superadmin: user.Superadmin}
+	switch r.Method {
+	case "GET":
+		d := &twoFactorCodeData{Submit: "Turn off two-factor authentication"}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		pm.serveTwoFactorPage(w, r, twoFactorPage{
+			Title:   "Two-factor authentication is on",
+			Message: fmt.Sprintf("You have %d unused recovery codes. To turn two-factor authentication off, enter a code from your authenticator app or a recovery code.", len(tf.recoveryCodes)),
+		}, d.Form)
+	case "POST":
+		d := &twoFactorCodeData{Submit: "Turn off two-factor authentication", login: login, ip: clientIP(r), pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		err = pm.saveTwoFactor(r.Context(), user.Superadmin, user.UserID, twoFactor{})
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		pm.audit(r.Context(), AuditTwoFactorDisable, auditAccount(user.Superadmin, user.UserID), nil)
+		http.Redirect(w, r, "/pm-2fa/setup", http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// twoFactorReset lets the superadmin turn off two-factor authentication for a
+// user who has lost their authenticator app and recovery codes.
+func (pm *PageManager) twoFactorReset(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-2fa-reset"
+	user, _ := CurrentUser(r)
+	if !user.Superadmin {
+		pm.forbidden(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		d := &twoFactorResetData{}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		page := twoFactorPage{Title: "Reset a user's two-factor authentication"}
+		if done := r.FormValue("done"); done != "" {
+			page.Message = fmt.Sprintf("Two-factor authentication has been turned off for %s.", done)
+		}
+		pm.serveTwoFactorPage(w, r, page, d.Form)
+	case "POST":
+		d := &twoFactorResetData{pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, LocaleURL(r)+"?done="+url.QueryEscape(d.Username), http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
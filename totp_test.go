@@ -0,0 +1,51 @@
+package pagemanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_verifySecondFactor(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	userID, err := pm.CreateUser(ctx, "alice", "alice@example.com", "correct horse battery staple")
+	is.NoErr(err)
+	secret, err := newTOTPSecret()
+	is.NoErr(err)
+	step := totpStep(time.Now())
+	recoveryCodes, ok, err := pm.enableTwoFactor(ctx, false, userID, secret, totpCode(secret, step-1))
+	is.NoErr(err)
+	is.True(ok)
+
+	// the code that enabled two-factor authentication cannot be replayed
+	ok, err = pm.verifySecondFactor(ctx, false, userID, totpCode(secret, step-1))
+	is.NoErr(err)
+	is.True(!ok)
+
+	// two logins that loaded the same state before either saved it: only
+	// the first may use the step or the recovery code
+	tf, err := pm.loadTwoFactor(ctx, false, userID)
+	is.NoErr(err)
+	for i, want := range []bool{true, false} {
+		ok, err = pm.useTOTPStep(ctx, false, userID, step)
+		is.NoErr(err)
+		is.Equal(want, ok)
+		ok, err = pm.useRecoveryCode(ctx, false, userID, tf.rawRecoveryCodes, tf.recoveryCodes[i+1:])
+		is.NoErr(err)
+		is.Equal(want, ok)
+	}
+	ok, err = pm.verifySecondFactor(ctx, false, userID, totpCode(secret, step))
+	is.NoErr(err)
+	is.True(!ok)
+	ok, err = pm.verifySecondFactor(ctx, false, userID, recoveryCodes[0])
+	is.NoErr(err)
+	is.True(!ok)
+	ok, err = pm.verifySecondFactor(ctx, false, userID, recoveryCodes[1])
+	is.NoErr(err)
+	is.True(ok)
+}
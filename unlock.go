@@ -0,0 +1,210 @@
+package pagemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+)
+
+// The superadmin's inner keys are derived from the superadmin password and
+// never stored, so on startup they have to come from somewhere. The
+// -pm-unlock flag picks where:
+//
+//     prompt         ask for the password on the terminal
+//     file:<path>    read the password from the first line of a file
+//     env:<NAME>     read the password from an environment variable
+//     (empty)        start locked
+//
+// A locked site still serves its public pages. Features that need the keys
+// show an unlock screen instead (see requireUnlocked), and logging in as the
+// superadmin unlocks the keys too.
+
+// Locked reports whether the superadmin's keys have yet to be unlocked.
+func (pm *PageManager) Locked() bool {
+	pm.keysMutex.RLock()
+	defer pm.keysMutex.RUnlock()
+	return len(pm.innerEncryptionKey) == 0 || len(pm.innerMACKey) == 0
+}
+
+// unlockAtStartup unlocks the keys as described by mode, the value of the
+// -pm-unlock flag.
+func (pm *PageManager) unlockAtStartup(ctx context.Context, mode string) error {
+	var password string
+	switch {
+	case mode == "":
+		return nil
+	case mode == "prompt":
+		b, err := readPassword("superadmin password: ")
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		password = string(b)
+	case strings.HasPrefix(mode, "file:"):
+		name := strings.TrimPrefix(mode, "file:")
+		info, err := os.Stat(name)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			log.Printf("warning: password file %s can be read by other users, consider chmod 600", name)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		password = strings.TrimRight(strings.SplitN(string(b), "\n", 2)[0], "\r")
+	case strings.HasPrefix(mode, "env:"):
+		name := strings.TrimPrefix(mode, "env:")
+		password = os.Getenv(name)
+		if password == "" {
+			return fmt.Errorf("environment variable %s is empty", name)
+		}
+		// keep the password out of any process started from here on
+		os.Unsetenv(name)
+	default:
+		return fmt.Errorf(`invalid -pm-unlock %q, expected "prompt", "file:<path>" or "env:<NAME>"`, mode)
+	}
+	err := pm.unlockSuperadmin(ctx, password)
+	if errors.Is(err, errIncorrectPassword) {
+		return fmt.Errorf("could not unlock the keys: %w", err)
+	}
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	via := mode
+	if i := strings.IndexByte(mode, ':'); i >= 0 {
+		via = mode[:i]
+	}
+	pm.audit(ctx, AuditKeyUnlock, "keys", map[string]interface{}{"via": via})
+	return nil
+}
+
+type unlockData struct {
+	Password string
+	Next     string
+	ip       string
+	pm       *PageManager
+	ctx      context.Context
+}
+
+func (d *unlockData) Form(form *hyforms.Form) {
+	const incorrectPasswordMsg = "incorrect password"
+	// inputs
+	password := form.
+		Input("password", "pm-superadmin-password", "").
+		Set("#pm-superadmin-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled})
+	next := form.Hidden("next", d.Next)
+
+	// marshal
+	form.Set("#loginform.bg-white", hy.Attr{"name": "unlockform", "method": "POST", "action": "/pm-unlock"})
+	form.Append("div", nil, next)
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("Superadmin password:")))
+	form.Append("div", nil, password)
+	if hyforms.ErrMsgsMatch(password.ErrMsgs(), incorrectPasswordMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("Incorrect password"))
+	}
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Unlock")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		d.Password = password.Validate(hyforms.Required).Value()
+		d.Next = next.Value()
+		if d.Password == "" {
+			return
+		}
+		// unlocking is audited as key.unlock, it does not log anyone in
+		err := d.pm.throttlePasswordCheck(d.ctx, d.ip, "superadmin", "", func() error {
+			return d.pm.unlockSuperadmin(d.ctx, d.Password)
+		})
+		if errors.Is(err, errIncorrectPassword) {
+			form.AddInputErrMsgs(password.Name(), incorrectPasswordMsg)
+		} else if err != nil {
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+// safeRedirect returns next if it is a path on this site, or "/" otherwise.
+// Browsers drop tabs and newlines and treat backslashes as slashes, so
+// "/\t/evil.example" would be followed to another host; any of those
+// characters in next, or escaped in its path, make next unsafe.
+func safeRedirect(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	for _, s := range []string{next, u.Path} {
+		if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") {
+			return "/"
+		}
+		for _, c := range s {
+			if c <= ' ' || c == 0x7f || c == '\\' {
+				return "/"
+			}
+		}
+	}
+	return next
+}
+
+// unlockPage lets the superadmin unlock the keys of a site that was started
+// locked, without logging in.
+func (pm *PageManager) unlockPage(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-unlock"
+	switch r.Method {
+	case "GET":
+		if !pm.Locked() {
+			http.Redirect(w, r, safeRedirect(r.FormValue("next")), http.StatusFound)
+			return
+		}
+		d := &unlockData{Next: r.FormValue("next")}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		pm.serveUnlockForm(w, r, d)
+	case "POST":
+		d := &unlockData{ip: clientIP(r), pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			d.Password = "" // never round-trip the password through a cookie
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, "/pm-unlock", http.StatusFound)
+			return
+		}
+		pm.audit(r.Context(), AuditKeyUnlock, "keys", map[string]interface{}{"via": "web"})
+		http.Redirect(w, r, safeRedirect(d.Next), http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (pm *PageManager) serveUnlockForm(w http.ResponseWriter, r *http.Request, d *unlockData) {
+	pm.serveUserForm(w, r, "unlock.html", userFormPage{
+		Title:   "Unlock",
+		Message: "The site's keys are locked. The superadmin needs to unlock them before this page can be used.",
+	}, d.Form)
+}
+
+// requireUnlocked serves the unlock screen and returns false if the keys are
+// locked. Handlers that need to encrypt, decrypt or MAC anything call it
+// first.
+func (pm *PageManager) requireUnlocked(w http.ResponseWriter, r *http.Request) bool {
+	if !pm.Locked() {
+		return true
+	}
+	next := LocaleURL(r)
+	if r.Method == "GET" && r.URL.RawQuery != "" {
+		next += "?" + r.URL.RawQuery
+	}
+	pm.serveUnlockForm(w, r, &unlockData{Next: next})
+	return false
+}
@@ -0,0 +1,36 @@
+package pagemanager
+
+import (
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_safeRedirect(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"/pm-sessions", "/pm-sessions"},
+		{"/blog/post?lang=en#top", "/blog/post?lang=en#top"},
+		{"", "/"},
+		{"pm-sessions", "/"},
+		{"https://evil.example", "/"},
+		{"//evil.example", "/"},
+		{"/\\evil.example", "/"},
+		{"/\t/evil.example", "/"},
+		{"/%09/evil.example", "/"},
+		{"/\n/evil.example", "/"},
+		{"/ /evil.example", "/"},
+		{"/a\\b", "/"},
+		{"/%2F/evil.example", "/"},
+		{"/search?q=a%20b", "/search?q=a%20b"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.next, func(t *testing.T) {
+			is := testutil.New(t)
+			is.Equal(tt.want, safeRedirect(tt.next))
+		})
+	}
+}
@@ -0,0 +1,737 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+const (
+	minPasswordLength     = 8
+	passwordResetLifetime = time.Hour
+)
+
+var usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+var (
+	errUsernameTaken      = errors.New("username taken")
+	errEmailTaken         = errors.New("email taken")
+	errInvalidResetToken  = errors.New("invalid or expired password reset token")
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     string
+)
+
+// verifyDummyPassword burns the same amount of time as verifying a real
+// password, so that logging in as a nonexistent user is not measurably faster
+// than logging in with the wrong password.
+func verifyDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		kd, _ := deriveKeyFromPassword("pagemanager")
+		dummyPasswordHash = kd.Marshal()
+	})
+	_ = verifyHashAndPassword(dummyPasswordHash, password)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// CreateUser creates a user with no authz groups and returns its USER_ID.
+// Usernames and emails must be unique.
+func (pm *PageManager) CreateUser(ctx context.Context, username, email, password string) (userID int64, err error) {
+	email = normalizeEmail(email)
+	passwordHash, err := deriveKeyFromPassword(password)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	publicUserID := base64.RawURLEncoding.EncodeToString(b)
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		USERS := tables.NEW_USERS(ctx, "")
+		exists, err := sq.ExistsContext(ctx, tx, sq.SQLite.From(USERS).Where(USERS.USERNAME.EqString(username)))
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if exists {
+			return errUsernameTaken
+		}
+		exists, err = sq.ExistsContext(ctx, tx, sq.SQLite.From(USERS).Where(USERS.EMAIL.EqString(email)))
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if exists {
+			return errEmailTaken
+		}
+		_, userID, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(USERS).
+			Valuesx(func(col *sq.Column) error {
+				col.SetString(USERS.PUBLIC_USER_ID, publicUserID)
+				col.SetString(USERS.USERNAME, username)
+				col.SetString(USERS.EMAIL, email)
+				col.SetString(USERS.PASSWORD_HASH, passwordHash.Marshal())
+				col.Set(USERS.AUTHZ_GROUPS, "[]")
+				return nil
+			}),
+			sq.ElastInsertID,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errUsernameTaken) || errors.Is(err, errEmailTaken) {
+			return 0, err
+		}
+		return 0, erro.Wrap(err)
+	}
+	return userID, nil
+}
+
+// authenticateUser returns the USER_ID of the user whose username or email is
+// login, provided password matches. It returns errIncorrectPassword otherwise.
+func (pm *PageManager) authenticateUser(ctx context.Context, login, password string) (userID int64, err error) {
+	var passwordHash sql.NullString
+	USERS := tables.NEW_USERS(ctx, "u")
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(USERS).
+		Where(
+			USERS.USER_ID.NeInt(0), // user 0 is the superadmin, who logs in at /pm-superadmin
+			sq.Or(
+				USERS.USERNAME.EqString(login),
+				USERS.EMAIL.EqString(normalizeEmail(login)),
+			),
+		).
+		Limit(1),
+		func(row *sq.Row) error {
+			userID = row.Int64(USERS.USER_ID)
+			passwordHash = row.NullString(USERS.PASSWORD_HASH)
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	if !passwordHash.Valid {
+		verifyDummyPassword(password)
+		return 0, errIncorrectPassword
+	}
+	err = verifyHashAndPassword(passwordHash.String, password)
+	if errors.Is(err, errPasswordHashingBusy) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, errIncorrectPassword
+	}
+	if weakerThanPolicy(passwordHash.String) {
+		err = pm.rehashUserPassword(ctx, userID, passwordHash.String, password)
+		if err != nil {
+			log.Printf("upgrading user %d's argon2 parameters: %s", userID, err)
+		}
+	}
+	return userID, nil
+}
+
+// rehashUserPassword replaces a user's password hash oldHash with a hash of
+// the same password made with argon2Policy. Unlike setUserPassword it leaves
+// the user's sessions alone, and it does nothing if the hash has changed in
+// the meantime.
+func (pm *PageManager) rehashUserPassword(ctx context.Context, userID int64, oldHash, password string) error {
+	passwordHash, err := deriveKeyFromPassword(password)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	USERS := tables.NEW_USERS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		Update(USERS).
+		Setx(func(col *sq.Column) error {
+			col.SetString(USERS.PASSWORD_HASH, passwordHash.Marshal())
+			return nil
+		}).
+		Where(
+			USERS.USER_ID.EqInt64(userID),
+			USERS.PASSWORD_HASH.EqString(oldHash),
+		),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// setUserPassword changes a user's password and logs them out everywhere, so
+// that whoever knew the old password loses access.
+func setUserPassword(ctx context.Context, db sq.Queryer, userID int64, password string) error {
+	passwordHash, err := deriveKeyFromPassword(password)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	USERS := tables.NEW_USERS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		Update(USERS).
+		Setx(func(col *sq.Column) error {
+			col.SetString(USERS.PASSWORD_HASH, passwordHash.Marshal())
+			return nil
+		}).
+		Where(USERS.USER_ID.EqInt64(userID)),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(SESSIONS.USER_ID.EqInt64(userID)),
+		0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// SendPasswordReset emails a password reset link to the user with the given
+// email. resetURL is the absolute URL of the reset page, the token is appended
+// as a query parameter. It does nothing if there is no such user, so that the
+// response does not reveal which emails have accounts. For the same reason
+// the token is made and the email sent in the background, since doing that
+// before returning would make SendPasswordReset take measurably longer for
+// emails that have accounts; errors are logged instead.
+func (pm *PageManager) SendPasswordReset(ctx context.Context, email, resetURL string) error {
+	email = normalizeEmail(email)
+	var userID int64
+	var found bool
+	USERS := tables.NEW_USERS(ctx, "u")
+	_, err := sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(USERS).
+		Where(USERS.USER_ID.NeInt(0), USERS.EMAIL.EqString(email)).
+		Limit(1),
+		func(row *sq.Row) error {
+			userID = row.Int64(USERS.USER_ID)
+			found = true
+			return nil
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !found {
+		return nil
+	}
+	// the request's context is cancelled once the response is written
+	go func(ctx context.Context) {
+		err := pm.sendPasswordReset(ctx, userID, email, resetURL)
+		if err != nil {
+			log.Printf("sending a password reset to user %d: %s", userID, err)
+		}
+	}(WithTenant(context.Background(), tenantID(ctx)))
+	return nil
+}
+
+func (pm *PageManager) sendPasswordReset(ctx context.Context, userID int64, email, resetURL string) error {
+	token, err := pm.createPasswordResetToken(ctx, userID)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	body := "Someone asked to reset the password for your account. If it was you, open this link within " +
+		passwordResetLifetime.String() + " to choose a new password:\n\n" +
+		resetURL + "?token=" + url.QueryEscape(token) + "\n\n" +
+		"If it wasn't you, you can ignore this email."
+	err = pm.mailer.SendMail(ctx, email, "Reset your password", body)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// createPasswordResetToken returns a token of the form
+// <userID>.<expiry unix time>.<nonce>.<MAC>. The MAC stops anyone from
+// forging tokens, the pm_password_resets row makes each token single-use.
+func (pm *PageManager) createPasswordResetToken(ctx context.Context, userID int64) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(passwordResetLifetime)
+	payload := strconv.FormatInt(userID, 10) + "." + strconv.FormatInt(expiresAt.Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(b)
+	mac, err := pm.MAC(payload)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	token := payload + "." + mac
+	PASSWORD_RESETS := tables.NEW_PASSWORD_RESETS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+		InsertInto(PASSWORD_RESETS).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(PASSWORD_RESETS.TOKEN_HASH, hashToken(token))
+			col.SetInt64(PASSWORD_RESETS.USER_ID, userID)
+			col.SetTime(PASSWORD_RESETS.CREATED_AT, now)
+			col.SetTime(PASSWORD_RESETS.EXPIRES_AT, expiresAt)
+			return nil
+		}),
+		0,
+	)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return token, nil
+}
+
+// ResetPassword sets a new password for the user that token was issued to and
+// logs that user out everywhere. It returns errInvalidResetToken if token is
+// forged, expired or has already been used.
+func (pm *PageManager) ResetPassword(ctx context.Context, token, password string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return errInvalidResetToken
+	}
+	ok, err := pm.VerifyMAC(strings.Join(parts[:3], "."), parts[3])
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !ok {
+		return errInvalidResetToken
+	}
+	userID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errInvalidResetToken
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errInvalidResetToken
+	}
+	now := time.Now().UTC()
+	if now.Unix() >= expiry {
+		return errInvalidResetToken
+	}
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		PASSWORD_RESETS := tables.NEW_PASSWORD_RESETS(ctx, "")
+		rowsAffected, _, err := sq.ExecContext(ctx, tx, sq.SQLite.
+			Update(PASSWORD_RESETS).
+			Setx(func(col *sq.Column) error {
+				col.SetTime(PASSWORD_RESETS.USED_AT, now)
+				return nil
+			}).
+			Where(
+				PASSWORD_RESETS.TOKEN_HASH.EqString(hashToken(token)),
+				PASSWORD_RESETS.USER_ID.EqInt64(userID),
+				PASSWORD_RESETS.USED_AT.IsNull(),
+			),
+			sq.ErowsAffected,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if rowsAffected == 0 {
+			return errInvalidResetToken
+		}
+		err = setUserPassword(ctx, tx, userID, password)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errInvalidResetToken) {
+			return err
+		}
+		return erro.Wrap(err)
+	}
+	pm.audit(ctx, AuditPasswordChange, auditAccount(false, userID), map[string]interface{}{"via": "reset", "sessions_revoked": true})
+	return nil
+}
+
+// validateNewPassword checks the password and confirm-password inputs. The
+// length check is done by hand because the hyforms validators would copy the
+// password into the error message, which round-trips through a cookie.
+func validateNewPassword(form *hyforms.Form, password, confirmPassword *hyforms.Input) string {
+	const passwordTooShortMsg = "password too short"
+	const passwordMismatchMsg = "passwords do not match"
+	value := password.Value()
+	if len([]rune(value)) < minPasswordLength {
+		form.AddInputErrMsgs(password.Name(), passwordTooShortMsg)
+	} else if confirmPassword.Value() != value {
+		form.AddInputErrMsgs(confirmPassword.Name(), passwordMismatchMsg)
+	}
+	return value
+}
+
+func appendPasswordErrMsgs(form *hyforms.Form, password, confirmPassword *hyforms.Input) {
+	if hyforms.ErrMsgsMatch(password.ErrMsgs(), "password too short") {
+		form.Append("div.f7.red", nil, hy.Txt(fmt.Sprintf("Passwords must be at least %d characters long", minPasswordLength)))
+	}
+	if hyforms.ErrMsgsMatch(confirmPassword.ErrMsgs(), "passwords do not match") {
+		form.Append("div.f7.red", nil, hy.Txt("Passwords do not match"))
+	}
+}
+
+type userLoginData struct {
+	Login      string
+	RememberMe bool
+	userID     int64
+	ip         string
+	pm         *PageManager
+	ctx        context.Context
+}
+
+func (d *userLoginData) Form(form *hyforms.Form) {
+	// inputs
+	login := form.
+		Text("pm-user-login", d.Login).
+		Set("#pm-user-login.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "username"})
+	password := form.
+		Input("password", "pm-user-password", "").
+		Set("#pm-user-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "current-password"})
+	rememberme := form.
+		Checkbox("remember-me", "", d.RememberMe).
+		Set("#remember-me.pointer", nil)
+
+	// marshal
+	form.Set("#loginform.bg-white", hy.Attr{"name": "loginform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": login.ID()}, hy.Txt("Username or Email Address:")))
+	form.Append("div", nil, login)
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("Password:")))
+	form.Append("div", nil, password)
+	form.Append("div.mv2.pt2", nil, rememberme, hy.H("label.ml1.pointer", hy.Attr{"for": rememberme.ID()}, hy.Txt("Remember Me")))
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Log in")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		d.Login = login.Validate(hyforms.Required).Value()
+		d.RememberMe = rememberme.Checked()
+		pw := password.Value()
+		if d.Login == "" || pw == "" {
+			form.AddErrMsgs("Please enter your username or email and your password")
+			return
+		}
+		err := d.pm.throttleLogin(d.ctx, d.ip, d.Login, func() error {
+			var err error
+			d.userID, err = d.pm.authenticateUser(d.ctx, d.Login, pw)
+			return err
+		})
+		if errors.Is(err, errIncorrectPassword) {
+			form.AddErrMsgs("Incorrect username, email or password")
+		} else if err != nil {
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+type userSignupData struct {
+	Username string
+	Email    string
+	userID   int64
+	pm       *PageManager
+	ctx      context.Context
+}
+
+func (d *userSignupData) Form(form *hyforms.Form) {
+	const usernameTakenMsg = "username taken"
+	const emailTakenMsg = "email taken"
+	// inputs
+	username := form.
+		Text("pm-user-username", d.Username).
+		Set("#pm-user-username.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "username"})
+	email := form.
+		Input("email", "pm-user-email", d.Email).
+		Set("#pm-user-email.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "email"})
+	password := form.
+		Input("password", "pm-user-password", "").
+		Set("#pm-user-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+	confirmPassword := form.
+		Input("password", "pm-user-confirm-password", "").
+		Set("#pm-user-confirm-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+
+	// marshal
+	form.Set("#signupform.bg-white", hy.Attr{"name": "signupform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": username.ID()}, hy.Txt("Username:")))
+	form.Append("div", nil, username)
+	if hyforms.ErrMsgsMatch(username.ErrMsgs(), hyforms.IsRegexpErrMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("Usernames are 3 to 32 letters, digits, dots, dashes or underscores"))
+	}
+	if hyforms.ErrMsgsMatch(username.ErrMsgs(), usernameTakenMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("That username is taken"))
+	}
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": email.ID()}, hy.Txt("Email Address:")))
+	form.Append("div", nil, email)
+	if hyforms.ErrMsgsMatch(email.ErrMsgs(), hyforms.IsEmailErrMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("That is not a valid email address"))
+	}
+	if hyforms.ErrMsgsMatch(email.ErrMsgs(), emailTakenMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("An account with that email address already exists"))
+	}
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("Password:")))
+	form.Append("div", nil, password)
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": confirmPassword.ID()}, hy.Txt("Confirm Password:")))
+	form.Append("div", nil, confirmPassword)
+	appendPasswordErrMsgs(form, password, confirmPassword)
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Sign up")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		d.Username = username.Validate(hyforms.Required, hyforms.IsRegexp(usernameRegexp)).Value()
+		d.Email = email.Validate(hyforms.Required, hyforms.IsEmail).Value()
+		pw := validateNewPassword(form, password, confirmPassword)
+		if len(username.ErrMsgs()) > 0 || len(email.ErrMsgs()) > 0 || len(password.ErrMsgs()) > 0 || len(confirmPassword.ErrMsgs()) > 0 {
+			return
+		}
+		var err error
+		d.userID, err = d.pm.CreateUser(d.ctx, d.Username, d.Email, pw)
+		switch {
+		case errors.Is(err, errUsernameTaken):
+			form.AddInputErrMsgs(username.Name(), usernameTakenMsg)
+		case errors.Is(err, errEmailTaken):
+			form.AddInputErrMsgs(email.Name(), emailTakenMsg)
+		case err != nil:
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+type forgotPasswordData struct {
+	Email    string
+	resetURL string
+	pm       *PageManager
+	ctx      context.Context
+}
+
+func (d *forgotPasswordData) Form(form *hyforms.Form) {
+	// inputs
+	email := form.
+		Input("email", "pm-user-email", d.Email).
+		Set("#pm-user-email.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "email"})
+
+	// marshal
+	form.Set("#loginform.bg-white", hy.Attr{"name": "forgotpasswordform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": email.ID()}, hy.Txt("Email Address:")))
+	form.Append("div", nil, email)
+	if hyforms.ErrMsgsMatch(email.ErrMsgs(), hyforms.IsEmailErrMsg) {
+		form.Append("div.f7.red", nil, hy.Txt("That is not a valid email address"))
+	}
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Email me a reset link")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		d.Email = email.Validate(hyforms.Required, hyforms.IsEmail).Value()
+		if len(email.ErrMsgs()) > 0 {
+			return
+		}
+		err := d.pm.SendPasswordReset(d.ctx, d.Email, d.resetURL)
+		if err != nil {
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+type resetPasswordData struct {
+	Token string
+	pm    *PageManager
+	ctx   context.Context
+}
+
+func (d *resetPasswordData) Form(form *hyforms.Form) {
+	// inputs
+	token := form.Hidden("token", d.Token)
+	password := form.
+		Input("password", "pm-user-password", "").
+		Set("#pm-user-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+	confirmPassword := form.
+		Input("password", "pm-user-confirm-password", "").
+		Set("#pm-user-confirm-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+
+	// marshal
+	form.Set("#loginform.bg-white", hy.Attr{"name": "resetpasswordform", "method": "POST", "action": ""})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.AppendElements(token)
+	form.Append("div.mv2", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("New Password:")))
+	form.Append("div", nil, password)
+	form.Append("div.mv2.pt2", nil, hy.H("label.pointer", hy.Attr{"for": confirmPassword.ID()}, hy.Txt("Confirm New Password:")))
+	form.Append("div", nil, confirmPassword)
+	appendPasswordErrMsgs(form, password, confirmPassword)
+	form.Append("div.mv2.pt2", nil, hy.H("button.pointer", hy.Attr{"type": "submit"}, hy.Txt("Set password")))
+
+	// unmarshal
+	form.Unmarshal(func() {
+		d.Token = token.Value()
+		pw := validateNewPassword(form, password, confirmPassword)
+		if len(password.ErrMsgs()) > 0 || len(confirmPassword.ErrMsgs()) > 0 {
+			return
+		}
+		err := d.pm.ResetPassword(d.ctx, d.Token, pw)
+		if errors.Is(err, errInvalidResetToken) {
+			form.AddErrMsgs("This password reset link is invalid, has expired or has already been used")
+		} else if err != nil {
+			form.AddErrMsgs(err.Error())
+		}
+	})
+}
+
+// userFormPage is the data passed to the login, signup and password reset
+// templates.
+type userFormPage struct {
+	Title   string
+	Message string
+	Form    template.HTML
+}
+
+func (pm *PageManager) serveUserForm(w http.ResponseWriter, r *http.Request, file string, page userFormPage, fn func(*hyforms.Form)) {
+	var err error
+	page.Form, err = hyforms.MarshalForm(nil, w, r, fn)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := pm.parseTemplates(templatesFS, file)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+	err = executeTemplate(t, w, page)
+	if err != nil {
+		http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (pm *PageManager) userLogin(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-user-login"
+	switch r.Method {
+	case "GET":
+		d := &userLoginData{}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		page := userFormPage{Title: "Log in"}
+		if r.FormValue("reset") != "" {
+			page.Message = "Your password has been changed, please log in with your new password."
+		}
+		pm.serveUserForm(w, r, "login.html", page, d.Form)
+	case "POST":
+		d := &userLoginData{ip: clientIP(r), pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		pm.startSession(w, r, d.userID, false, d.RememberMe)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (pm *PageManager) userSignup(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-user-signup"
+	switch r.Method {
+	case "GET":
+		d := &userSignupData{}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		pm.serveUserForm(w, r, "signup.html", userFormPage{Title: "Sign up"}, d.Form)
+	case "POST":
+		d := &userSignupData{pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		token, err := pm.createSession(r, d.userID, map[string]interface{}{})
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, r, token, false)
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (pm *PageManager) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	const formCookieName = "pm-forgot-password"
+	if !pm.requireUnlocked(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		d := &forgotPasswordData{}
+		_ = hyforms.CookiePop(w, r, formCookieName, d)
+		page := userFormPage{Title: "Forgot your password?"}
+		if r.FormValue("sent") != "" {
+			page.Message = "If an account with that email address exists, we have sent it a link to reset its password."
+		}
+		pm.serveUserForm(w, r, "password-reset.html", page, d.Form)
+	case "POST":
+		siteURL, err := pm.tenantURL(r.Context())
+		if err != nil {
+			http.Error(w, erro.Wrap(err).Error(), http.StatusInternalServerError)
+			return
+		}
+		d := &forgotPasswordData{pm: pm, ctx: r.Context(), resetURL: siteURL + "/pm-reset-password"}
+		err = hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			_ = hyforms.CookieSet(w, formCookieName, d, nil)
+			http.Redirect(w, r, LocaleURL(r), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, LocaleURL(r)+"?sent=1", http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (pm *PageManager) resetPassword(w http.ResponseWriter, r *http.Request) {
+	if !pm.requireUnlocked(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		d := &resetPasswordData{Token: r.FormValue("token")}
+		pm.serveUserForm(w, r, "password-reset.html", userFormPage{Title: "Choose a new password"}, d.Form)
+	case "POST":
+		d := &resetPasswordData{pm: pm, ctx: r.Context()}
+		err := hyforms.UnmarshalForm(w, r, d.Form)
+		if err != nil {
+			http.Redirect(w, r, LocaleURL(r)+"?token="+url.QueryEscape(d.Token), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/pm-login?reset=1", http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,110 @@
+package pagemanager
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+// chanMailer sends every email body to a channel.
+type chanMailer chan string
+
+func (m chanMailer) SendMail(ctx context.Context, to, subject, body string) error {
+	m <- body
+	return nil
+}
+
+func Test_authenticateUser(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	cheapArgon2(t)
+	ctx := context.Background()
+	userID, err := pm.CreateUser(ctx, "alice", "Alice@Example.com", "password1")
+	is.NoErr(err)
+	tests := []struct {
+		description string
+		login       string
+		password    string
+		wantErr     error
+	}{
+		{"username", "alice", "password1", nil},
+		{"email", "alice@example.com", "password1", nil},
+		{"email is normalized", " ALICE@example.com ", "password1", nil},
+		{"wrong password", "alice", "password2", errIncorrectPassword},
+		{"no such user", "bob", "password1", errIncorrectPassword},
+		{"superadmin", "superadmin", "password1", errIncorrectPassword},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			is := testutil.New(t)
+			gotID, err := pm.authenticateUser(ctx, tt.login, tt.password)
+			if tt.wantErr != nil {
+				is.True(errors.Is(err, tt.wantErr))
+				return
+			}
+			is.NoErr(err)
+			is.Equal(userID, gotID)
+		})
+	}
+}
+
+func Test_ResetPassword(t *testing.T) {
+	is := testutil.New(t)
+	pm := newTestPageManager(t)
+	unlockTestPageManager(t, pm)
+	ctx := context.Background()
+	mailer := make(chanMailer, 1)
+	pm.SetMailer(mailer)
+	userID, err := pm.CreateUser(ctx, "alice", "alice@example.com", "password1")
+	is.NoErr(err)
+
+	// unknown emails are not told apart from known ones
+	is.NoErr(pm.SendPasswordReset(ctx, "bob@example.com", "https://example.com/pm-reset-password"))
+	is.NoErr(pm.SendPasswordReset(ctx, "alice@example.com", "https://example.com/pm-reset-password"))
+	var body string
+	select {
+	case body = <-mailer:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no password reset email was sent")
+	}
+	i := strings.Index(body, "?token=")
+	is.True(i >= 0)
+	token, err := url.QueryUnescape(strings.Fields(body[i+len("?token="):])[0])
+	is.NoErr(err)
+	select {
+	case body = <-mailer:
+		t.Fatalf("unexpected email: %s", body)
+	default:
+	}
+
+	t.Run("forged", func(t *testing.T) {
+		is := testutil.New(t)
+		parts := strings.Split(token, ".")
+		parts[0] = strconv.FormatInt(userID+1, 10)
+		is.True(errors.Is(pm.ResetPassword(ctx, strings.Join(parts, "."), "password2"), errInvalidResetToken))
+		is.True(errors.Is(pm.ResetPassword(ctx, "not a token", "password2"), errInvalidResetToken))
+	})
+	t.Run("expired", func(t *testing.T) {
+		is := testutil.New(t)
+		payload := strconv.FormatInt(userID, 10) + "." + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ".nonce"
+		mac, err := pm.MAC(payload)
+		is.NoErr(err)
+		is.True(errors.Is(pm.ResetPassword(ctx, payload+"."+mac, "password2"), errInvalidResetToken))
+	})
+	t.Run("single use", func(t *testing.T) {
+		is := testutil.New(t)
+		is.NoErr(pm.ResetPassword(ctx, token, "password2"))
+		_, err := pm.authenticateUser(ctx, "alice", "password2")
+		is.NoErr(err)
+		is.True(errors.Is(pm.ResetPassword(ctx, token, "password3"), errInvalidResetToken))
+		_, err = pm.authenticateUser(ctx, "alice", "password2")
+		is.NoErr(err)
+	})
+}